@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,6 +14,8 @@ import (
 	"github.com/rs/zerolog/log"
 	torrxfer "github.com/sushshring/torrxfer/pkg/client"
 	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"github.com/sushshring/torrxfer/pkg/net"
 	"github.com/vbauerster/mpb/v6"
 	"github.com/vbauerster/mpb/v6/decor"
 )
@@ -20,16 +24,117 @@ var (
 	name      = "torrxfer-client"
 	app       = kingpin.New(name, "Torrent downloaded file transfer server")
 	debug     = app.Flag("debug", "Enable debug mode").Default("false").OverrideDefaultFromEnvar("TORRXFER_CLIENT_DEBUG").Bool()
-	config    = app.Flag("config", "Path to configuration file").Required().File()
+	config    = app.Flag("config", "Path to configuration file. Required by all commands except decrypt and encryption").File()
 	trace     = app.Flag("trace", "Enable trace mode").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_TRACE").Bool()
 	logToFile = app.Flag("nopretty", "Output progress as log statements instead of progress bars").
 			Default("false").
 			OverrideDefaultFromEnvar("TORRXFER_CLIENT_NOPRETTY").
 			Bool()
 
-	version = "0.1"
+	runCmd = app.Command("run", "Watch directories and transfer files to the configured servers").Default()
+
+	pairCmd     = app.Command("pair", "Pair with a server using a code from torrxfer-server pair and add it to the config")
+	pairAddress = pairCmd.Arg("address", "Server address as host:port").Required().String()
+	pairCode    = pairCmd.Arg("code", "Pairing code").Required().String()
+
+	trustCmd            = app.Command("trust", "Manage the certificates pinned for TLS servers")
+	trustListCmd        = trustCmd.Command("list", "List pinned servers")
+	trustAddCmd         = trustCmd.Command("add", "Pin the certificate a server presents, replacing any existing pin")
+	trustAddAddress     = trustAddCmd.Arg("address", "Server address as host:port").Required().String()
+	trustAddFingerprint = trustAddCmd.Flag("fingerprint", "SHA-256 fingerprint of the server certificate. Fetched from the server if not set").String()
+	trustRemoveCmd      = trustCmd.Command("remove", "Forget the certificate pinned for a server")
+	trustRemoveAddress  = trustRemoveCmd.Arg("address", "Server address as host:port").Required().String()
+
+	encryptionCmd       = app.Command("encryption", "Manage keys files are encrypted with before they are sent")
+	encryptionGenkeyCmd = encryptionCmd.Command("genkey", "Generate a new encryption key to use as EncryptionKeyFile")
+	encryptionGenkeyOut = encryptionGenkeyCmd.Arg("path", "File to write the key to").Required().String()
+
+	decryptCmd = app.Command("decrypt", "Restore the plaintext of a file stored encrypted on a server")
+	decryptKey = decryptCmd.Flag("key", "The EncryptionKeyFile the file was encrypted with").Required().String()
+	decryptIn  = decryptCmd.Arg("in", "Encrypted file").Required().String()
+	decryptOut = decryptCmd.Arg("out", "File to write the plaintext to. Defaults to the encrypted file without its suffix").String()
+
+	version = common.Version
 )
 
+// runTrustCommand manages the known servers store of the configured client
+func runTrustCommand(command string) {
+	clientConfig, err := torrxfer.ReadConfig(*config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not read config")
+	}
+	knownServers := net.NewKnownServers(torrxfer.KnownServersPath((*config).Name(), clientConfig))
+
+	switch command {
+	case trustListCmd.FullCommand():
+		servers, err := knownServers.List()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not list known servers")
+		}
+		for _, server := range servers {
+			fmt.Printf("%s\t%s\n", server.Address, server.Fingerprint)
+		}
+	case trustAddCmd.FullCommand():
+		fingerprint := *trustAddFingerprint
+		if fingerprint == "" {
+			fingerprint, err = net.FetchServerFingerprint(*trustAddAddress)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Could not fetch server certificate")
+			}
+			// The fetched certificate is unverified, so show it for the user to compare out of band
+			fmt.Printf("%s presented certificate %s\n", *trustAddAddress, fingerprint)
+		}
+		if err := knownServers.Add(*trustAddAddress, fingerprint); err != nil {
+			log.Fatal().Err(err).Msg("Could not pin server")
+		}
+	case trustRemoveCmd.FullCommand():
+		removed, err := knownServers.Remove(*trustRemoveAddress)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not remove server")
+		}
+		if !removed {
+			log.Fatal().Str("Address", *trustRemoveAddress).Msg("Server is not pinned")
+		}
+	}
+}
+
+// runDecryptCommand writes the plaintext of an encrypted file. The output is only moved into place once the whole file
+// has been authenticated
+func runDecryptCommand() error {
+	key, err := crypto.ReadEncryptionKey(*decryptKey)
+	if err != nil {
+		return err
+	}
+	out := *decryptOut
+	if out == "" {
+		if !strings.HasSuffix(*decryptIn, crypto.EncryptedFileSuffix) {
+			return fmt.Errorf("%s does not end in %s. Provide the output file", *decryptIn, crypto.EncryptedFileSuffix)
+		}
+		out = strings.TrimSuffix(*decryptIn, crypto.EncryptedFileSuffix)
+	}
+	in, err := os.Open(*decryptIn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	temp, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if err := crypto.Decrypt(key, bufio.NewReader(in), temp); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s already exists", out)
+	}
+	return os.Rename(temp.Name(), out)
+}
+
 type barDetails struct {
 	bar       *mpb.Bar
 	startTime time.Time
@@ -40,7 +145,7 @@ type barDetails struct {
 
 func main() {
 	app.Version(version)
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 	var level zerolog.Level
 	if *trace {
 		level = zerolog.TraceLevel
@@ -51,6 +156,36 @@ func main() {
 	}
 	common.ConfigureLogging(level, false, os.Stderr)
 
+	switch command {
+	case encryptionGenkeyCmd.FullCommand():
+		if err := crypto.GenerateEncryptionKey(*encryptionGenkeyOut); err != nil {
+			log.Fatal().Err(err).Msg("Could not generate encryption key")
+		}
+		log.Info().Str("Path", *encryptionGenkeyOut).Msg("Generated encryption key. Keep a copy, files can not be decrypted without it")
+		return
+	case decryptCmd.FullCommand():
+		if err := runDecryptCommand(); err != nil {
+			log.Fatal().Err(err).Msg("Could not decrypt file")
+		}
+		return
+	}
+	if *config == nil {
+		log.Fatal().Msg("--config must be provided")
+	}
+
+	switch command {
+	case pairCmd.FullCommand():
+		server, err := torrxfer.PairServer((*config).Name(), *pairAddress, *pairCode)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not pair with server")
+		}
+		log.Info().Str("Address", server.Address).Uint32("Port", server.Port).Msg("Added server to config")
+		return
+	case trustListCmd.FullCommand(), trustAddCmd.FullCommand(), trustRemoveCmd.FullCommand():
+		runTrustCommand(command)
+		return
+	}
+
 	log.Debug().Msg("Starting the Torrxfer client")
 
 	client := torrxfer.NewTorrxferClient()
@@ -76,6 +211,10 @@ func main() {
 			log.Info().Object("Server", notification.Connection).Msg("Disconnected")
 		case torrxfer.ConnectionNotificationTypeQueryError:
 			fallthrough
+		case torrxfer.ConnectionNotificationTypeVerificationError:
+			fallthrough
+		case torrxfer.ConnectionNotificationTypeFatalError:
+			fallthrough
 		case torrxfer.ConnectionNotificationTypeTransferError:
 			log.Error().Err(notification.Error).Object("Server", notification.Connection).Object("File", notification.SentFile).Msg("Error")
 		case torrxfer.ConnectionNotificationTypeFilesUpdated:
@@ -1,29 +1,89 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	glog "log"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/inhies/go-bytesize"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
 	"github.com/sushshring/torrxfer/pkg/server"
 )
 
 var (
-	app     = kingpin.New("torrxfer-server", "Torrent downloaded file transfer server")
-	debug   = app.Flag("debug", "Enable debug mode").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_DEBUG").Bool()
-	tls     = app.Flag("tls", "Should server use TLS vs plain TCP").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_TLS").Bool()
-	cafile  = app.Flag("cafile", "The file containing the CA root cert file").String()
-	keyfile = app.Flag("keyfile", "The file containing the CA root key file").String()
-	trace   = app.Flag("trace", "Enable trace mode").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_TRACE").Bool()
-	version = "0.1"
+	app      = kingpin.New("torrxfer-server", "Torrent downloaded file transfer server")
+	debug    = app.Flag("debug", "Enable debug mode").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_DEBUG").Bool()
+	tls      = app.Flag("tls", "Should server use TLS vs plain TCP").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_TLS").Bool()
+	cafile   = app.Flag("cafile", "The file containing the CA root cert file").String()
+	keyfile  = app.Flag("keyfile", "The file containing the CA root key file").String()
+	clientca = app.Flag("clientca", "The file containing the CA bundle client certificates must be signed by. Requires --tls").String()
+	tokenkey = app.Flag("tokenkey", "The file containing the key client tokens are signed with. Requires --tls or --pskfile").OverrideDefaultFromEnvar("TORRXFER_SERVER_TOKEN_KEY").String()
+	pskfile  = app.Flag("pskfile", "The file containing a pre-shared key to secure connections with instead of --tls").OverrideDefaultFromEnvar("TORRXFER_SERVER_PSK_FILE").String()
+	trace    = app.Flag("trace", "Enable trace mode").Default("false").OverrideDefaultFromEnvar("TORRXFER_SERVER_TRACE").Bool()
+
+	serveCmd = app.Command("serve", "Run the transfer server").Default()
+
+	tokenCmd       = app.Command("token", "Manage client tokens. Requires --tokenkey")
+	tokenGenkeyCmd = tokenCmd.Command("genkey", "Generate a new token key")
+	tokenIssueCmd  = tokenCmd.Command("issue", "Issue a token for a client")
+	tokenIssueName = tokenIssueCmd.Arg("identity", "Identity of the client, used to look up its policy").Required().String()
+	tokenIssueTTL  = tokenIssueCmd.Flag("ttl", "How long the token is valid for. 0 never expires").Default("8760h").Duration()
+
+	pskCmd       = app.Command("psk", "Manage the pre-shared key. Requires --pskfile")
+	pskGenkeyCmd = pskCmd.Command("genkey", "Generate a new pre-shared key")
+
+	certCmd              = app.Command("cert", "Manage the built-in certificate authority in TORRXFER_SERVER_CERTDIR")
+	certInitCmd          = certCmd.Command("init", "Create the certificate authority")
+	certInitName         = certInitCmd.Flag("name", "Common name of the certificate authority").Default("torrxfer CA").String()
+	certIssueServerCmd   = certCmd.Command("issue-server", "Issue the server certificate used by --tls when --cafile is not set")
+	certIssueServerHosts = certIssueServerCmd.Flag("host", "DNS name or IP address clients connect to. Repeatable. Defaults to the server address and hostname").Strings()
+	certIssueServerTTL   = certIssueServerCmd.Flag("ttl", "How long the certificate is valid for").Default("8760h").Duration()
+	certIssueClientCmd   = certCmd.Command("issue-client", "Issue a client certificate for mutual TLS")
+	certIssueClientName  = certIssueClientCmd.Arg("identity", "Identity of the client, used to look up its policy").Required().String()
+	certIssueClientOut   = certIssueClientCmd.Flag("out", "Directory to write <identity>.pem and <identity>.key to").Default(".").String()
+	certIssueClientTTL   = certIssueClientCmd.Flag("ttl", "How long the certificate is valid for").Default("8760h").Duration()
+
+	pairCmd      = app.Command("pair", "Create a single use code a client can pair with to get a credential")
+	pairIdentity = pairCmd.Arg("identity", "Identity of the client, used to look up its policy").Required().String()
+	pairTTL      = pairCmd.Flag("ttl", "How long the code can be used for").Default("10m").Duration()
+
+	keyCmd       = app.Command("key", "Manage the keyring in TORRXFER_SERVER_ENCRYPTION_KEY_FILE that encrypts stored data")
+	keyGenkeyCmd = keyCmd.Command("genkey", "Generate a new keyring")
+	keyRotateCmd = keyCmd.Command("rotate", "Add a new key to the keyring. Send SIGHUP to the server to re-encrypt stored data with it")
+
+	exportCmd  = app.Command("export", "Write the contents of a stored file, decrypting it if it is encrypted")
+	exportPath = exportCmd.Arg("path", "Path of the file, absolute or relative to the media directory").Required().String()
+	exportOut  = exportCmd.Arg("out", "File to write the contents to").Required().String()
+
+	fsckCmd    = app.Command("fsck", "Check the server DB against the media directory. The server must not be running")
+	fsckRepair = fsckCmd.Flag("repair", "Truncate partial files to their last verified checkpoint and drop records for missing files").Bool()
+
+	trashCmd        = app.Command("trash", "Manage files the server replaced or discarded")
+	trashListCmd    = trashCmd.Command("list", "List trashed files, oldest first")
+	trashRestoreCmd = trashCmd.Command("restore", "Move a trashed file back to where it was. The server must not be running")
+	trashRestoreID  = trashRestoreCmd.Arg("id", "ID of the trashed file as shown by trash list").Required().String()
+
+	auditCmd    = app.Command("audit", "Show the audit log of queries and transfers, oldest first")
+	auditClient = auditCmd.Flag("client", "Only show records of the client with this identity").String()
+	auditPath   = auditCmd.Flag("path", "Only show records of the file or directory at this path relative to the media directory").String()
+	auditSince  = auditCmd.Flag("since", "Only show records from this date (2006-01-02) or time (RFC 3339) on").String()
+	auditUntil  = auditCmd.Flag("until", "Only show records up to and including this date (2006-01-02), or before this time (RFC 3339)").String()
+	auditJSON   = auditCmd.Flag("json", "Print the records as json lines").Bool()
+
+	version = common.Version
 )
 
 func main() {
 	app.Version(version)
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 	var serverConf common.ServerConfig
 	err := envconfig.Process("TORRXFER_SERVER", &serverConf)
 	if err != nil {
@@ -39,5 +99,186 @@ func main() {
 		level = zerolog.InfoLevel
 	}
 	common.ConfigureLogging(level, false, serverConf.Logfile.Writer, os.Stdout)
-	server.RunServer(serverConf, *tls, *cafile, *keyfile)
+
+	switch command {
+	case fsckCmd.FullCommand():
+		summary, err := server.Fsck(serverConf, *fsckRepair)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Check failed")
+		}
+		log.Info().Object("Summary", summary).Bool("Repaired", *fsckRepair).Msg("Check complete")
+	case trashListCmd.FullCommand():
+		entries, err := server.ListTrash(serverConf)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not list trash")
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.ID, entry.TrashedAt.Format(time.RFC3339), bytesize.New(float64(entry.Size)), entry.OriginalPath)
+		}
+	case trashRestoreCmd.FullCommand():
+		entry, err := server.RestoreTrash(serverConf, *trashRestoreID)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not restore trashed file")
+		}
+		log.Info().Object("Entry", entry).Msg("Restored")
+	case tokenGenkeyCmd.FullCommand():
+		if *tokenkey == "" {
+			log.Fatal().Msg("--tokenkey must be provided")
+		}
+		if err := crypto.GenerateTokenKey(*tokenkey); err != nil {
+			log.Fatal().Err(err).Msg("Could not generate token key")
+		}
+		log.Info().Str("Path", *tokenkey).Msg("Generated token key")
+	case tokenIssueCmd.FullCommand():
+		if *tokenkey == "" {
+			log.Fatal().Msg("--tokenkey must be provided")
+		}
+		key, err := crypto.ReadTokenKey(*tokenkey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not read token key")
+		}
+		token, err := crypto.IssueToken(key, *tokenIssueName, *tokenIssueTTL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not issue token")
+		}
+		fmt.Println(token)
+	case pskGenkeyCmd.FullCommand():
+		if *pskfile == "" {
+			log.Fatal().Msg("--pskfile must be provided")
+		}
+		passphrase, err := crypto.GeneratePSK(*pskfile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not generate pre-shared key")
+		}
+		log.Info().Str("Path", *pskfile).Msg("Generated pre-shared key")
+		// Printed so it can be copied into the client config
+		fmt.Println(passphrase)
+	case certInitCmd.FullCommand():
+		ca, err := crypto.InitCA(serverConf.CertDirectory(), *certInitName)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create certificate authority")
+		}
+		log.Info().Str("Path", filepath.Join(serverConf.CertDirectory(), crypto.CACertFileName)).Str("Fingerprint", crypto.CertFingerprint(ca.Cert.Raw)).Msg("Created certificate authority")
+	case certIssueServerCmd.FullCommand():
+		ca, err := crypto.LoadCA(serverConf.CertDirectory())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not load certificate authority. Run cert init first")
+		}
+		hosts := *certIssueServerHosts
+		if len(hosts) == 0 {
+			hosts = server.ServerCertHosts(serverConf)
+		}
+		certPEM, keyPEM, err := ca.IssueServer(hosts, *certIssueServerTTL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not issue server certificate")
+		}
+		certPath := filepath.Join(serverConf.CertDirectory(), crypto.ServerCertFileName)
+		if err := crypto.WriteKeyPair(certPath, filepath.Join(serverConf.CertDirectory(), crypto.ServerKeyFileName), certPEM, keyPEM); err != nil {
+			log.Fatal().Err(err).Msg("Could not write server certificate")
+		}
+		log.Info().Str("Path", certPath).Strs("Hosts", hosts).Msg("Issued server certificate")
+	case certIssueClientCmd.FullCommand():
+		ca, err := crypto.LoadCA(serverConf.CertDirectory())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not load certificate authority. Run cert init first")
+		}
+		certPEM, keyPEM, err := ca.IssueClient(*certIssueClientName, *certIssueClientTTL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not issue client certificate")
+		}
+		certPath := filepath.Join(*certIssueClientOut, *certIssueClientName+".pem")
+		if err := crypto.WriteKeyPair(certPath, filepath.Join(*certIssueClientOut, *certIssueClientName+".key"), certPEM, keyPEM); err != nil {
+			log.Fatal().Err(err).Msg("Could not write client certificate")
+		}
+		log.Info().Str("Path", certPath).Msg("Issued client certificate")
+	case keyGenkeyCmd.FullCommand(), keyRotateCmd.FullCommand():
+		if serverConf.EncryptionKeyFile == "" {
+			log.Fatal().Msg("TORRXFER_SERVER_ENCRYPTION_KEY_FILE must be set")
+		}
+		if command == keyGenkeyCmd.FullCommand() {
+			err = crypto.GenerateKeyring(serverConf.EncryptionKeyFile)
+		} else {
+			err = crypto.RotateKeyring(serverConf.EncryptionKeyFile)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not update keyring")
+		}
+		keys, err := crypto.ReadKeyring(serverConf.EncryptionKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not read keyring")
+		}
+		log.Info().Str("Path", serverConf.EncryptionKeyFile).Str("Key", keys.CurrentID()).Msg("Keyring updated. Keep a copy, stored data can not be recovered without it")
+	case exportCmd.FullCommand():
+		out, err := os.OpenFile(*exportOut, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create output file")
+		}
+		if err := server.Export(serverConf, *exportPath, out); err != nil {
+			out.Close()
+			os.Remove(*exportOut)
+			log.Fatal().Err(err).Msg("Could not export file")
+		}
+		if err := out.Close(); err != nil {
+			log.Fatal().Err(err).Msg("Could not write output file")
+		}
+	case auditCmd.FullCommand():
+		filter := server.AuditFilter{Client: *auditClient, Path: *auditPath}
+		if filter.Since, err = parseAuditTime(*auditSince, false); err != nil {
+			log.Fatal().Err(err).Msg("Invalid --since")
+		}
+		if filter.Until, err = parseAuditTime(*auditUntil, true); err != nil {
+			log.Fatal().Err(err).Msg("Invalid --until")
+		}
+		err = server.ReadAudit(serverConf.AuditLogPath(), filter, func(record server.AuditRecord) bool {
+			if *auditJSON {
+				line, _ := json.Marshal(record)
+				fmt.Println(string(line))
+				return true
+			}
+			client, path := record.Client, record.Path
+			if client == "" {
+				client = "-"
+			}
+			if path == "" {
+				path = filepath.ToSlash(filepath.Join(record.MediaPath, record.Name))
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s/%s\t%s\n", record.Started.Format(time.RFC3339), record.Event, record.Code, client, record.Peer,
+				bytesize.New(float64(record.BytesWritten)), bytesize.New(float64(record.Size)), path)
+			return true
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not read audit log")
+		}
+	case pairCmd.FullCommand():
+		code, err := server.CreatePairingCode(serverConf, *pairIdentity, *pairTTL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not create pairing code")
+		}
+		fmt.Printf("Pairing code for %s, valid for %v: %s\n", *pairIdentity, *pairTTL, code)
+		fmt.Printf("On the client run: torrxfer-client --config=<config> pair <host:port> %s\n", code)
+	case serveCmd.FullCommand():
+		server.RunServer(serverConf, server.TransportConfig{
+			EnableTLS:    *tls,
+			CertFile:     *cafile,
+			KeyFile:      *keyfile,
+			ClientCAFile: *clientca,
+			TokenKeyFile: *tokenkey,
+			PSKFile:      *pskfile,
+		})
+	}
+}
+
+// parseAuditTime parses a date or RFC 3339 time given on the command line. A date given as an upper bound includes the
+// whole day. Empty values are the zero time
+func parseAuditTime(value string, upperBound bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if upperBound {
+			return date.AddDate(0, 0, 1), nil
+		}
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
 }
@@ -21,34 +21,43 @@ type KvDB interface {
 	Get(key string) (string, error)
 	Delete(key string) error
 	Has(key string) bool
+	Walk(fn func(value string) (newValue string, keep bool)) error
 }
 
 type kvDb struct {
 	innerDb       *pogreb.DB
 	calledChannel chan struct{}
 	channelMux    sync.Mutex
+	path          string
 }
 
-var singleton *kvDb
-var once sync.Once
-
-// GetDb Creates the database or initializes it from an existing file
-func GetDb(dbFileName string, dbFileDirectory ...string) (db KvDB, err error) {
-	once.Do(func() {
-		var iDbFileDirectory string
-		if len(dbFileDirectory) > 0 {
-			iDbFileDirectory = dbFileDirectory[0]
-		} else {
-			iDbFileDirectory = os.TempDir()
-		}
-		singleton, err = initDb(dbFileName, iDbFileDirectory)
-		if err != nil {
-			log.Debug().Err(err).Msg("Could not init DB")
-			singleton = nil
-		}
-	})
-	db = singleton
-	return
+// openDbs holds every open database by file path so each file is only opened once
+var openDbs = make(map[string]*kvDb)
+var openDbsMux sync.Mutex
+
+// GetDb Creates the database or initializes it from an existing file. Asking for a file that is already open
+// returns the same database
+func GetDb(dbFileName string, dbFileDirectory ...string) (KvDB, error) {
+	var iDbFileDirectory string
+	if len(dbFileDirectory) > 0 {
+		iDbFileDirectory = dbFileDirectory[0]
+	} else {
+		iDbFileDirectory = os.TempDir()
+	}
+	openDbsMux.Lock()
+	defer openDbsMux.Unlock()
+
+	path := filepath.Join(iDbFileDirectory, dbFileName)
+	if db, ok := openDbs[path]; ok {
+		return db, nil
+	}
+	db, err := initDb(dbFileName, iDbFileDirectory)
+	if err != nil {
+		log.Debug().Err(err).Msg("Could not init DB")
+		return nil, err
+	}
+	openDbs[path] = db
+	return db, nil
 }
 
 func initDb(dbFileName, dbFileDirectory string) (*kvDb, error) {
@@ -64,7 +73,7 @@ func initDb(dbFileName, dbFileDirectory string) (*kvDb, error) {
 		log.Debug().Stack().Err(err).Msg("Failed to open db. Retrying with data loss")
 		return nil, err
 	}
-	ret := &kvDb{db, make(chan struct{}, 1000), sync.Mutex{}}
+	ret := &kvDb{db, make(chan struct{}, 1000), sync.Mutex{}, dbFilePath}
 	go func() {
 		calledCounter := 0
 		for range ret.calledChannel {
@@ -74,6 +83,7 @@ func initDb(dbFileName, dbFileDirectory string) (*kvDb, error) {
 				ret.innerDb.Compact()
 				calledCounter = 0
 			}
+			ret.channelMux.Unlock()
 		}
 	}()
 	return ret, nil
@@ -85,6 +95,11 @@ func (db *kvDb) called() {
 
 func (db *kvDb) Close() {
 	defer db.called()
+	openDbsMux.Lock()
+	if openDbs[db.path] == db {
+		delete(openDbs, db.path)
+	}
+	openDbsMux.Unlock()
 	db.innerDb.Sync()
 	db.innerDb.Close()
 	if err := db.innerDb.Close(); err != nil {
@@ -148,3 +163,41 @@ func (db *kvDb) Has(key string) (has bool) {
 	}
 	return
 }
+
+// Walk calls fn with every value in the store. fn returns the value to store in its place, and false to delete the entry.
+// Changes are applied once every entry has been visited
+func (db *kvDb) Walk(fn func(value string) (newValue string, keep bool)) error {
+	defer db.called()
+	updates := make(map[string]string)
+	deletes := make([][]byte, 0)
+	it := db.innerDb.Items()
+	for {
+		key, value, err := it.Next()
+		if err == pogreb.ErrIterationDone {
+			break
+		}
+		if err != nil {
+			log.Debug().Stack().Err(err).Msg("Iteration failed")
+			return err
+		}
+		newValue, keep := fn(string(value))
+		if !keep {
+			deletes = append(deletes, key)
+		} else if newValue != string(value) {
+			updates[string(key)] = newValue
+		}
+	}
+	for key, value := range updates {
+		if err := db.innerDb.Put([]byte(key), []byte(value)); err != nil {
+			log.Debug().Stack().Err(err).Msg("Put failed")
+			return err
+		}
+	}
+	for _, key := range deletes {
+		if err := db.innerDb.Delete(key); err != nil {
+			log.Debug().Stack().Err(err).Msg("Delete failed")
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/sushshring/torrxfer/pkg/crypto"
 )
@@ -30,6 +31,22 @@ func TestInitDb(t *testing.T) {
 	}
 }
 
+func TestManyCalls(t *testing.T) {
+	// Every call signals the compaction goroutine. Calls must keep going once more of them were made than it buffers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*threshold+10; i++ {
+			kvDbTest.Has("manyCalls")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Errorf("DB calls blocked")
+	}
+}
+
 func TestPut(t *testing.T) {
 	const (
 		testKey   string = "key"
@@ -65,3 +82,83 @@ func TestGet(t *testing.T) {
 		t.Errorf("Retrieved incorrect value. Expected: %s got %s", testValue, value)
 	}
 }
+
+func TestWalk(t *testing.T) {
+	entries := map[string]string{
+		"walkKeep":   "keep",
+		"walkUpdate": "update",
+		"walkDelete": "delete",
+	}
+	for key, value := range entries {
+		if err := kvDbTest.Put(key, value); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err := kvDbTest.Walk(func(value string) (string, bool) {
+		switch value {
+		case "update":
+			return "updated", true
+		case "delete":
+			return value, false
+		}
+		return value, true
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if value, err := kvDbTest.Get("walkKeep"); err != nil || value != "keep" {
+		t.Errorf("Kept value changed. Expected: keep got %s", value)
+	}
+	if value, err := kvDbTest.Get("walkUpdate"); err != nil || value != "updated" {
+		t.Errorf("Value not updated. Expected: updated got %s", value)
+	}
+	if kvDbTest.Has("walkDelete") {
+		t.Errorf("Deleted key still present")
+	}
+}
+
+func TestGetDbReuse(t *testing.T) {
+	dir, err := os.MkdirTemp("", "getdb")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	first, err := GetDb("reuse.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := GetDb("reuse.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first != second {
+		t.Errorf("Same file opened twice")
+	}
+	other, err := GetDb("other.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if other == first {
+		t.Errorf("Different files share a DB")
+	}
+	other.Close()
+	first.Close()
+	// A closed DB can be opened again
+	reopened, err := GetDb("reuse.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if reopened == first {
+		t.Errorf("Closed DB was returned")
+	}
+	reopened.Close()
+}
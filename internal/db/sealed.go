@@ -0,0 +1,121 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+// sealedDb encrypts the values of a KvDB with a keyring. Keys are already stored as hashes
+type sealedDb struct {
+	inner KvDB
+	keys  *crypto.Keyring
+	// migrate accepts values written before encryption was enabled
+	migrate bool
+	// walks holds Walk exclusively, so values it seals again are never older than a concurrent Put
+	walks sync.RWMutex
+}
+
+// NewSealedDb returns a store that encrypts values with keys before they reach db. Walk seals every value it visits that
+// is not sealed with the current key. Values written before encryption was enabled could have been written by anyone
+// with access to db, so they are only read, and sealed by Walk, with migrate. Otherwise Get refuses them and Walk skips
+// them
+func NewSealedDb(db KvDB, keys *crypto.Keyring, migrate bool) KvDB {
+	return &sealedDb{inner: db, keys: keys, migrate: migrate}
+}
+
+func (db *sealedDb) Close() {
+	db.inner.Close()
+}
+
+func (db *sealedDb) Put(key, value string) error {
+	db.walks.RLock()
+	defer db.walks.RUnlock()
+	sealed, err := db.keys.Seal([]byte(value))
+	if err != nil {
+		log.Debug().Stack().Err(err).Msg("Could not seal value")
+		return err
+	}
+	return db.inner.Put(key, string(sealed))
+}
+
+func (db *sealedDb) Get(key string) (string, error) {
+	db.walks.RLock()
+	defer db.walks.RUnlock()
+	value, err := db.inner.Get(key)
+	if err != nil {
+		return value, err
+	}
+	return db.open(value)
+}
+
+func (db *sealedDb) Delete(key string) error {
+	db.walks.RLock()
+	defer db.walks.RUnlock()
+	return db.inner.Delete(key)
+}
+
+func (db *sealedDb) Has(key string) bool {
+	db.walks.RLock()
+	defer db.walks.RUnlock()
+	return db.inner.Has(key)
+}
+
+// Walk calls fn with the plaintext of every value. A value that can not be decrypted stops the walk with an error
+// instead of being passed to fn, so it is never mistaken for a corrupt record. Values that are not sealed are kept as
+// they are without being passed to fn, unless migrating
+func (db *sealedDb) Walk(fn func(value string) (newValue string, keep bool)) error {
+	db.walks.Lock()
+	defer db.walks.Unlock()
+	var walkErr error
+	unsealed := 0
+	err := db.inner.Walk(func(value string) (string, bool) {
+		if walkErr != nil {
+			return value, true
+		}
+		plain, err := db.open(value)
+		if err == crypto.ErrNotSealed {
+			unsealed++
+			return value, true
+		}
+		if err != nil {
+			walkErr = err
+			return value, true
+		}
+		newValue, keep := fn(plain)
+		if !keep || (newValue == plain && db.keys.SealedWithCurrent([]byte(value))) {
+			return value, keep
+		}
+		sealed, err := db.keys.Seal([]byte(newValue))
+		if err != nil {
+			walkErr = err
+			return value, true
+		}
+		return string(sealed), true
+	})
+	if unsealed > 0 {
+		log.Info().Int("Records", unsealed).Msg("Skipped records that are not encrypted. Set ENCRYPTION_MIGRATE to encrypt them")
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+// open returns the plaintext of a stored value. Returns crypto.ErrNotSealed for values that are not sealed, unless
+// migrating
+func (db *sealedDb) open(value string) (string, error) {
+	if !crypto.IsSealed([]byte(value)) {
+		if !db.migrate {
+			return "", crypto.ErrNotSealed
+		}
+		return value, nil
+	}
+	plain, err := db.keys.Open([]byte(value))
+	if err != nil {
+		log.Debug().Err(err).Msg("Could not open sealed value")
+		return "", err
+	}
+	return string(plain), nil
+}
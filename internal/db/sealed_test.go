@@ -0,0 +1,102 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+func TestSealedDb(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sealeddb")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	inner, err := GetDb("sealed.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer inner.Close()
+	oldKey := strings.Repeat("01", 32)
+	keys, err := crypto.ParseKeyring(oldKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sealed := NewSealedDb(inner, keys, false)
+
+	// Values written before encryption was enabled are refused and skipped unless migrating
+	if err := inner.Put("plain", "plain record"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := sealed.Put("key", "record"); err != nil {
+		t.Error(err)
+		return
+	}
+	if raw, _ := inner.Get("key"); !crypto.IsSealed([]byte(raw)) || strings.Contains(raw, "record") {
+		t.Errorf("Value is stored in the clear: %q", raw)
+	}
+	if value, err := sealed.Get("key"); err != nil || value != "record" {
+		t.Errorf("Expected record, got %q %v", value, err)
+	}
+	if value, err := sealed.Get("plain"); err != crypto.ErrNotSealed {
+		t.Errorf("Expected the plain record to be refused, got %q %v", value, err)
+	}
+	walked := make([]string, 0)
+	if err := sealed.Walk(func(value string) (string, bool) {
+		walked = append(walked, value)
+		return value, true
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(walked) != 1 || walked[0] != "record" {
+		t.Errorf("Expected the plain record to be skipped, got %v", walked)
+	}
+	if raw, _ := inner.Get("plain"); raw != "plain record" {
+		t.Errorf("Expected the plain record to be kept as it is, got %q", raw)
+	}
+	if value, err := NewSealedDb(inner, keys, true).Get("plain"); err != nil || value != "plain record" {
+		t.Errorf("Expected plain record while migrating, got %q %v", value, err)
+	}
+
+	// Walking after a rotation while migrating seals every value with the new key
+	rotated, err := crypto.ParseKeyring(strings.Repeat("02", 32) + "," + oldKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keys.Replace(rotated)
+	if err := NewSealedDb(inner, keys, true).Walk(func(value string) (string, bool) { return value, true }); err != nil {
+		t.Error(err)
+		return
+	}
+	for key, expected := range map[string]string{"key": "record", "plain": "plain record"} {
+		raw, _ := inner.Get(key)
+		if !keys.SealedWithCurrent([]byte(raw)) {
+			t.Errorf("%s was not sealed with the new key", key)
+		}
+		if value, err := sealed.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s, got %q %v", expected, value, err)
+		}
+	}
+
+	// Values that can not be decrypted stop the walk instead of being dropped
+	unknown, err := crypto.ParseKeyring(strings.Repeat("03", 32))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = NewSealedDb(inner, unknown, false).Walk(func(value string) (string, bool) { return value, false })
+	if err == nil {
+		t.Errorf("Expected walk to fail")
+	}
+	if !inner.Has("key") {
+		t.Errorf("Undecryptable value was deleted")
+	}
+}
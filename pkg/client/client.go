@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
 	"github.com/sushshring/torrxfer/pkg/net"
 )
 
@@ -29,6 +31,7 @@ type torrxferClient struct {
 	fileStoredDbs        []FileWatcher
 	jobQueue             chan<- ServerTransferJob
 	clientConfig         *common.ClientConfig
+	knownServers         *net.KnownServers
 	sync.RWMutex
 }
 
@@ -40,25 +43,36 @@ func NewTorrxferClient() (c TorrxferClient) {
 		notificationChannels: []chan ServerNotification{},
 		fileStoredDbs:        []FileWatcher{},
 		jobQueue:             nil,
+		knownServers:         net.NewKnownServers(DefaultKnownServersPath()),
 		RWMutex:              sync.RWMutex{},
 	}
 	return
 }
 
-func (c *torrxferClient) Run(config *os.File) error {
+// ReadConfig reads the client configuration from the JSON config file
+func ReadConfig(config *os.File) (common.ClientConfig, error) {
+	var clientConfig common.ClientConfig
 	jsonData, err := ioutil.ReadAll(config)
 	if err != nil {
 		common.LogErrorStack(err, "Failed to read config file")
-		return err
+		return clientConfig, err
 	}
 
-	var clientConfig common.ClientConfig
 	err = json.Unmarshal(jsonData, &clientConfig)
 	log.Debug().RawJSON("", jsonData).Msg("JSON data: ")
 	if err != nil {
 		common.LogErrorStack(err, "Failed to unmarshal json")
+		return clientConfig, err
+	}
+	return clientConfig, nil
+}
+
+func (c *torrxferClient) Run(config *os.File) error {
+	clientConfig, err := ReadConfig(config)
+	if err != nil {
 		return err
 	}
+	c.knownServers = net.NewKnownServers(KnownServersPath(config.Name(), clientConfig))
 
 	for _, serverConfig := range clientConfig.Servers {
 		log.Debug().Str("Address", serverConfig.Address).Uint32("Port", serverConfig.Port).Msg("Connecting to server")
@@ -108,6 +122,7 @@ func (c *torrxferClient) Run(config *os.File) error {
 			log.Trace().
 				Str("Notification: ", ConnectionNotificationStrings[notification.NotificationType]).
 				Uint64("Bytes transferred: ", notification.Connection.bytesTransferred).
+				Float64("Compression ratio: ", notification.Connection.GetCompressionRatio()).
 				Str("To: ", notification.Connection.address).
 				Msg("Connection update")
 		}
@@ -144,17 +159,40 @@ func (c *torrxferClient) WatchDirectory(dirname, mediaDirectoryRoot string) erro
 // ConnectServer creates a connection to the server provided
 func (c *torrxferClient) ConnectServer(server common.ServerConnectionConfig) (*ServerConnection, error) {
 	// Connect to the server
-	rpc, err := net.NewTorrxferServerConnection(server)
+	rpc, err := net.NewTorrxferServerConnection(server, c.knownServers)
 	if err != nil {
 		common.LogError(err, "RPC connection failed")
 		return nil, err
 	}
 
 	serverConnection := newServerConnection(uint16(len(c.connections)), server.Address, server.Port, rpc)
+	if server.EncryptionKeyFile != "" {
+		if serverConnection.encryptionKey, err = crypto.ReadEncryptionKey(server.EncryptionKeyFile); err != nil {
+			common.LogError(err, "Could not read encryption key")
+			return nil, err
+		}
+	}
 
 	return serverConnection, nil
 }
 
+// KnownServersPath returns where the client with the config file at configPath pins server certificates
+func KnownServersPath(configPath string, clientConfig common.ClientConfig) string {
+	if clientConfig.KnownServersFile != "" {
+		return clientConfig.KnownServersFile
+	}
+	return filepath.Join(filepath.Dir(configPath), net.KnownServersFileName)
+}
+
+// DefaultKnownServersPath returns where server certificates are pinned for a client started without a config file
+func DefaultKnownServersPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		configDir = os.TempDir()
+	}
+	return filepath.Join(configDir, "torrxfer", net.KnownServersFileName)
+}
+
 // RegisterForConnectionNotifications is a client method that notifies the caller on changes to all active connections
 func (c *torrxferClient) RegisterForConnectionNotifications() <-chan ServerNotification {
 	channel := make(chan ServerNotification, 500)
@@ -196,8 +234,11 @@ func (c *torrxferClient) transferToServers(file *File) {
 				// Retry transfer on error
 				case ConnectionNotificationTypeQueryError:
 					fallthrough
+				case ConnectionNotificationTypeVerificationError:
+					fallthrough
 				case ConnectionNotificationTypeTransferError:
 					log.Debug().Err(notification.Error).Msg("Error during query/transfer")
+					transferJob.Delay = retryDelay(transferJob.Delay, notification.Error)
 					c.jobQueue <- transferJob
 				case ConnectionNotificationTypeCompleted:
 					if c.clientConfig.DeleteOnComplete {
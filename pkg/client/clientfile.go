@@ -72,12 +72,16 @@ func generateMediaPrefix(mediaDirectoryRoot string, path string) (string, error)
 	if err != nil {
 		return "", err
 	}
-	fileDir := filepath.Dir(absoluteFilePath)
-	if !strings.HasPrefix(fileDir, absoluteMediaDirectory) {
+	// The server expects a path relative to its media directory with / separators
+	mediaPrefix, err := filepath.Rel(absoluteMediaDirectory, filepath.Dir(absoluteFilePath))
+	if err != nil || mediaPrefix == ".." || strings.HasPrefix(mediaPrefix, ".."+string(filepath.Separator)) {
 		err := errors.New("media directory root is not part of the file path")
 		return "", err
 	}
-	return strings.TrimPrefix(fileDir, absoluteMediaDirectory), nil
+	if mediaPrefix == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(mediaPrefix), nil
 }
 
 func (f *File) getStrings() (stringReprs []string) {
@@ -147,7 +151,8 @@ func (f *File) UnmarshalText(text []byte) error {
 	}
 
 	f.Path = strings.TrimSpace(tokens[0])
-	f.MediaPrefix = strings.TrimSpace(tokens[1])
+	// Records written by older clients have an OS specific prefix with a leading separator
+	f.MediaPrefix = strings.TrimLeft(filepath.ToSlash(strings.TrimSpace(tokens[1])), "/")
 	size, err := strconv.ParseUint(strings.TrimSpace(tokens[2]), 10, 64)
 	if err != nil {
 		return err
@@ -26,16 +26,20 @@ const (
 	ConnectionNotificationTypeTransferError
 	// ConnectionNotificationTypeFatalError Fatal transfer error
 	ConnectionNotificationTypeFatalError
+	// ConnectionNotificationTypeVerificationError Server copy of the file did not match after transfer
+	ConnectionNotificationTypeVerificationError
 )
 
 // ConnectionNotificationStrings String representation of ConnectionNotificationType iota
 var ConnectionNotificationStrings = map[ConnectionNotificationType]string{
-	ConnectionNotificationTypeConnected:     "Connected",
-	ConnectionNotificationTypeDisconnected:  "Disconnected",
-	ConnectionNotificationTypeFilesUpdated:  "File Updated",
-	ConnectionNotificationTypeQueryError:    "Query Error",
-	ConnectionNotificationTypeTransferError: "Transfer Error",
-	ConnectionNotificationTypeCompleted:     "Completed",
+	ConnectionNotificationTypeConnected:         "Connected",
+	ConnectionNotificationTypeDisconnected:      "Disconnected",
+	ConnectionNotificationTypeFilesUpdated:      "File Updated",
+	ConnectionNotificationTypeQueryError:        "Query Error",
+	ConnectionNotificationTypeTransferError:     "Transfer Error",
+	ConnectionNotificationTypeCompleted:         "Completed",
+	ConnectionNotificationTypeFatalError:        "Fatal Error",
+	ConnectionNotificationTypeVerificationError: "Verification Error",
 }
 
 // ServerNotification is a struct that contains details about a notification from a server transfer action
@@ -57,6 +61,11 @@ type ServerConnection struct {
 	fileTransferStatus map[*File]uint64
 	filesTransferred   map[string]*File
 	rpcConnection      net.TorrxferServerConnection
+	// encryptionKey encrypts files before they are sent to the server. Files are sent as is when nil
+	encryptionKey []byte
+	// rawBytesSent and wireBytesSent count the transfer requests sent before and after compression
+	rawBytesSent  uint64
+	wireBytesSent uint64
 
 	sync.RWMutex
 }
@@ -107,6 +116,23 @@ func (s *ServerConnection) GetBytesTransferred() (bytesTransferred uint64) {
 	return
 }
 
+// GetCompressionRatio returns how many times smaller compression made the data sent to the server in this session. 0 if
+// nothing was sent yet
+func (s *ServerConnection) GetCompressionRatio() (ratio float64) {
+	s.RLock()
+	defer s.RUnlock()
+	ratio = net.CompressionStats{RawBytes: s.rawBytesSent, WireBytes: s.wireBytesSent}.Ratio()
+	return
+}
+
+// addCompressionStats counts what a transfer sent towards the compression ratio of the session
+func (s *ServerConnection) addCompressionStats(stats net.CompressionStats) {
+	s.Lock()
+	defer s.Unlock()
+	s.rawBytesSent += stats.RawBytes
+	s.wireBytesSent += stats.WireBytes
+}
+
 // GetFileSizeOnServer returns the current number of bytes transferred for this file in this session
 func (s *ServerConnection) GetFileSizeOnServer(filename string) (fileSize uint64) {
 	s.RLock()
@@ -128,5 +154,6 @@ func (s *ServerConnection) GetFilesTransferred() (files []*File) {
 
 // MarshalZerologObject implements the zerolog Object Marshaller for easy connection detail logging
 func (s *ServerConnection) MarshalZerologObject(e *zerolog.Event) {
-	e.Str("Address", s.GetAddress()).Uint32("Port", s.GetPort()).Uint64("Bytes transferred", s.GetBytesTransferred())
+	e.Str("Address", s.GetAddress()).Uint32("Port", s.GetPort()).Uint64("Bytes transferred", s.GetBytesTransferred()).
+		Float64("Compression ratio", s.GetCompressionRatio())
 }
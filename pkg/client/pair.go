@@ -0,0 +1,137 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gnet "net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"github.com/sushshring/torrxfer/pkg/net"
+)
+
+// credentialsDirName is the directory next to the config file that credentials from pairing are written to
+const credentialsDirName string = "credentials"
+
+// PairServer pairs with the server at address using a pairing code from torrxfer-server pair. The credential the server
+// hands out is written next to the config file, the server certificate is pinned and the server is added to the
+// Servers of the config, replacing any entry for the same address
+func PairServer(configPath, address, code string) (common.ServerConnectionConfig, error) {
+	host, portString, err := gnet.SplitHostPort(address)
+	if err != nil {
+		return common.ServerConnectionConfig{}, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 32)
+	if err != nil {
+		return common.ServerConnectionConfig{}, fmt.Errorf("invalid port %s: %w", portString, err)
+	}
+	config, err := readConfigFile(configPath)
+	if err != nil {
+		return common.ServerConnectionConfig{}, err
+	}
+
+	keyPEM, requestPEM, err := crypto.GenerateClientKey()
+	if err != nil {
+		return common.ServerConnectionConfig{}, err
+	}
+	credential, err := net.Pair(address, code, requestPEM)
+	if err != nil {
+		common.LogError(err, "Could not pair with server")
+		return common.ServerConnectionConfig{}, err
+	}
+	log.Info().Str("Identity", credential.Identity).Str("Fingerprint", credential.Fingerprint).Msg("Paired with server")
+
+	server := common.ServerConnectionConfig{Address: host, Port: uint32(port), UseTLS: true}
+	dir := filepath.Join(filepath.Dir(configPath), credentialsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return common.ServerConnectionConfig{}, err
+	}
+	name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(address)
+	if credential.Token != "" {
+		server.OAuthFile = filepath.Join(dir, name+".token")
+		if err := os.WriteFile(server.OAuthFile, []byte(credential.Token+"\n"), 0600); err != nil {
+			return common.ServerConnectionConfig{}, err
+		}
+	}
+	if len(credential.Certificate) > 0 {
+		server.ClientCertFile = filepath.Join(dir, name+".pem")
+		server.ClientKeyFile = filepath.Join(dir, name+".key")
+		if err := crypto.WriteKeyPair(server.ClientCertFile, server.ClientKeyFile, credential.Certificate, keyPEM); err != nil {
+			return common.ServerConnectionConfig{}, err
+		}
+		server.CertFile = filepath.Join(dir, name+"-ca.pem")
+		if err := os.WriteFile(server.CertFile, credential.CACertificate, 0644); err != nil {
+			return common.ServerConnectionConfig{}, err
+		}
+	}
+
+	var clientConfig common.ClientConfig
+	if err := json.Unmarshal(config, &clientConfig); err != nil {
+		return common.ServerConnectionConfig{}, err
+	}
+	knownServers := net.NewKnownServers(KnownServersPath(configPath, clientConfig))
+	if err := knownServers.Add(fmt.Sprintf("%s:%d", host, port), credential.Fingerprint); err != nil {
+		return common.ServerConnectionConfig{}, err
+	}
+	return server, addServerToConfig(configPath, config, server)
+}
+
+func readConfigFile(configPath string) ([]byte, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		common.LogError(err, "Could not open config file")
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// addServerToConfig writes the config file back with server in its Servers. Settings the client does not know about
+// are kept
+func addServerToConfig(configPath string, config []byte, server common.ServerConnectionConfig) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(config, &fields); err != nil {
+		return err
+	}
+	var servers []common.ServerConnectionConfig
+	if raw, ok := fields["Servers"]; ok {
+		if err := json.Unmarshal(raw, &servers); err != nil {
+			return err
+		}
+	}
+	replaced := false
+	for i := range servers {
+		if servers[i].Address == server.Address && servers[i].Port == server.Port {
+			servers[i] = server
+			replaced = true
+		}
+	}
+	if !replaced {
+		servers = append(servers, server)
+	}
+	raw, err := json.Marshal(servers)
+	if err != nil {
+		return err
+	}
+	fields["Servers"] = raw
+	data, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	tmpPath := configPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), stat.Mode().Perm()); err != nil {
+		common.LogError(err, "Could not write config file")
+		return err
+	}
+	return os.Rename(tmpPath, configPath)
+}
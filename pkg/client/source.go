@@ -0,0 +1,122 @@
+package client
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"github.com/sushshring/torrxfer/pkg/net"
+)
+
+// transferSource is the data sent to the server for a file. Offsets and hashes are of the data as the server stores
+// it, so resuming and verifying a transfer works the same whether or not the file is encrypted
+type transferSource interface {
+	// rpcFile describes the data to the server
+	rpcFile(mediaPrefix string) (*net.RPCFile, error)
+	// hash returns the hash of all of the data
+	hash() (string, error)
+	// prefixHash returns the hash of the first size bytes of the data
+	prefixHash(size uint64) (string, error)
+	// open returns a reader of the data starting at offset
+	open(offset uint64) (io.ReadCloser, error)
+}
+
+// newTransferSource returns the source for file. Files are encrypted with key when it is set
+func newTransferSource(file *File, key []byte) (transferSource, error) {
+	if key == nil {
+		return &plainSource{path: file.Path}, nil
+	}
+	encrypted, err := crypto.OpenEncrypted(key, file.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedSource{path: file.Path, file: encrypted}, nil
+}
+
+// plainSource sends a file as it is on disk
+type plainSource struct {
+	path string
+}
+
+func (s *plainSource) rpcFile(mediaPrefix string) (*net.RPCFile, error) {
+	file, err := net.NewFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.SetMediaPath(mediaPrefix); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *plainSource) hash() (string, error) {
+	return crypto.HashFile(s.path)
+}
+
+func (s *plainSource) prefixHash(size uint64) (string, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return crypto.HashReader(io.LimitReader(file, int64(size)))
+}
+
+func (s *plainSource) open(offset uint64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// encryptedSource sends the ciphertext of a file, stored on the server under the file name with
+// crypto.EncryptedFileSuffix appended
+type encryptedSource struct {
+	path string
+	file *crypto.EncryptedFile
+	// dataHash caches the hash of the ciphertext, which takes encrypting the whole file to compute
+	dataHash string
+}
+
+func (s *encryptedSource) rpcFile(mediaPrefix string) (*net.RPCFile, error) {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		common.LogError(err, "Could not stat file to encrypt")
+		return nil, err
+	}
+	hash, err := s.hash()
+	if err != nil {
+		return nil, err
+	}
+	file := net.NewFileFromData(filepath.Base(s.path)+crypto.EncryptedFileSuffix, s.file.Size(), hash, stat.ModTime())
+	if err := file.SetMediaPath(mediaPrefix); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *encryptedSource) hash() (string, error) {
+	if s.dataHash == "" {
+		hash, err := s.file.Hash(s.file.Size())
+		if err != nil {
+			return "", err
+		}
+		s.dataHash = hash
+	}
+	return s.dataHash, nil
+}
+
+func (s *encryptedSource) prefixHash(size uint64) (string, error) {
+	return s.file.Hash(size)
+}
+
+func (s *encryptedSource) open(offset uint64) (io.ReadCloser, error) {
+	return s.file.NewReader(offset)
+}
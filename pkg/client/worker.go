@@ -1,17 +1,31 @@
 package client
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
-	"os"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"github.com/sushshring/torrxfer/pkg/common"
-	"github.com/sushshring/torrxfer/pkg/crypto"
 	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+const (
+	// minRetryDelay and maxRetryDelay bound how long a job waits before retrying on a server that is out of space or
+	// busy receiving a different file at the same path
+	minRetryDelay = 30 * time.Second
+	maxRetryDelay = 30 * time.Minute
+)
+
+// ErrVerificationFailed is reported when the server's copy of a file does not match the local file once a transfer closes.
+// The transfer is retried
+var ErrVerificationFailed = errors.New("server file does not match local file")
+
 // ServerTransferJob holds the attributes needed to perform unit of work.
 type ServerTransferJob struct {
 	ID                    uuid.UUID
@@ -42,21 +56,37 @@ func (w ServerTransferWorker) doFileTransferJob(job ServerTransferJob) {
 	// Prime the server for the file.
 	file.TransferTime = time.Now()
 	log.Trace().Str("File Path", file.Path).Str("Media Prefix", file.MediaPrefix).Str("Job ID", job.ID.String()).Msg("Starting job")
-	remoteFileInfo, err := job.ServerConnection.rpcConnection.QueryFile(file.Path, file.MediaPrefix, job.ID.String())
+	source, err := newTransferSource(file, job.ServerConnection.encryptionKey)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to open provided file")
+		job.sendConnectionNotification(ConnectionNotificationTypeFatalError, 0, err)
+		return
+	}
+	rpcFile, err := source.rpcFile(file.MediaPrefix)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to describe provided file")
+		job.sendConnectionNotification(ConnectionNotificationTypeFatalError, 0, err)
+		return
+	}
+	remoteFileInfo, err := job.ServerConnection.rpcConnection.QueryFile(rpcFile, job.ID.String())
 	if err != nil {
 		log.Trace().Err(err).Msg("Query file failed")
+		if !isRetryable(err) {
+			job.sendConnectionNotification(ConnectionNotificationTypeFatalError, 0, err)
+			return
+		}
 		job.sendConnectionNotification(ConnectionNotificationTypeQueryError, 0, err)
 		return
 	}
 	// File was already fully transmitted
 	// Verify based on data hash
-	fileHash, err := crypto.HashFile(file.Path)
+	fileHash, err := source.hash()
 	if err != nil {
 		// If hashing local file failed due to an transient error, just check for file size.
 		// If file size is different, attempt to transfer again.
 		fileHash = ""
 	}
-	if fileHash == remoteFileInfo.GetDataHash() || file.Size == remoteFileInfo.GetRemoteSize() {
+	if fileHash != "" && fileHash == remoteFileInfo.GetDataHash() {
 		func() {
 			job.ServerConnection.Lock()
 			defer job.ServerConnection.Unlock()
@@ -71,41 +101,44 @@ func (w ServerTransferWorker) doFileTransferJob(job ServerTransferJob) {
 	bytesReader, bytesWriter := io.Pipe()
 	offset := remoteFileInfo.GetRemoteSize()
 
-	// Open the file for reading
-	fileOnDisk, err := os.Open(file.Path)
-	if err != nil {
-		log.Debug().Err(err).Msg("Failed to open provided file")
-		return
-	}
-	defer fileOnDisk.Close()
 	// Continue transmission of file from last sent point if the data hash so far matches
 	if offset > 0 {
-		currentHash, err := crypto.HashReader(io.LimitReader(fileOnDisk, int64(offset)))
+		currentHash, err := source.prefixHash(offset)
 		if err != nil {
 			// If error while generating hash, transfer the full file even though this was a local error
 			common.LogErrorStack(err, "Could not generate hash of file to remote offset")
 			currentHash = ""
 		}
-		if currentHash == remoteFileInfo.GetDataHash() {
-			if _, err := fileOnDisk.Seek(int64(offset), 0); err != nil {
-				// Could not seek to location locally. Transfer full file
-				offset = 0
-				// Best effort seek to 0. If failed,
-				if _, err := fileOnDisk.Seek(0, 0); err != nil {
-					log.Trace().Err(err).Uint64("offset", offset).Msg("Seek to 0 failed after seek to specific offset failed")
-					job.sendConnectionNotification(ConnectionNotificationTypeFatalError, 0, err)
-				}
-			}
+		if currentHash != remoteFileInfo.GetDataHash() {
+			// The server's partial copy does not match the local file. Restarting from offset 0 makes the server discard it
+			log.Debug().Uint64("offset", offset).Msg("Remote data does not match local file. Restarting transfer")
+			offset = 0
 		}
-	} else {
+	}
+	// Open the file for reading
+	fileOnDisk, err := source.open(offset)
+	if err != nil && offset > 0 {
+		// Could not seek to location locally. Transfer full file
+		log.Trace().Err(err).Uint64("offset", offset).Msg("Could not open file at offset. Transferring full file")
 		offset = 0
-		if _, err := fileOnDisk.Seek(0, 0); err != nil {
-			log.Trace().Err(err).Msg("Seek to 0 failed")
-			job.sendConnectionNotification(ConnectionNotificationTypeFatalError, 0, err)
-		}
+		fileOnDisk, err = source.open(0)
 	}
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to open provided file")
+		job.sendConnectionNotification(ConnectionNotificationTypeFatalError, 0, err)
+		return
+	}
+	defer fileOnDisk.Close()
+	// Whether the file is worth compressing may be judged by a sample of the data that is about to be sent
+	var fileData io.Reader = fileOnDisk
+	compression := job.ServerConnection.rpcConnection.CompressionFor(file.Path, func() []byte {
+		sampled := bufio.NewReaderSize(fileOnDisk, net.CompressionSampleSize)
+		fileData = sampled
+		sample, _ := sampled.Peek(net.CompressionSampleSize)
+		return sample
+	})
 	// Setup the file transfer channels. There may be one blocking call but it should be fairly trivial
-	fileSummaryChan, err := job.ServerConnection.rpcConnection.TransferFile(bytesReader, common.DefaultBlockSize, offset, job.ID.String())
+	fileSummaryChan, err := job.ServerConnection.rpcConnection.TransferFile(bytesReader, source.open, offset, compression, job.ID.String())
 	if err != nil {
 		log.Trace().Err(err).Msg("Transfer file failed")
 		job.sendConnectionNotification(ConnectionNotificationTypeTransferError, 0, err)
@@ -120,6 +153,12 @@ func (w ServerTransferWorker) doFileTransferJob(job ServerTransferJob) {
 
 	go func(summaryChannel chan net.FileTransferNotification, server *ServerConnection, file *File) {
 		for summary := range summaryChannel {
+			if summary.NotificationType != net.TransferNotificationTypeBytes {
+				server.addCompressionStats(summary.Compression)
+				log.Debug().Str("File", file.Path).Str("Codec", summary.Compression.Codec).
+					Uint64("Raw bytes", summary.Compression.RawBytes).Uint64("Wire bytes", summary.Compression.WireBytes).
+					Float64("Ratio", summary.Compression.Ratio()).Msg("Transfer compression")
+			}
 			switch summary.NotificationType {
 			case net.TransferNotificationTypeError:
 				log.Trace().Err(err).Msg("Error during bytes transfer")
@@ -134,6 +173,17 @@ func (w ServerTransferWorker) doFileTransferJob(job ServerTransferJob) {
 					job.sendConnectionNotification(ConnectionNotificationTypeFilesUpdated, summary.LastTransferred)
 				}()
 			case net.TransferNotificationTypeClosed:
+				// Only trust the transfer once the server's copy hashes to the same value as the local file
+				if summary.Summary == nil || fileHash == "" || summary.Summary.DataHash != fileHash {
+					var remoteHash string
+					if summary.Summary != nil {
+						remoteHash = summary.Summary.DataHash
+					}
+					log.Debug().Str("Local hash", fileHash).Str("Server hash", remoteHash).Msg("Transfer verification failed")
+					job.sendConnectionNotification(ConnectionNotificationTypeVerificationError, 0,
+						fmt.Errorf("%w: local hash %q, server hash %q", ErrVerificationFailed, fileHash, remoteHash))
+					continue
+				}
 				job.sendConnectionNotification(ConnectionNotificationTypeCompleted, 0)
 			}
 		}
@@ -142,7 +192,7 @@ func (w ServerTransferWorker) doFileTransferJob(job ServerTransferJob) {
 	func(dataChannel *io.PipeWriter, path string) {
 		defer dataChannel.Close()
 
-		n, err := io.Copy(dataChannel, fileOnDisk)
+		n, err := io.Copy(dataChannel, fileData)
 		if err != nil {
 			common.LogErrorStack(err, "Failed to pipe from file")
 			job.sendConnectionNotification(ConnectionNotificationTypeTransferError, 0, err)
@@ -152,6 +202,31 @@ func (w ServerTransferWorker) doFileTransferJob(job ServerTransferJob) {
 
 }
 
+// isRetryable reports whether a request the server refused may succeed if it is made again later
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.AlreadyExists:
+		return false
+	default:
+		return true
+	}
+}
+
+// retryDelay returns how long to wait before retrying a job that failed with err. A server that is out of space, or
+// receiving a different file at the same path, is given exponentially more time. Other errors are retried straight away
+func retryDelay(previous time.Duration, err error) time.Duration {
+	if code := status.Code(err); code != codes.ResourceExhausted && code != codes.Aborted {
+		return 0
+	}
+	if previous < minRetryDelay {
+		return minRetryDelay
+	}
+	if previous*2 > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return previous * 2
+}
+
 func (w ServerTransferJob) sendConnectionNotification(n ConnectionNotificationType, lastBlockSize uint64, err ...error) {
 	serverNotif := ServerNotification{
 		NotificationType: n,
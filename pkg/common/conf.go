@@ -1,7 +1,15 @@
 package common
 
-// DefaultBlockSize is the minimal block that is transferred to the server
-const DefaultBlockSize = 1024
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/inhies/go-bytesize"
+)
+
+// Version is the version of torrxfer
+const Version = "0.1"
 
 // ServerConfig describes all the environment specific details for running the server
 type ServerConfig struct {
@@ -11,4 +19,108 @@ type ServerConfig struct {
 	Logfile LogFileDecoder   `envconfig:"LOGFILE" default:""`
 	SaveDir DirectoryDecoder `envconfig:"MEDIADIR" default:"."`
 	DbDir   string           `envconfig:"DBDIR" default:""`
+	// CertDir holds the built-in certificate authority and the server certificate it issues. Defaults to certs in DbDir
+	CertDir string `envconfig:"CERTDIR" default:""`
+	// CheckpointInterval is how often partially received files are flushed to disk and recorded in the DB
+	CheckpointInterval time.Duration `envconfig:"CHECKPOINT_INTERVAL" default:"30s"`
+	// AckInterval is how often partially received files are flushed to disk so the client can be told how much of them
+	// is durable. Files are also acknowledged once their client has sent half of what it may send unacknowledged. 0 only does the latter,
+	// and acknowledges files whose client has stopped sending
+	AckInterval time.Duration `envconfig:"ACK_INTERVAL" default:"1s"`
+	// TransferWindow is how much data clients together may send before it is acknowledged. 0 does not limit clients
+	TransferWindow bytesize.ByteSize `envconfig:"TRANSFER_WINDOW" default:"64MB"`
+	// ConflictPolicy decides what happens to a new file whose name is taken by a different file on the server
+	ConflictPolicy ConflictPolicy `envconfig:"CONFLICT_POLICY" default:"overwrite"`
+	// ConflictPolicies overrides ConflictPolicy for media prefixes, e.g. "tv:rename,movies:reject"
+	ConflictPolicies map[string]ConflictPolicy `envconfig:"CONFLICT_POLICIES" default:""`
+	// Trash moves files the server replaces or discards into the .trash directory of SaveDir instead of deleting them
+	Trash bool `envconfig:"TRASH" default:"true"`
+	// TrashMaxAge is how long trashed files are kept. 0 keeps them until TrashMaxSize is reached
+	TrashMaxAge time.Duration `envconfig:"TRASH_MAX_AGE" default:"720h"`
+	// TrashMaxSize is how much space trashed files may take up before the oldest are purged, e.g. "50GB". 0 is unlimited
+	TrashMaxSize bytesize.ByteSize `envconfig:"TRASH_MAX_SIZE" default:"0B"`
+	// PathProfile rewrites client supplied file names to suit the filesystem the media directory is shared over
+	PathProfile PathProfile `envconfig:"PATH_PROFILE" default:"none"`
+	// MaxNameLength is the longest file or directory name in bytes the server will create. 0 is unlimited
+	MaxNameLength int `envconfig:"MAX_NAME_LENGTH" default:"255"`
+	// NormalizeUnicode converts client supplied paths to Unicode NFC so the same name always maps to the same file
+	NormalizeUnicode bool `envconfig:"NORMALIZE_UNICODE" default:"false"`
+	// DiskReserve is the free space the server keeps on the media filesystem when admitting new transfers, e.g. "1GB"
+	DiskReserve bytesize.ByteSize `envconfig:"DISK_RESERVE" default:"0B"`
+	// CertReloadInterval is how often the TLS certificate files are checked for changes. 0 only reloads on SIGHUP
+	CertReloadInterval time.Duration `envconfig:"CERT_RELOAD_INTERVAL" default:"1m"`
+	// PairCredentialTTL is how long the credentials handed to clients that pair with the server are valid for
+	PairCredentialTTL time.Duration `envconfig:"PAIR_CREDENTIAL_TTL" default:"8760h"`
+	// EncryptionKeyFile is a keyring file enabling encryption at rest of the media directory and file DB. It holds one
+	// hex encoded key per line, newest first
+	EncryptionKeyFile string `envconfig:"ENCRYPTION_KEY_FILE" default:""`
+	// EncryptionKey is the keyring as comma separated hex encoded keys, newest first, instead of EncryptionKeyFile
+	EncryptionKey string `envconfig:"ENCRYPTION_KEY" default:""`
+	// EncryptionMigrate reads files and DB records stored before encryption was enabled, and encrypts them with the
+	// current key. Without it they are refused once encryption is enabled
+	EncryptionMigrate bool `envconfig:"ENCRYPTION_MIGRATE" default:"false"`
+	// PolicyFile is a json PolicyConfig limiting where each client may write and how much. Empty allows every client everything
+	PolicyFile string `envconfig:"POLICY_FILE" default:""`
+	// AuditLog is the file every query and transfer outcome is appended to. Defaults to audit.log in DbDir
+	AuditLog string `envconfig:"AUDIT_LOG" default:""`
+}
+
+// CertDirectory returns the directory of the built-in certificate authority
+func (c ServerConfig) CertDirectory() string {
+	if c.CertDir != "" {
+		return c.CertDir
+	}
+	return filepath.Join(c.DbDir, "certs")
+}
+
+// AuditLogPath returns the file the audit log is written to
+func (c ServerConfig) AuditLogPath() string {
+	if c.AuditLog != "" {
+		return c.AuditLog
+	}
+	return filepath.Join(c.DbDir, "audit.log")
+}
+
+// PathProfile describes a set of rules client supplied file names are rewritten to follow
+type PathProfile string
+
+const (
+	// PathProfileNone keeps names as they are, apart from validation
+	PathProfileNone PathProfile = "none"
+	// PathProfileWindows replaces characters and names that Windows and SMB shares cannot store
+	PathProfileWindows PathProfile = "windows"
+)
+
+// Decode validates a path profile name
+func (p *PathProfile) Decode(value string) error {
+	switch profile := PathProfile(value); profile {
+	case PathProfileNone, PathProfileWindows:
+		*p = profile
+		return nil
+	}
+	return fmt.Errorf("unknown path profile %q", value)
+}
+
+// ConflictPolicy describes how the server treats a new file whose name is taken by a different file
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyOverwrite replaces the existing file
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite"
+	// ConflictPolicyRename stores the new file next to the existing one with a numeric suffix
+	ConflictPolicyRename ConflictPolicy = "rename"
+	// ConflictPolicyKeepBoth stores the new file under the conflicts directory
+	ConflictPolicyKeepBoth ConflictPolicy = "keep-both"
+	// ConflictPolicyReject refuses the new file
+	ConflictPolicyReject ConflictPolicy = "reject"
+)
+
+// Decode validates a conflict policy name
+func (p *ConflictPolicy) Decode(value string) error {
+	switch policy := ConflictPolicy(value); policy {
+	case ConflictPolicyOverwrite, ConflictPolicyRename, ConflictPolicyKeepBoth, ConflictPolicyReject:
+		*p = policy
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q", value)
 }
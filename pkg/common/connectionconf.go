@@ -1,5 +1,7 @@
 package common
 
+import "github.com/inhies/go-bytesize"
+
 const (
 	// DefaultAddress for a server
 	DefaultAddress string = "localhost"
@@ -18,6 +20,8 @@ type ClientConfig struct {
 	Servers            []ServerConnectionConfig `json:"Servers"`
 	WatchedDirectories []WatchedDirectory       `json:"WatchedDirectories"`
 	DeleteOnComplete   bool                     `json:"DeleteFileOnComplete"`
+	// KnownServersFile is where server certificates are pinned. Defaults to known_servers next to the config file
+	KnownServersFile string `json:"KnownServersFile"`
 }
 
 // ServerConnectionConfig json representation
@@ -27,4 +31,20 @@ type ServerConnectionConfig struct {
 	UseTLS    bool   `json:"Secure"`
 	CertFile  string `json:"CertFile"`
 	OAuthFile string `json:"OAuthFile"`
+	// ClientCertFile and ClientKeyFile hold the certificate the client authenticates with on servers that require mutual TLS
+	ClientCertFile string `json:"ClientCertFile"`
+	ClientKeyFile  string `json:"ClientKeyFile"`
+	// PSK and PSKFile hold a pre-shared key, used instead of TLS certificates. Set at most one, and not with UseTLS
+	PSK     string `json:"PSK"`
+	PSKFile string `json:"PSKFile"`
+	// EncryptionKeyFile holds the key files are encrypted with before they are sent. The server only stores
+	// ciphertext, which torrxfer-client decrypt restores
+	EncryptionKeyFile string `json:"EncryptionKeyFile"`
+	// MinChunkSize and MaxChunkSize bound the chunks files are sent in. Chunks are sized to the measured throughput
+	// and round trip time in between. Defaults to 4KB and the largest chunk the server accepts
+	MinChunkSize bytesize.ByteSize `json:"MinChunkSize"`
+	MaxChunkSize bytesize.ByteSize `json:"MaxChunkSize"`
+	// Compression is none, gzip, zstd or auto, the default. auto compresses with the preferred codec the server
+	// supports, except for files that look incompressible by their extension or a sample of their data
+	Compression string `json:"Compression"`
 }
@@ -0,0 +1,21 @@
+package common
+
+import "github.com/inhies/go-bytesize"
+
+// DefaultPolicyName is the policy entry applied to clients without an entry of their own
+const DefaultPolicyName string = "*"
+
+// PolicyConfig json representation of the server policy file. Clients maps client identities to their policy
+type PolicyConfig struct {
+	Clients map[string]ClientPolicy `json:"Clients"`
+}
+
+// ClientPolicy json representation of the limits on what a client may write to the server
+type ClientPolicy struct {
+	// MediaPrefixes the client may write under. Empty allows any
+	MediaPrefixes []string `json:"MediaPrefixes"`
+	// Quota is the total size of files the client may transfer. 0 is unlimited
+	Quota bytesize.ByteSize `json:"Quota"`
+	// MaxFileSize is the largest single file the client may transfer. 0 is unlimited
+	MaxFileSize bytesize.ByteSize `json:"MaxFileSize"`
+}
@@ -0,0 +1,307 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+const (
+	// CACertFileName and CAKeyFileName hold the certificate authority in the certificate directory
+	CACertFileName string = "ca.pem"
+	CAKeyFileName  string = "ca.key"
+	// ServerCertFileName and ServerKeyFileName hold the server keypair in the certificate directory
+	ServerCertFileName string = "server.pem"
+	ServerKeyFileName  string = "server.key"
+
+	// DefaultCertValidity is how long issued certificates are valid for unless asked otherwise
+	DefaultCertValidity time.Duration = 365 * 24 * time.Hour
+	// caValidity is how long a new certificate authority is valid for
+	caValidity time.Duration = 10 * 365 * 24 * time.Hour
+	// serverCertRenewBefore is how close to expiry EnsureServerCert reissues the server certificate
+	serverCertRenewBefore time.Duration = 30 * 24 * time.Hour
+)
+
+// CertificateAuthority signs server and client certificates for a torrxfer deployment
+type CertificateAuthority struct {
+	Cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// InitCA creates a new certificate authority named name in dir. An existing certificate authority is never overwritten
+func InitCA(dir, name string) (*CertificateAuthority, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		common.LogError(err, "Could not create certificate directory")
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certificateTemplate(name, caValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// The key is written first so a CA certificate is never left without its key
+	if err := writeNewFile(filepath.Join(dir, CAKeyFileName), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := writeNewFile(filepath.Join(dir, CACertFileName), encodeCert(der), 0644); err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{cert, key}, nil
+}
+
+// LoadCA reads the certificate authority in dir
+func LoadCA(dir string) (*CertificateAuthority, error) {
+	certBytes, err := os.ReadFile(filepath.Join(dir, CACertFileName))
+	if err != nil {
+		common.LogError(err, "Could not open CA certificate")
+		return nil, err
+	}
+	keyBytes, err := os.ReadFile(filepath.Join(dir, CAKeyFileName))
+	if err != nil {
+		common.LogError(err, "Could not open CA key")
+		return nil, err
+	}
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return nil, errors.New("failed to parse CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyBytes)
+	if block == nil {
+		return nil, errors.New("failed to parse CA key PEM")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, errors.New("CA key does not match CA certificate")
+	}
+	return &CertificateAuthority{cert, key}, nil
+}
+
+// IssueServer signs a server certificate valid for ttl. hosts are the DNS names and IP addresses clients connect to
+// the server with. The returned certificate PEM is followed by the CA certificate
+func (ca *CertificateAuthority) IssueServer(hosts []string, ttl time.Duration) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("server certificate needs at least one host")
+	}
+	template, err := certificateTemplate(hosts[0], ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return ca.issue(template)
+}
+
+// IssueClient signs a client certificate valid for ttl. identity becomes the common name, which the server uses as
+// the client identity with mutual TLS
+func (ca *CertificateAuthority) IssueClient(identity string, ttl time.Duration) (certPEM, keyPEM []byte, err error) {
+	template, err := clientTemplate(identity, ttl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca.issue(template)
+}
+
+// CertPEM returns the PEM encoded CA certificate
+func (ca *CertificateAuthority) CertPEM() []byte {
+	return encodeCert(ca.Cert.Raw)
+}
+
+// issue generates a key and signs a certificate for it from template
+func (ca *CertificateAuthority) issue(template *x509.Certificate) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err = ca.sign(template, &key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// sign signs a certificate for publicKey from template. The returned PEM is followed by the CA certificate
+func (ca *CertificateAuthority) sign(template *x509.Certificate, publicKey interface{}) ([]byte, error) {
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	// Never outlive the CA
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, publicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeCert(der), ca.CertPEM()...), nil
+}
+
+// EnsureServerCert makes sure dir holds a server certificate for hosts signed by the CA in dir, creating the CA and
+// issuing the certificate as needed. The certificate is reissued when it is close to expiry or does not cover hosts
+func EnsureServerCert(dir string, hosts []string, ttl time.Duration) (certPath, keyPath string, err error) {
+	certPath = filepath.Join(dir, ServerCertFileName)
+	keyPath = filepath.Join(dir, ServerKeyFileName)
+	ca, err := LoadCA(dir)
+	if os.IsNotExist(err) {
+		ca, err = InitCA(dir, "torrxfer CA")
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if cert, err := readCert(certPath); err == nil && certCovers(cert, hosts) &&
+		time.Until(cert.NotAfter) > serverCertRenewBefore && cert.CheckSignatureFrom(ca.Cert) == nil {
+		return certPath, keyPath, nil
+	}
+	certPEM, keyPEM, err := ca.IssueServer(hosts, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	if err := WriteKeyPair(certPath, keyPath, certPEM, keyPEM); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// WriteKeyPair writes a certificate and its key, replacing existing files. The key is only readable by the owner
+func WriteKeyPair(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if err := writeFileAtomic(keyPath, keyPEM, 0600); err != nil {
+		common.LogError(err, "Could not write key")
+		return err
+	}
+	if err := writeFileAtomic(certPath, certPEM, 0644); err != nil {
+		common.LogError(err, "Could not write certificate")
+		return err
+	}
+	return nil
+}
+
+// certificateTemplate returns a template with a random serial number valid from now for ttl
+func certificateTemplate(commonName string, ttl time.Duration) (*x509.Certificate, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("certificate lifetime must be positive, got %v", ttl)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"torrxfer"}},
+		// Tolerate clocks that are slightly behind
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(ttl),
+	}, nil
+}
+
+// clientTemplate returns a template for a client certificate identifying the client as identity
+func clientTemplate(identity string, ttl time.Duration) (*x509.Certificate, error) {
+	if identity == "" {
+		return nil, errors.New("client identity must not be empty")
+	}
+	template, err := certificateTemplate(identity, ttl)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return template, nil
+}
+
+// certCovers checks that cert is valid for every host
+func certCovers(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, errors.New("failed to parse certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		common.LogError(err, "Could not create file")
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	return err
+}
+
+// writeFileAtomic replaces path with data so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
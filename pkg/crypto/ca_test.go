@@ -0,0 +1,195 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateAuthority(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ca")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ca, err := InitCA(dir, "test CA")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := InitCA(dir, "test CA"); err == nil {
+		t.Errorf("Expected existing CA not to be overwritten")
+	}
+	loaded, err := LoadCA(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Errorf("Loaded CA does not match created CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	certPEM, keyPEM, err := ca.IssueServer([]string{"server.example", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, host := range []string{"server.example", "127.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Server certificate does not verify for %s: %v", host, err)
+		}
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "other.example", Roots: roots}); err == nil {
+		t.Errorf("Server certificate verified for a host it was not issued for")
+	}
+
+	certPEM, keyPEM, err = ca.IssueClient("alice", time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	leaf, err = x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if leaf.Subject.CommonName != "alice" {
+		t.Errorf("Client certificate common name is %s", leaf.Subject.CommonName)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Client certificate does not verify: %v", err)
+	}
+}
+
+func TestEnsureServerCert(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ca")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dir = filepath.Join(dir, "certs")
+
+	certPath, keyPath, err := EnsureServerCert(dir, []string{"localhost"}, time.Hour*24*365)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Error(err)
+		return
+	}
+	first, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// An existing certificate that still covers the hosts is kept
+	if _, _, err := EnsureServerCert(dir, []string{"localhost"}, time.Hour*24*365); err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Server certificate reissued without need")
+	}
+
+	// A new host needs a new certificate from the same CA
+	if _, _, err := EnsureServerCert(dir, []string{"localhost", "server.example"}, time.Hour*24*365); err != nil {
+		t.Error(err)
+		return
+	}
+	cert, err := readCert(certPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if cert.VerifyHostname("server.example") != nil {
+		t.Errorf("Server certificate not reissued for new host")
+	}
+	ca, err := LoadCA(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := cert.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("Reissued certificate not signed by the existing CA: %v", err)
+	}
+}
+
+func TestPinFingerprint(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ca")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ca, err := InitCA(dir, "test CA")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	chain := func(certPEM, keyPEM []byte, err error) [][]byte {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return cert.Certificate
+	}
+	first := chain(ca.IssueServer([]string{"server.example"}, time.Hour))
+	reissued := chain(ca.IssueServer([]string{"server.example"}, time.Hour))
+	client := chain(ca.IssueClient("alice", time.Hour))
+	if first == nil || reissued == nil || client == nil {
+		return
+	}
+
+	// A server that sends its CA has the CA pinned, so a reissued certificate still matches
+	pin := PinFingerprint(first)
+	if pin != CertFingerprint(ca.Cert.Raw) {
+		t.Errorf("Expected the CA to be pinned, got %s", pin)
+	}
+	if !VerifyPin(reissued, pin) {
+		t.Errorf("Expected a reissued server certificate to match the pinned CA")
+	}
+	if VerifyPin(client, pin) {
+		t.Errorf("Expected a client certificate signed by the pinned CA not to match")
+	}
+	// Without the CA the server certificate itself is pinned
+	leafPin := PinFingerprint(first[:1])
+	if leafPin != CertFingerprint(first[0]) || !VerifyPin(first, leafPin) || VerifyPin(reissued[:1], leafPin) {
+		t.Errorf("Unexpected pin for a server certificate without its CA")
+	}
+}
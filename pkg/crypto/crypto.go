@@ -50,6 +50,66 @@ func Hash(key string) (string, error) {
 	return fmt.Sprintf("%x", sum), nil
 }
 
+// CertFingerprint returns the SHA256 fingerprint of a DER encoded certificate
+func CertFingerprint(der []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(der))
+}
+
+// PinFingerprint returns the fingerprint clients pin for a server presenting the DER encoded chain. If the server sends
+// the CA that signed its certificate, the CA is pinned so the pin stays valid when the server certificate is reissued.
+// Otherwise the server certificate itself is pinned
+func PinFingerprint(chain [][]byte) string {
+	if anchor := chainAnchor(chain); anchor != nil {
+		return CertFingerprint(anchor.Raw)
+	}
+	return CertFingerprint(chain[0])
+}
+
+// VerifyPin reports whether a server presenting the DER encoded chain matches the fingerprint pinned for it: either
+// its certificate is the pinned certificate, or it is a server certificate signed by the pinned CA
+func VerifyPin(chain [][]byte, pinned string) bool {
+	if len(chain) == 0 {
+		return false
+	}
+	if CertFingerprint(chain[0]) == strings.ToLower(pinned) {
+		return true
+	}
+	anchor := chainAnchor(chain)
+	return anchor != nil && CertFingerprint(anchor.Raw) == strings.ToLower(pinned)
+}
+
+// chainAnchor returns the CA certificate at the end of chain if the first certificate is a valid server certificate
+// issued by it. Returns nil for a chain without a CA
+func chainAnchor(chain [][]byte) *x509.Certificate {
+	if len(chain) < 2 {
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, raw := range chain {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil
+		}
+		certs = append(certs, cert)
+	}
+	anchor := certs[len(certs)-1]
+	if !anchor.IsCA {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1 : len(certs)-1] {
+		intermediates.AddCert(cert)
+	}
+	// The CA also signs client certificates, which must not be accepted in place of the server certificate
+	options := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if _, err := certs[0].Verify(options); err != nil {
+		return nil
+	}
+	return anchor
+}
+
 // VerifyCert verifies is a pem cert file is valid and trusted
 func VerifyCert(filepath string, hostname string) (bool, *x509.Certificate, error) {
 	bytes, err := os.ReadFile(filepath)
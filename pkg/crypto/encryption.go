@@ -0,0 +1,268 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+const (
+	// EncryptedFileSuffix is appended to the name of files stored encrypted on the server
+	EncryptedFileSuffix string = ".torrxfer-enc"
+
+	// encryptionMagic starts every encrypted file and names the format version
+	encryptionMagic string = "TORRXFE1"
+	// encryptionChunkSize is the amount of plaintext sealed at a time
+	encryptionChunkSize int = 64 * 1024
+	// encryptionSaltSize is the size of the per file salt the file key is derived with
+	encryptionSaltSize int = 32
+	// encryptionHeaderSize is the size of the magic, chunk size, plaintext size and salt that precede the chunks
+	encryptionHeaderSize int = len(encryptionMagic) + 4 + 8 + encryptionSaltSize
+	// encryptionKeySize is the size in bytes of an encryption key
+	encryptionKeySize int = 32
+)
+
+// ErrDecryptionFailed is returned for encrypted data that was modified, truncated or encrypted with a different key
+var ErrDecryptionFailed = errors.New("decryption failed")
+
+// GenerateEncryptionKey writes a new random file encryption key to path. An existing key is never overwritten
+func GenerateEncryptionKey(path string) error {
+	return generateKeyFile(path, encryptionKeySize)
+}
+
+// ReadEncryptionKey reads a hex encoded file encryption key from path
+func ReadEncryptionKey(path string) ([]byte, error) {
+	key, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != encryptionKeySize {
+		return nil, errors.Errorf("encryption key must be %d bytes", encryptionKeySize)
+	}
+	return key, nil
+}
+
+// EncryptedFile is the ciphertext a local file encrypts to. Chunks of the file are sealed with AES-256-GCM under a key
+// derived from the master key and the file contents, so the same file always encrypts to the same bytes. That lets
+// transfers be resumed and verified by hashes of the ciphertext. The cost is that the server can tell when two
+// files it stores are identical
+type EncryptedFile struct {
+	path      string
+	plainSize uint64
+	header    []byte
+	aead      cipher.AEAD
+}
+
+// OpenEncrypted prepares the file at path for encryption with key. The file is read once to derive its key
+func OpenEncrypted(key []byte, path string) (*EncryptedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		common.LogError(err, "Could not open file to encrypt")
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	plainSize, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	// The salt only depends on the contents, so it does not reveal the plaintext hash without the key
+	salt := keyedHash(key, "salt", hash.Sum(nil))
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	binary.BigEndian.PutUint32(header[len(encryptionMagic):], uint32(encryptionChunkSize))
+	binary.BigEndian.PutUint64(header[len(encryptionMagic)+4:], uint64(plainSize))
+	copy(header[len(encryptionMagic)+12:], salt)
+	aead, err := fileCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFile{path: path, plainSize: uint64(plainSize), header: header, aead: aead}, nil
+}
+
+// Size returns the size of the ciphertext
+func (e *EncryptedFile) Size() uint64 {
+	chunks := e.plainSize/uint64(encryptionChunkSize) + 1
+	return uint64(len(e.header)) + e.plainSize + chunks*uint64(e.aead.Overhead())
+}
+
+// Hash returns the SHA256 hash of the first size bytes of the ciphertext
+func (e *EncryptedFile) Hash(size uint64) (string, error) {
+	reader, err := e.NewReader(0)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return HashReader(io.LimitReader(reader, int64(size)))
+}
+
+// NewReader returns a reader of the ciphertext starting at offset
+func (e *EncryptedFile) NewReader(offset uint64) (io.ReadCloser, error) {
+	if offset > e.Size() {
+		return nil, errors.Errorf("offset %d is past the end of the ciphertext", offset)
+	}
+	file, err := os.Open(e.path)
+	if err != nil {
+		common.LogError(err, "Could not open file to encrypt")
+		return nil, err
+	}
+	reader := &encryptReader{file: file, encrypted: e}
+	if offset == e.Size() {
+		reader.done = true
+		return reader, nil
+	}
+	if offset < uint64(len(e.header)) {
+		reader.pending = e.header[offset:]
+		return reader, nil
+	}
+	sealedChunkSize := uint64(encryptionChunkSize + e.aead.Overhead())
+	reader.chunk = (offset - uint64(len(e.header))) / sealedChunkSize
+	skip := (offset - uint64(len(e.header))) % sealedChunkSize
+	if _, err := file.Seek(int64(reader.chunk)*int64(encryptionChunkSize), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := reader.sealNext(); err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+	if skip > uint64(len(reader.pending)) {
+		file.Close()
+		return nil, errors.Errorf("offset %d is not in the ciphertext", offset)
+	}
+	reader.pending = reader.pending[skip:]
+	return reader, nil
+}
+
+// encryptReader seals the plaintext a chunk at a time as it is read
+type encryptReader struct {
+	file      *os.File
+	encrypted *EncryptedFile
+	// chunk is the index of the next chunk to seal
+	chunk   uint64
+	pending []byte
+	done    bool
+	plain   []byte
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// sealNext seals the next chunk into pending. Returns io.EOF once the last chunk has been sealed
+func (r *encryptReader) sealNext() error {
+	if r.done {
+		return io.EOF
+	}
+	if r.plain == nil {
+		r.plain = make([]byte, encryptionChunkSize)
+	}
+	n, err := io.ReadFull(r.file, r.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	// The chunk count is fixed by the size read when the file was opened, so a file that changed since is caught by
+	// the hash check instead of producing a stream that does not decrypt
+	last := r.chunk == r.encrypted.plainSize/uint64(encryptionChunkSize)
+	if last {
+		n = int(r.encrypted.plainSize % uint64(encryptionChunkSize))
+	} else if n < encryptionChunkSize {
+		return errors.New("file shrank while being encrypted")
+	}
+	r.pending = r.encrypted.aead.Seal(r.pending[:0], chunkNonce(r.chunk, last), r.plain[:n], r.encrypted.header)
+	r.chunk++
+	r.done = last
+	return nil
+}
+
+func (r *encryptReader) Close() error {
+	return r.file.Close()
+}
+
+// Decrypt writes the plaintext of an encrypted file read from in to out. An error is returned if any of the file was
+// modified, truncated or encrypted with a different key, in which case out holds an incomplete plaintext
+func Decrypt(key []byte, in io.Reader, out io.Writer) error {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return errors.Wrap(ErrDecryptionFailed, "file is too short to be encrypted")
+	}
+	if !bytes.Equal(header[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		return errors.Wrap(ErrDecryptionFailed, "file is not encrypted by torrxfer")
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(encryptionMagic):])
+	plainSize := binary.BigEndian.Uint64(header[len(encryptionMagic)+4:])
+	salt := header[len(encryptionMagic)+12:]
+	if chunkSize == 0 || chunkSize > 16*1024*1024 {
+		return errors.Wrap(ErrDecryptionFailed, "invalid chunk size")
+	}
+	aead, err := fileCipher(key, salt)
+	if err != nil {
+		return err
+	}
+	lastChunk := plainSize / uint64(chunkSize)
+	sealed := make([]byte, int(chunkSize)+aead.Overhead())
+	var plain []byte
+	for chunk := uint64(0); chunk <= lastChunk; chunk++ {
+		size := len(sealed)
+		if chunk == lastChunk {
+			size = int(plainSize%uint64(chunkSize)) + aead.Overhead()
+		}
+		if _, err := io.ReadFull(in, sealed[:size]); err != nil {
+			return errors.Wrap(ErrDecryptionFailed, "file is truncated")
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(chunk, chunk == lastChunk), sealed[:size], header)
+		if err != nil {
+			return errors.Wrapf(ErrDecryptionFailed, "chunk %d does not authenticate", chunk)
+		}
+		if _, err := out.Write(plain); err != nil {
+			return err
+		}
+	}
+	if n, _ := in.Read(sealed[:1]); n != 0 {
+		return errors.Wrap(ErrDecryptionFailed, "file has trailing data")
+	}
+	return nil
+}
+
+// fileCipher returns the AEAD for the file with salt
+func fileCipher(key, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(keyedHash(key, "file", salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce numbers the chunks of a file and marks the last one, so chunks cannot be reordered, dropped or the file
+// truncated at a chunk boundary without decryption failing
+func chunkNonce(chunk uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, chunk)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// keyedHash derives a value for purpose from data with key
+func keyedHash(key []byte, purpose string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
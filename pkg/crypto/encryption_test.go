@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptTestFile writes size random bytes to a file and opens it for encryption
+func encryptTestFile(t *testing.T, key []byte, size int) ([]byte, *EncryptedFile) {
+	plain := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(plain)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := OpenEncrypted(key, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain, encrypted
+}
+
+func readCiphertext(t *testing.T, encrypted *EncryptedFile, offset uint64) []byte {
+	reader, err := encrypted.NewReader(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	ciphertext, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, encryptionKeySize)
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, 3*encryptionChunkSize + 17} {
+		plain, encrypted := encryptTestFile(t, key, size)
+		ciphertext := readCiphertext(t, encrypted, 0)
+		if uint64(len(ciphertext)) != encrypted.Size() {
+			t.Errorf("Size %d: ciphertext is %d bytes, expected %d", size, len(ciphertext), encrypted.Size())
+		}
+		// Resuming at any offset continues the same ciphertext
+		for _, offset := range []uint64{1, uint64(encryptionHeaderSize), uint64(encryptionHeaderSize + encryptionChunkSize + 20), encrypted.Size()} {
+			if offset > encrypted.Size() {
+				continue
+			}
+			if !bytes.Equal(readCiphertext(t, encrypted, offset), ciphertext[offset:]) {
+				t.Errorf("Size %d: ciphertext read from offset %d does not match", size, offset)
+			}
+		}
+		var decrypted bytes.Buffer
+		if err := Decrypt(key, bytes.NewReader(ciphertext), &decrypted); err != nil {
+			t.Errorf("Size %d: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("Size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, encryptionKeySize)
+	_, encrypted := encryptTestFile(t, key, 2*encryptionChunkSize+5)
+	ciphertext := readCiphertext(t, encrypted, 0)
+
+	modified := append([]byte(nil), ciphertext...)
+	modified[encryptionHeaderSize+encryptionChunkSize+30] ^= 1
+	truncated := ciphertext[:encryptionHeaderSize+encryptionChunkSize+encrypted.aead.Overhead()]
+	cases := map[string]struct {
+		key        []byte
+		ciphertext []byte
+	}{
+		"modified":  {key, modified},
+		"truncated": {key, truncated},
+		"trailing":  {key, append(append([]byte(nil), ciphertext...), 0)},
+		"wrong key": {bytes.Repeat([]byte{2}, encryptionKeySize), ciphertext},
+	}
+	for name, c := range cases {
+		if err := Decrypt(c.key, bytes.NewReader(c.ciphertext), io.Discard); !errors.Is(err, ErrDecryptionFailed) {
+			t.Errorf("%s: expected decryption to fail, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+const (
+	// keyIDSize is the size of the ID that names the key data was encrypted with
+	keyIDSize int = 8
+	// sealedValueMagic starts every value sealed by a keyring
+	sealedValueMagic string = "TORRXFV1"
+)
+
+var (
+	// ErrUnknownKey is returned for data encrypted with a key that is not in the keyring
+	ErrUnknownKey = errors.New("data is encrypted with a key that is not in the keyring")
+	// ErrNotSealed is returned for data that was not encrypted by a keyring
+	ErrNotSealed = errors.New("data is not encrypted")
+)
+
+// Keyring holds the keys data at rest is encrypted with. The first key encrypts new data. The others only decrypt data
+// written before the keys were rotated, until it is encrypted again with the first
+type Keyring struct {
+	keys []ringKey
+	sync.RWMutex
+}
+
+type ringKey struct {
+	id  []byte
+	key []byte
+	// value seals values, which are small enough to use a random nonce per value with a single key
+	value cipher.AEAD
+}
+
+// GenerateKeyring writes a keyring with a single new random key to path. An existing keyring is never overwritten
+func GenerateKeyring(path string) error {
+	return generateKeyFile(path, encryptionKeySize)
+}
+
+// RotateKeyring adds a new random key to the keyring at path. New data is encrypted with it, and the existing keys are
+// kept to decrypt data until it has been encrypted again
+func RotateKeyring(path string) error {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		common.LogError(err, "Could not open keyring")
+		return err
+	}
+	if _, err := ParseKeyring(string(text)); err != nil {
+		return err
+	}
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(hex.EncodeToString(key)+"\n"+string(text)), 0600)
+}
+
+// ReadKeyring reads a keyring from path. The file holds one hex encoded key per line, newest first
+func ReadKeyring(path string) (*Keyring, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		common.LogError(err, "Could not open keyring")
+		return nil, err
+	}
+	return ParseKeyring(string(text))
+}
+
+// ParseKeyring parses hex encoded keys separated by newlines or commas, newest first
+func ParseKeyring(text string) (*Keyring, error) {
+	keyring := new(Keyring)
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "keyring holds a key that is not hex encoded")
+		}
+		if len(key) != encryptionKeySize {
+			return nil, errors.Errorf("keyring keys must be %d bytes", encryptionKeySize)
+		}
+		block, err := aes.NewCipher(keyedHash(key, "value", nil))
+		if err != nil {
+			return nil, err
+		}
+		value, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys = append(keyring.keys, ringKey{id: keyedHash(key, "id", nil)[:keyIDSize], key: key, value: value})
+	}
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+	return keyring, nil
+}
+
+// Replace swaps the keys of the keyring for those of other, for keyrings reloaded while in use
+func (k *Keyring) Replace(other *Keyring) {
+	other.RLock()
+	keys := other.keys
+	other.RUnlock()
+	k.Lock()
+	defer k.Unlock()
+	k.keys = keys
+}
+
+// CurrentID returns the hex encoded ID of the key new data is encrypted with
+func (k *Keyring) CurrentID() string {
+	return hex.EncodeToString(k.current().id)
+}
+
+// Seal encrypts and authenticates value with the current key
+func (k *Keyring) Seal(value []byte) ([]byte, error) {
+	key := k.current()
+	nonce := make([]byte, key.value.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(sealedValueMagic)+keyIDSize+len(nonce)+len(value)+key.value.Overhead())
+	sealed = append(sealed, sealedValueMagic...)
+	sealed = append(sealed, key.id...)
+	sealed = append(sealed, nonce...)
+	return key.value.Seal(sealed, nonce, value, sealed[:len(sealedValueMagic)+keyIDSize]), nil
+}
+
+// Open decrypts a value sealed by the keyring. Returns ErrNotSealed for values that were never sealed
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrNotSealed
+	}
+	key, ok := k.find(sealed[len(sealedValueMagic) : len(sealedValueMagic)+keyIDSize])
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	nonceStart := len(sealedValueMagic) + keyIDSize
+	if len(sealed) < nonceStart+key.value.NonceSize()+key.value.Overhead() {
+		return nil, ErrDecryptionFailed
+	}
+	nonce := sealed[nonceStart : nonceStart+key.value.NonceSize()]
+	value, err := key.value.Open(nil, nonce, sealed[nonceStart+len(nonce):], sealed[:nonceStart])
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return value, nil
+}
+
+// SealedWithCurrent reports whether value was sealed with the current key
+func (k *Keyring) SealedWithCurrent(sealed []byte) bool {
+	return IsSealed(sealed) && bytes.Equal(sealed[len(sealedValueMagic):len(sealedValueMagic)+keyIDSize], k.current().id)
+}
+
+// IsSealed reports whether value was sealed by a keyring
+func IsSealed(value []byte) bool {
+	return len(value) >= len(sealedValueMagic)+keyIDSize && string(value[:len(sealedValueMagic)]) == sealedValueMagic
+}
+
+func (k *Keyring) current() ringKey {
+	k.RLock()
+	defer k.RUnlock()
+	return k.keys[0]
+}
+
+func (k *Keyring) find(id []byte) (ringKey, bool) {
+	k.RLock()
+	defer k.RUnlock()
+	for _, key := range k.keys {
+		if bytes.Equal(key.id, id) {
+			return key, true
+		}
+	}
+	return ringKey{}, false
+}
@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	if err := GenerateKeyring(path); err != nil {
+		t.Error(err)
+		return
+	}
+	keyring, err := ReadKeyring(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sealed, err := keyring.Seal([]byte("record"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if bytes.Contains(sealed, []byte("record")) || !keyring.SealedWithCurrent(sealed) {
+		t.Errorf("Value was not sealed with the current key")
+	}
+
+	if err := RotateKeyring(path); err != nil {
+		t.Error(err)
+		return
+	}
+	rotated, err := ReadKeyring(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if rotated.CurrentID() == keyring.CurrentID() {
+		t.Errorf("Rotation did not add a new current key")
+	}
+	// Values sealed with the old key still open, but need sealing again
+	if value, err := rotated.Open(sealed); err != nil || string(value) != "record" {
+		t.Errorf("Expected old value to open, got %q %v", value, err)
+	}
+	if rotated.SealedWithCurrent(sealed) {
+		t.Errorf("Old value reported as sealed with the new key")
+	}
+
+	other, err := ParseKeyring(hexKey(3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := other.Open(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected unknown key, got %v", err)
+	}
+	if _, err := other.Open([]byte("plain record")); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("Expected plain value to be reported as not sealed, got %v", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := rotated.Open(sealed); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected modified value to fail, got %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Rotation left a temporary file behind")
+	}
+}
+
+// hexKey returns a hex encoded key made of b
+func hexKey(b byte) string {
+	const digits = "0123456789abcdef"
+	key := make([]byte, 0, 2*encryptionKeySize)
+	for i := 0; i < encryptionKeySize; i++ {
+		key = append(key, digits[b>>4], digits[b&0xf])
+	}
+	return string(key)
+}
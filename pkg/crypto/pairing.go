@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// pairingCodeAlphabet leaves out characters that are easily confused when a code is read out or typed
+	pairingCodeAlphabet string = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// pairingCodeLength is the number of characters in a pairing code, not counting the separators. At 5 bits each,
+	// the 125 bits of a code cannot be guessed offline from a proof captured by a server impersonating the real one
+	pairingCodeLength int = 25
+	// pairingCodeGroupSize is the number of characters between separators
+	pairingCodeGroupSize int = 5
+
+	// PairingRoleClient and PairingRoleServer tell the proofs of both sides of a pairing apart
+	PairingRoleClient string = "client"
+	PairingRoleServer string = "server"
+)
+
+// GeneratePairingCode returns a random single use pairing code such as ABCDE-FGHJK-LMNPQ-RSTUV-WXYZ2
+func GeneratePairingCode() (string, error) {
+	var code strings.Builder
+	max := big.NewInt(int64(len(pairingCodeAlphabet)))
+	for i := 0; i < pairingCodeLength; i++ {
+		if i > 0 && i%pairingCodeGroupSize == 0 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(pairingCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// NormalizePairingCode makes a pairing code typed by a user comparable with the one that was generated
+func NormalizePairingCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
+
+// PairingProof proves knowledge of a pairing code without revealing it. The proof is bound to the fingerprint the
+// client pins for the server, see PinFingerprint, so it cannot be relayed through a server presenting a different
+// certificate
+func PairingProof(code, role, fingerprint string) []byte {
+	mac := hmac.New(sha256.New, []byte(NormalizePairingCode(code)))
+	mac.Write([]byte(role + ":" + strings.ToLower(fingerprint)))
+	return mac.Sum(nil)
+}
+
+// CheckPairingProof reports whether proof was made with code for role and fingerprint
+func CheckPairingProof(proof []byte, code, role, fingerprint string) bool {
+	return hmac.Equal(proof, PairingProof(code, role, fingerprint))
+}
+
+// GenerateClientKey creates a key for a client certificate and a certificate signing request for it
+func GenerateClientKey() (keyPEM, requestPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The server decides the identity, so the request carries no subject
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// SignClientRequest signs a client certificate for identity over the key in a PEM certificate signing request
+func (ca *CertificateAuthority) SignClientRequest(identity string, requestPEM []byte, ttl time.Duration) ([]byte, error) {
+	block, _ := pem.Decode(requestPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse certificate request PEM")
+	}
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	// The client must hold the key it asks a certificate for
+	if err := request.CheckSignature(); err != nil {
+		return nil, err
+	}
+	template, err := clientTemplate(identity, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return ca.sign(template, request.PublicKey)
+}
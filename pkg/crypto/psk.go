@@ -0,0 +1,149 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+const (
+	// pskSalt separates keys derived from a passphrase here from anything else derived from the same passphrase
+	pskSalt string = "torrxfer pre-shared key v1"
+	// pskIterations slows down guessing the passphrase from the public key, which anyone connecting can see
+	pskIterations int = 210000
+	// pskMinLength is the shortest passphrase accepted
+	pskMinLength int = 16
+	// pskGeneratedSize is the size in bytes of the random part of a generated passphrase
+	pskGeneratedSize int = 32
+)
+
+// ErrPSKMismatch is returned when the peer does not hold the same pre-shared key
+var ErrPSKMismatch = errors.New("peer does not hold the pre-shared key")
+
+// PSKIdentity is the TLS identity both sides of a pre-shared key connection derive from the passphrase. Each side
+// presents the same certificate and accepts only a peer that presents the same key, so a handshake only completes
+// between holders of the passphrase
+type PSKIdentity struct {
+	Certificate tls.Certificate
+	publicKey   ed25519.PublicKey
+}
+
+// GeneratePSK writes a new random passphrase to path. An existing passphrase is never overwritten
+func GeneratePSK(path string) (string, error) {
+	key := make([]byte, pskGeneratedSize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	passphrase := base64.RawURLEncoding.EncodeToString(key)
+	if err := writeNewFile(path, []byte(passphrase+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return passphrase, nil
+}
+
+// ReadPSK reads a passphrase from path
+func ReadPSK(path string) (string, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		common.LogError(err, "Could not open pre-shared key file")
+		return "", err
+	}
+	return strings.TrimSpace(string(text)), nil
+}
+
+// DerivePSKIdentity derives the TLS identity for passphrase
+func DerivePSKIdentity(passphrase string) (*PSKIdentity, error) {
+	if len(passphrase) < pskMinLength {
+		return nil, errors.Errorf("pre-shared key must be at least %d characters", pskMinLength)
+	}
+	seed := pbkdf2SHA256([]byte(passphrase), []byte(pskSalt), pskIterations, ed25519.SeedSize)
+	key := ed25519.NewKeyFromSeed(seed)
+	publicKey := key.Public().(ed25519.PublicKey)
+	// The certificate only carries the key. Peers check the key, not the certificate fields
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "torrxfer pre-shared key"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Date(9999, time.December, 31, 23, 59, 59, 0, time.UTC),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"torrxfer"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &PSKIdentity{
+		Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		publicKey:   publicKey,
+	}, nil
+}
+
+// TLSConfig returns a TLS configuration for either side of a pre-shared key connection
+func (p *PSKIdentity) TLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{p.Certificate},
+		// Servers ask clients for the certificate. Neither side verifies a chain, only the key in VerifyPeer
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p.VerifyPeer,
+		// TLS 1.3 keeps the certificates, and with them the public key, from passive observers
+		MinVersion: tls.VersionTLS13,
+	}
+}
+
+// VerifyPeer accepts a peer that presented a certificate for the key derived from the passphrase. Used as
+// tls.Config.VerifyPeerCertificate
+func (p *PSKIdentity) VerifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return ErrPSKMismatch
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	publicKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || !bytes.Equal(publicKey, p.publicKey) {
+		return ErrPSKMismatch
+	}
+	return nil
+}
+
+// pbkdf2SHA256 is PBKDF2 from RFC 8018 with HMAC-SHA256 as the pseudorandom function
+func pbkdf2SHA256(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	block := make([]byte, 4)
+	for i := uint32(1); len(key) < keyLength; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block, i)
+		prf.Write(block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector from RFC 7914 section 11
+	const expected = "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	key := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	if hex.EncodeToString(key) != expected {
+		t.Errorf("PBKDF2 was incorrect. Got %x, expected %s", key, expected)
+	}
+}
+
+// pskHandshake runs a TLS handshake between a client and a server holding the given passphrases
+func pskHandshake(t *testing.T, clientPassphrase, serverPassphrase string) error {
+	clientIdentity, err := DerivePSKIdentity(clientPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverIdentity, err := DerivePSKIdentity(serverPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		server := tls.Server(serverConn, serverIdentity.TLSConfig())
+		serverErr <- server.Handshake()
+		// Unblock the client if the server gave up first
+		server.Close()
+	}()
+	clientErr := tls.Client(clientConn, clientIdentity.TLSConfig()).Handshake()
+	if err := <-serverErr; err != nil {
+		return err
+	}
+	return clientErr
+}
+
+func TestPSKHandshake(t *testing.T) {
+	const passphrase = "correct horse battery staple"
+	if err := pskHandshake(t, passphrase, passphrase); err != nil {
+		t.Errorf("Expected handshake with the same passphrase to succeed, got %v", err)
+	}
+	if err := pskHandshake(t, passphrase, passphrase+"!"); err == nil {
+		t.Errorf("Expected handshake with different passphrases to fail")
+	}
+	if _, err := DerivePSKIdentity("short"); err == nil {
+		t.Errorf("Expected short passphrase to be refused")
+	}
+	identity, err := DerivePSKIdentity(passphrase)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := identity.VerifyPeer(nil, nil); !errors.Is(err, ErrPSKMismatch) {
+		t.Errorf("Expected peer without certificate to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,464 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sealedFileMagic starts every file sealed by a keyring and names the format version
+	sealedFileMagic string = "TORRXFS2"
+	// sealedFileMagicPrefix is the part of the magic that stays the same between format versions
+	sealedFileMagicPrefix string = "TORRXFS"
+	// sealedFileIDSize is the size of the random ID each sealed file derives its keys from
+	sealedFileIDSize int = 16
+	// sealedSizeRecordSize is the size of the key ID, nonce and sealed data length stored after the file ID
+	sealedSizeRecordSize int64 = int64(keyIDSize) + 12 + 8 + 16
+	// sealedHeaderSize is the size of the magic, file ID and size record that precede the blocks
+	sealedHeaderSize int64 = int64(len(sealedFileMagic)+sealedFileIDSize) + sealedSizeRecordSize
+	// sealedBlockSize is the amount of data sealed together. Writes re-seal every block they touch, so it is kept
+	// close to the size of the chunks clients send
+	sealedBlockSize int64 = 4096
+	// sealedSlotHeaderSize is the size of the key ID, nonce and data length stored before each sealed block
+	sealedSlotHeaderSize int64 = int64(keyIDSize) + 12 + 4
+	// sealedSlotSize is the space each block takes on disk, whether or not it is full
+	sealedSlotSize int64 = sealedSlotHeaderSize + sealedBlockSize + 16
+)
+
+// SealedFile is a file encrypted at rest with a keyring that supports positional reads and writes. Data is sealed in
+// fixed size blocks with AES-256-GCM, each with its own random nonce and the ID of the key it was sealed with, so
+// blocks sealed with any key in the keyring read back after the key is rotated. The length of the data is sealed in the header, and
+// every block up to it is sealed, including the blocks of holes that were never written, so a file that is cut short
+// or has blocks zeroed does not read back
+type SealedFile struct {
+	file    *os.File
+	keys    *Keyring
+	fileID  []byte
+	ciphers map[string]cipher.AEAD
+	// blocks is the number of blocks that hold data and size the length of the data. Blocks on disk past the end of
+	// the data, left by a write that was interrupted before the size was updated, are sealed again before they are used
+	blocks int64
+	size   int64
+	sync.Mutex
+}
+
+// SealedFileSize returns the space a sealed file holding size bytes of data takes on disk
+func SealedFileSize(size int64) int64 {
+	return sealedHeaderSize + (size+sealedBlockSize-1)/sealedBlockSize*sealedSlotSize
+}
+
+// OpenSealedFile reads the data in file through keys. An empty file that is open for writing is initialized as a sealed
+// file. Returns ErrNotSealed for files that hold data that was not sealed, which can then be used as they are. The
+// sealed file takes ownership of file
+func OpenSealedFile(file *os.File, keys *Keyring) (*SealedFile, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sealed := &SealedFile{file: file, keys: keys, ciphers: make(map[string]cipher.AEAD)}
+	header := make([]byte, sealedHeaderSize)
+	if stat.Size() == 0 {
+		copy(header, sealedFileMagic)
+		if _, err := rand.Read(header[len(sealedFileMagic) : len(sealedFileMagic)+sealedFileIDSize]); err != nil {
+			return nil, err
+		}
+		sealed.fileID = header[len(sealedFileMagic) : len(sealedFileMagic)+sealedFileIDSize]
+		// Files opened read only can not be initialized, and are as empty as they would be if they were sealed
+		if _, err := file.WriteAt(header[:len(sealedFileMagic)+sealedFileIDSize], 0); err != nil {
+			return nil, ErrNotSealed
+		}
+		if err := sealed.writeSize(); err != nil {
+			return nil, err
+		}
+		return sealed, nil
+	}
+	magic := make([]byte, len(sealedFileMagic))
+	if _, err := file.ReadAt(magic, 0); err != nil || !strings.HasPrefix(string(magic), sealedFileMagicPrefix) {
+		return nil, ErrNotSealed
+	}
+	if string(magic) != sealedFileMagic {
+		return nil, errors.Errorf("unsupported sealed file version %s", magic)
+	}
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, errors.Wrap(ErrDecryptionFailed, "file is shorter than its header")
+	}
+	sealed.fileID = header[len(sealedFileMagic) : len(sealedFileMagic)+sealedFileIDSize]
+	if sealed.size, err = sealed.readSize(header[len(sealedFileMagic)+sealedFileIDSize:]); err != nil {
+		return nil, err
+	}
+	sealed.blocks = (sealed.size + sealedBlockSize - 1) / sealedBlockSize
+	if (stat.Size()-sealedHeaderSize)/sealedSlotSize < sealed.blocks {
+		return nil, errors.Wrap(ErrDecryptionFailed, "file is shorter than its sealed size")
+	}
+	return sealed, nil
+}
+
+// Size returns the size of the data in the file
+func (f *SealedFile) Size() (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.size, nil
+}
+
+// ReadAt implements io.ReaderAt over the data in the file
+func (f *SealedFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < f.size {
+		position := off + int64(n)
+		index, within := position/sealedBlockSize, position%sealedBlockSize
+		data, err := f.readBlock(index)
+		if err != nil {
+			return n, err
+		}
+		// Only the end of the last block is past the end of the file. Anything in between that was never written is zero
+		end := sealedBlockSize
+		if f.size-index*sealedBlockSize < end {
+			end = f.size - index*sealedBlockSize
+		}
+		chunk := p[n:]
+		if int64(len(chunk)) > end-within {
+			chunk = chunk[:end-within]
+		}
+		copied := 0
+		if within < int64(len(data)) {
+			copied = copy(chunk, data[within:])
+		}
+		for i := copied; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		n += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt over the data in the file. Blocks that are only partly written are read and sealed
+// again with the rest of their data
+func (f *SealedFile) WriteAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	size := f.size
+	n := 0
+	for n < len(p) {
+		position := off + int64(n)
+		index, within := position/sealedBlockSize, position%sealedBlockSize
+		take := int64(len(p) - n)
+		if take > sealedBlockSize-within {
+			take = sealedBlockSize - within
+		}
+		block := p[n : int64(n)+take]
+		if take != sealedBlockSize {
+			existing, err := f.readData(index)
+			if err != nil {
+				f.updateSize(size)
+				return n, err
+			}
+			length := within + take
+			if current := int64(len(existing)); current > length {
+				length = current
+			}
+			block = make([]byte, length)
+			copy(block, existing)
+			copy(block[within:], p[n:int64(n)+take])
+		}
+		if err := f.writeBlock(index, block); err != nil {
+			f.updateSize(size)
+			return n, err
+		}
+		n += int(take)
+		if position+take > size {
+			size = position + take
+		}
+	}
+	return n, f.updateSize(size)
+}
+
+// Truncate changes the size of the data in the file. Data added by growing the file reads as zeros
+func (f *SealedFile) Truncate(size int64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	if size == f.size {
+		return nil
+	}
+	if size > f.size {
+		// The last block is sealed again without anything past the current end, and the blocks up to the new end
+		// are sealed as holes
+		last := (size - 1) / sealedBlockSize
+		existing, err := f.readData(last)
+		if err != nil {
+			return err
+		}
+		if err := f.writeBlock(last, existing); err != nil {
+			return err
+		}
+		if f.size%sealedBlockSize != 0 && (f.size-1)/sealedBlockSize < last {
+			previous := (f.size - 1) / sealedBlockSize
+			if existing, err = f.readData(previous); err != nil {
+				return err
+			}
+			if err := f.writeBlock(previous, existing); err != nil {
+				return err
+			}
+		}
+		return f.updateSize(size)
+	}
+	// The size shrinks first, so the file is never left with a sealed size longer than its data
+	blocks := (size + sealedBlockSize - 1) / sealedBlockSize
+	var block []byte
+	if blocks > 0 {
+		existing, err := f.readBlock(blocks - 1)
+		if err != nil {
+			return err
+		}
+		block = make([]byte, size-(blocks-1)*sealedBlockSize)
+		copy(block, existing)
+	}
+	if err := f.updateSize(size); err != nil {
+		return err
+	}
+	if err := f.file.Truncate(sealedHeaderSize + blocks*sealedSlotSize); err != nil {
+		return err
+	}
+	f.blocks = blocks
+	if blocks == 0 {
+		return nil
+	}
+	return f.writeBlock(blocks-1, block)
+}
+
+// StaleBlocks returns the number of blocks sealed with a key other than the current key, counting the sealed size as a
+// block. A file with stale blocks can be encrypted with the current key by copying its data to a new sealed file
+func (f *SealedFile) StaleBlocks() (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	current := f.keys.current().id
+	stale := 0
+	keyID := make([]byte, keyIDSize)
+	if _, err := f.file.ReadAt(keyID, int64(len(sealedFileMagic)+sealedFileIDSize)); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(keyID, current) {
+		stale++
+	}
+	for index := int64(0); index < f.blocks; index++ {
+		if _, err := f.file.ReadAt(keyID, sealedHeaderSize+index*sealedSlotSize); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(keyID, current) {
+			stale++
+		}
+	}
+	return stale, nil
+}
+
+// Sync commits the file to disk
+func (f *SealedFile) Sync() error {
+	return f.file.Sync()
+}
+
+// Close closes the file
+func (f *SealedFile) Close() error {
+	return f.file.Close()
+}
+
+// readBlock returns the data in the block at index. Blocks past the end of the file are empty. Every block before it
+// must be sealed
+func (f *SealedFile) readBlock(index int64) ([]byte, error) {
+	if index >= f.blocks {
+		return nil, nil
+	}
+	slot := make([]byte, sealedSlotSize)
+	if _, err := f.file.ReadAt(slot, sealedHeaderSize+index*sealedSlotSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	keyID := slot[:keyIDSize]
+	if isZero(keyID) {
+		return nil, errors.Wrapf(ErrDecryptionFailed, "block %d is missing", index)
+	}
+	aead, err := f.cipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(slot[sealedSlotHeaderSize-4:]))
+	if length > sealedBlockSize {
+		return nil, errors.Wrapf(ErrDecryptionFailed, "block %d is longer than the block size", index)
+	}
+	nonce := slot[keyIDSize : keyIDSize+aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, slot[sealedSlotHeaderSize:sealedSlotHeaderSize+length+int64(aead.Overhead())], f.blockData(index, slot))
+	if err != nil {
+		return nil, errors.Wrapf(ErrDecryptionFailed, "block %d does not authenticate", index)
+	}
+	return data, nil
+}
+
+// readData returns the data in the block at index that is before the end of the file
+func (f *SealedFile) readData(index int64) ([]byte, error) {
+	data, err := f.readBlock(index)
+	if err != nil {
+		return nil, err
+	}
+	if end := f.size - index*sealedBlockSize; int64(len(data)) > end {
+		if end < 0 {
+			end = 0
+		}
+		data = data[:end]
+	}
+	return data, nil
+}
+
+// writeBlock seals data with the current key into the block at index. Blocks between the end of the file and index are
+// sealed empty first, so the file never has a hole that is not authenticated
+func (f *SealedFile) writeBlock(index int64, data []byte) error {
+	for f.blocks < index {
+		if err := f.sealBlock(f.blocks, nil); err != nil {
+			return err
+		}
+	}
+	return f.sealBlock(index, data)
+}
+
+func (f *SealedFile) sealBlock(index int64, data []byte) error {
+	key := f.keys.current()
+	aead, err := f.cipher(key.id)
+	if err != nil {
+		return err
+	}
+	slot := make([]byte, sealedSlotSize)
+	copy(slot, key.id)
+	if _, err := rand.Read(slot[keyIDSize : keyIDSize+aead.NonceSize()]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(slot[sealedSlotHeaderSize-4:], uint32(len(data)))
+	aead.Seal(slot[sealedSlotHeaderSize:sealedSlotHeaderSize], slot[keyIDSize:keyIDSize+aead.NonceSize()], data, f.blockData(index, slot))
+	if _, err := f.file.WriteAt(slot, sealedHeaderSize+index*sealedSlotSize); err != nil {
+		return err
+	}
+	if index >= f.blocks {
+		f.blocks = index + 1
+	}
+	return nil
+}
+
+// updateSize seals size as the length of the data if it changed
+func (f *SealedFile) updateSize(size int64) error {
+	if size == f.size {
+		return nil
+	}
+	f.size = size
+	return f.writeSize()
+}
+
+// writeSize seals the length of the data into the header with the current key
+func (f *SealedFile) writeSize() error {
+	key := f.keys.current()
+	aead, err := f.cipher(key.id)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, sealedSizeRecordSize)
+	copy(record, key.id)
+	nonce := record[keyIDSize : keyIDSize+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(f.size))
+	aead.Seal(record[keyIDSize+aead.NonceSize():keyIDSize+aead.NonceSize()], nonce, length, f.sizeData(key.id))
+	_, err = f.file.WriteAt(record, int64(len(sealedFileMagic)+sealedFileIDSize))
+	return err
+}
+
+// readSize returns the length of the data sealed in record
+func (f *SealedFile) readSize(record []byte) (int64, error) {
+	keyID := record[:keyIDSize]
+	aead, err := f.cipher(keyID)
+	if err != nil {
+		return 0, err
+	}
+	nonce := record[keyIDSize : keyIDSize+aead.NonceSize()]
+	length, err := aead.Open(nil, nonce, record[keyIDSize+aead.NonceSize():], f.sizeData(keyID))
+	if err != nil || len(length) != 8 {
+		return 0, errors.Wrap(ErrDecryptionFailed, "file size does not authenticate")
+	}
+	size := binary.BigEndian.Uint64(length)
+	if size > math.MaxInt64/2 {
+		return 0, errors.Wrap(ErrDecryptionFailed, "file size is out of range")
+	}
+	return int64(size), nil
+}
+
+// sizeData is the data the size is authenticated with besides its value, so it can not be moved between files
+func (f *SealedFile) sizeData(keyID []byte) []byte {
+	data := make([]byte, 0, len(sealedFileMagic)+sealedFileIDSize+keyIDSize)
+	data = append(data, sealedFileMagic...)
+	data = append(data, f.fileID...)
+	return append(data, keyID...)
+}
+
+// blockData is the data each block is authenticated with besides its contents, so blocks can not be moved within or
+// between files, or their key or length changed
+func (f *SealedFile) blockData(index int64, slot []byte) []byte {
+	data := make([]byte, 0, sealedFileIDSize+8+keyIDSize+4)
+	data = append(data, f.fileID...)
+	data = append(data, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(data[sealedFileIDSize:], uint64(index))
+	data = append(data, slot[:keyIDSize]...)
+	return append(data, slot[sealedSlotHeaderSize-4:sealedSlotHeaderSize]...)
+}
+
+// cipher returns the cipher for the blocks of this file sealed with the key with id
+func (f *SealedFile) cipher(id []byte) (cipher.AEAD, error) {
+	if aead, ok := f.ciphers[string(id)]; ok {
+		return aead, nil
+	}
+	key, ok := f.keys.find(id)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	block, err := aes.NewCipher(keyedHash(key.key, "file", f.fileID))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	f.ciphers[string(id)] = aead
+	return aead, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
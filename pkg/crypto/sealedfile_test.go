@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSealedFile(t *testing.T, path string, keys *Keyring) *SealedFile {
+	handle, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := OpenSealedFile(handle, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// checkSealedContents reads the whole file and compares it with expected
+func checkSealedContents(t *testing.T, sealed *SealedFile, expected []byte) {
+	t.Helper()
+	if size, _ := sealed.Size(); size != int64(len(expected)) {
+		t.Errorf("Size is %d, expected %d", size, len(expected))
+		return
+	}
+	data, err := io.ReadAll(io.NewSectionReader(sealed, 0, int64(len(expected))))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Contents do not match")
+	}
+}
+
+func TestSealedFileWrites(t *testing.T) {
+	keys, err := ParseKeyring(hexKey(1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	path := filepath.Join(t.TempDir(), "file")
+	sealed := openTestSealedFile(t, path, keys)
+	random := rand.New(rand.NewSource(1))
+	var expected []byte
+	write := func(offset int64, size int) {
+		data := make([]byte, size)
+		random.Read(data)
+		if _, err := sealed.WriteAt(data, offset); err != nil {
+			t.Fatal(err)
+		}
+		if end := offset + int64(size); end > int64(len(expected)) {
+			expected = append(expected, make([]byte, end-int64(len(expected)))...)
+		}
+		copy(expected[offset:], data)
+	}
+	// Chunks that are not block aligned, arrive out of order and leave holes
+	write(0, 1000)
+	write(1000, 5000)
+	write(20000, 1024)
+	write(9000, 3000)
+	write(int64(sealedBlockSize)*2, int(sealedBlockSize))
+	checkSealedContents(t, sealed, expected)
+
+	if err := sealed.Truncate(7000); err != nil {
+		t.Error(err)
+		return
+	}
+	expected = expected[:7000]
+	checkSealedContents(t, sealed, expected)
+	write(7000, 100)
+	sealed.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if bytes.Contains(raw, expected[:64]) {
+		t.Errorf("Data is stored in the clear")
+	}
+
+	// Rotating the key keeps the data readable, and copying the data seals every block with the new key
+	rotated, err := ParseKeyring(hexKey(2) + "," + hexKey(1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sealed = openTestSealedFile(t, path, rotated)
+	checkSealedContents(t, sealed, expected)
+	if stale, err := sealed.StaleBlocks(); err != nil || stale != 3 {
+		t.Errorf("Expected the size and 2 blocks to be stale, got %d %v", stale, err)
+	}
+	copyPath := filepath.Join(t.TempDir(), "copy")
+	copied := openTestSealedFile(t, copyPath, rotated)
+	if _, err := io.Copy(&sectionWriter{copied, 0}, io.NewSectionReader(sealed, 0, int64(len(expected)))); err != nil {
+		t.Error(err)
+		return
+	}
+	if stale, err := copied.StaleBlocks(); err != nil || stale != 0 {
+		t.Errorf("Expected no stale blocks after copying, got %d %v", stale, err)
+	}
+	sealed.Close()
+	copied.Close()
+	newOnly, err := ParseKeyring(hexKey(2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sealed = openTestSealedFile(t, copyPath, newOnly)
+	defer sealed.Close()
+	checkSealedContents(t, sealed, expected)
+
+	old, err := ParseKeyring(hexKey(1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handle, err := os.Open(copyPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer handle.Close()
+	if _, err := OpenSealedFile(handle, old); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected unknown key, got %v", err)
+	}
+}
+
+func TestSealedFileDetectsPlainFiles(t *testing.T) {
+	keys, err := ParseKeyring(hexKey(1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	path := filepath.Join(t.TempDir(), "plain")
+	if err := os.WriteFile(path, []byte("plain media file"), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+	handle, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer handle.Close()
+	if _, err := OpenSealedFile(handle, keys); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("Expected plain file to be reported as not sealed, got %v", err)
+	}
+}
+
+// sectionWriter writes to the end of what it has written to a sealed file so far
+type sectionWriter struct {
+	file   *SealedFile
+	offset int64
+}
+
+func (w *sectionWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+func TestSealedFileDetectsTampering(t *testing.T) {
+	keys, err := ParseKeyring(hexKey(1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("sealed data "), 2000)
+	// A hole is left between the two writes
+	hole := int64(len(data)) + 3*sealedBlockSize
+	write := func(path string) {
+		sealed := openTestSealedFile(t, path, keys)
+		defer sealed.Close()
+		if _, err := sealed.WriteAt(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sealed.WriteAt(data, hole); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(path string) error {
+		handle, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		sealed, err := OpenSealedFile(handle, keys)
+		if err != nil {
+			handle.Close()
+			return err
+		}
+		defer sealed.Close()
+		size, _ := sealed.Size()
+		_, err = io.Copy(io.Discard, io.NewSectionReader(sealed, 0, size))
+		return err
+	}
+	zero := func(path string, offset int64, size int) {
+		handle, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer handle.Close()
+		if _, err := handle.WriteAt(make([]byte, size), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "intact")
+	write(path)
+	if err := read(path); err != nil {
+		t.Errorf("Expected intact file to read back, got %v", err)
+	}
+	tampered := map[string]func(path string){
+		"truncated": func(path string) {
+			if err := os.Truncate(path, sealedHeaderSize+2*sealedSlotSize); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"block zeroed": func(path string) { zero(path, sealedHeaderSize+sealedSlotSize, int(sealedSlotSize)) },
+		"hole zeroed":  func(path string) { zero(path, sealedHeaderSize+7*sealedSlotSize, int(sealedSlotSize)) },
+		"size zeroed":  func(path string) { zero(path, int64(len(sealedFileMagic)+sealedFileIDSize), int(sealedSizeRecordSize)) },
+	}
+	for name, tamper := range tampered {
+		path := filepath.Join(dir, name)
+		write(path)
+		tamper(path)
+		if err := read(path); !errors.Is(err, ErrDecryptionFailed) && !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("Expected %s file to be refused, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+const (
+	// tokenIssuer is the issuer of every token signed by a torrxfer server
+	tokenIssuer string = "torrxfer"
+	// tokenKeySize is the size in bytes of a generated token signing key
+	tokenKeySize int = 32
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired or not signed with the server key
+var ErrInvalidToken = errors.New("invalid token")
+
+// GenerateTokenKey writes a new random token signing key to path. An existing key is never overwritten
+func GenerateTokenKey(path string) error {
+	return generateKeyFile(path, tokenKeySize)
+}
+
+// ReadTokenKey reads a hex encoded token signing key from path
+func ReadTokenKey(path string) ([]byte, error) {
+	key, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < tokenKeySize {
+		return nil, fmt.Errorf("token key must be at least %d bytes", tokenKeySize)
+	}
+	return key, nil
+}
+
+// generateKeyFile writes size random bytes hex encoded to path. An existing file is never overwritten
+func generateKeyFile(path string, size int) error {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		common.LogError(err, "Could not create key file")
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(hex.EncodeToString(key) + "\n")
+	return err
+}
+
+// readKeyFile reads a hex encoded key from path
+func readKeyFile(path string) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		common.LogError(err, "Could not open key file")
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(text)))
+}
+
+// IssueToken signs a bearer token for subject that expires after ttl. A ttl of 0 issues a token that never expires
+func IssueToken(key []byte, subject string, ttl time.Duration) (string, error) {
+	if subject == "" {
+		return "", errors.New("token subject must not be empty")
+	}
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		Issuer:   tokenIssuer,
+		Subject:  subject,
+		IssuedAt: now.Unix(),
+	}
+	if ttl != 0 {
+		claims.ExpiresAt = now.Add(ttl).Unix()
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+}
+
+// VerifyToken checks the signature and lifetime of a bearer token and returns its subject
+func VerifyToken(key []byte, token string) (string, error) {
+	claims := new(jwt.StandardClaims)
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		// Only accept the algorithm tokens are issued with so the key cannot be used as anything else
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !parsed.Valid || claims.Issuer != tokenIssuer || claims.Subject == "" {
+		return "", ErrInvalidToken
+	}
+	return claims.Subject, nil
+}
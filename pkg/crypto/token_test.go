@@ -0,0 +1,71 @@
+package crypto
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenIssueVerify(t *testing.T) {
+	dir, err := os.MkdirTemp("", "token")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	keyPath := filepath.Join(dir, "token.key")
+	if err := GenerateTokenKey(keyPath); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := GenerateTokenKey(keyPath); err == nil {
+		t.Errorf("Existing token key was overwritten")
+	}
+	key, err := ReadTokenKey(keyPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	token, err := IssueToken(key, "alice", time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	subject, err := VerifyToken(key, token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if subject != "alice" {
+		t.Errorf("Incorrect subject. Expected: alice got %s", subject)
+	}
+
+	otherKey := []byte(strings.Repeat("k", tokenKeySize))
+	expired, err := IssueToken(key, "alice", -time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for name, invalid := range map[string]string{
+		"wrong key": mustIssue(t, otherKey, "alice"),
+		"expired":   expired,
+		"tampered":  token[:len(token)-2] + "xx",
+		"garbage":   "not a token",
+	} {
+		if _, err := VerifyToken(key, invalid); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Expected %s token to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func mustIssue(t *testing.T, key []byte, subject string) string {
+	token, err := IssueToken(key, subject, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
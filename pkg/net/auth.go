@@ -0,0 +1,158 @@
+package net
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authorizationHeader string = "authorization"
+	bearerPrefix        string = "Bearer "
+)
+
+var (
+	errInvalidToken       = status.Errorf(codes.Unauthenticated, "invalid token")
+	errMissingCertificate = status.Errorf(codes.Unauthenticated, "client certificate required")
+)
+
+// tokenSubjectKey is the context key the verified token subject is stored under
+type tokenSubjectKey struct{}
+
+// TokenValidator checks the bearer token of every incoming request against the server token key
+type TokenValidator struct {
+	key []byte
+}
+
+// NewTokenValidator creates a validator for tokens signed with key
+func NewTokenValidator(key []byte) *TokenValidator {
+	return &TokenValidator{key}
+}
+
+// EnsureValidToken is a unary interceptor that rejects requests without a valid bearer token. Pair is let through
+// since pairing is how a client gets its token
+func (v *TokenValidator) EnsureValidToken(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod == pairMethod {
+		return handler(ctx, req)
+	}
+	ctx, err := v.validate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// EnsureValidTokenStream is a stream interceptor that rejects streams without a valid bearer token
+func (v *TokenValidator) EnsureValidTokenStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := v.validate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ss, ctx})
+}
+
+// validate verifies the bearer token in the request metadata and returns a context carrying its subject
+func (v *TokenValidator) validate(ctx context.Context) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, errMissingMetadata
+	}
+	authorization := md[authorizationHeader]
+	if len(authorization) == 0 || !strings.HasPrefix(authorization[0], bearerPrefix) {
+		return nil, status.Errorf(codes.Unauthenticated, "missing bearer token")
+	}
+	subject, err := crypto.VerifyToken(v.key, strings.TrimPrefix(authorization[0], bearerPrefix))
+	if err != nil {
+		log.Info().Err(err).Msg("Rejected token")
+		return nil, errInvalidToken
+	}
+	return context.WithValue(ctx, tokenSubjectKey{}, subject), nil
+}
+
+// EnsureClientCertificate is a unary interceptor that rejects requests from clients that did not present a verified
+// certificate. Pair is let through since pairing is how a client gets its certificate
+func EnsureClientCertificate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod != pairMethod && !hasClientCertificate(ctx) {
+		return nil, errMissingCertificate
+	}
+	return handler(ctx, req)
+}
+
+// EnsureClientCertificateStream is a stream interceptor that rejects streams from clients that did not present a
+// verified certificate
+func EnsureClientCertificateStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !hasClientCertificate(ss.Context()) {
+		return errMissingCertificate
+	}
+	return handler(srv, ss)
+}
+
+// authenticatedStream replaces the context of a server stream with one carrying the verified token subject
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// tokenCredentials attaches a bearer token to every RPC
+type tokenCredentials struct {
+	token string
+}
+
+// NewTokenCredentials returns per-RPC credentials that send token as a bearer token. They require TLS
+func NewTokenCredentials(token string) credentials.PerRPCCredentials {
+	return tokenCredentials{token}
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{authorizationHeader: bearerPrefix + c.token}, nil
+}
+
+// RequireTransportSecurity never lets the token be sent in the clear
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// clientIdentity returns the authenticated identity of the client. The subject of a client certificate verified during
+// the TLS handshake takes precedence over the subject of a bearer token. Empty if the client is not authenticated
+func clientIdentity(ctx context.Context) string {
+	if cert := clientCertificate(ctx); cert != nil {
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName
+		}
+		return cert.Subject.String()
+	}
+	if subject, ok := ctx.Value(tokenSubjectKey{}).(string); ok {
+		return subject
+	}
+	return ""
+}
+
+// clientCertificate returns the client certificate verified during the TLS handshake. nil if there is none
+func clientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+func hasClientCertificate(ctx context.Context) bool {
+	return clientCertificate(ctx) != nil
+}
@@ -0,0 +1,129 @@
+package net
+
+import (
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+const (
+	// initialChunkSize is the size of the first chunk of a transfer, before any throughput is measured
+	initialChunkSize uint32 = 64 << 10
+	// chunkAlignment keeps chunks a multiple of the block size servers store encrypted files in, so chunks do not
+	// start or end partway through a block
+	chunkAlignment uint32 = 4096
+	// minChunkInterval and maxChunkInterval bound how long sending one chunk should take
+	minChunkInterval = 10 * time.Millisecond
+	maxChunkInterval = 250 * time.Millisecond
+	// throughputSmoothing is the weight of the latest measurement in the average throughput
+	throughputSmoothing = 0.25
+)
+
+// castagnoli is the CRC-32C table chunk checksums are computed with
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChunkChecksum returns the checksum a chunk of data is sent with
+func ChunkChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
+
+// chunkBuffers holds chunk buffers between transfers, so every file does not allocate its own
+var chunkBuffers sync.Pool
+
+// getChunkBuffer returns a buffer that holds at least size bytes
+func getChunkBuffer(size uint32) *[]byte {
+	if buffer, ok := chunkBuffers.Get().(*[]byte); ok && uint32(cap(*buffer)) >= size {
+		return buffer
+	}
+	buffer := make([]byte, size)
+	return &buffer
+}
+
+// putChunkBuffer returns a buffer from getChunkBuffer once nothing refers to it anymore. Buffers larger than a chunk
+// are not kept
+func putChunkBuffer(buffer *[]byte) {
+	if uint32(cap(*buffer)) > MaxChunkSize {
+		return
+	}
+	chunkBuffers.Put(buffer)
+}
+
+// chunkSizer picks the size of each chunk of a transfer so that sending one takes about a round trip to the server at
+// the measured throughput. Slow links get small chunks and regular progress, fast links get large chunks and less
+// overhead per byte
+type chunkSizer struct {
+	min  uint32
+	max  uint32
+	size uint32
+	// interval is how long sending one chunk should take
+	interval time.Duration
+	// throughput is the average rate chunks were sent at, in bytes per second
+	throughput float64
+}
+
+// newChunkSizer returns a sizer for chunks of min to max bytes, rounded to the chunk alignment. 0 uses the default for
+// either bound
+func newChunkSizer(min, max uint32, rtt time.Duration) *chunkSizer {
+	if max == 0 {
+		max = MaxChunkSize
+	}
+	// Both bounds are aligned so that every chunk is
+	if max < chunkAlignment {
+		max = chunkAlignment
+	}
+	max = max / chunkAlignment * chunkAlignment
+	if min == 0 {
+		min = chunkAlignment
+	}
+	min = (min + chunkAlignment - 1) / chunkAlignment * chunkAlignment
+	if min > max {
+		min = max
+	}
+	interval := rtt
+	if interval < minChunkInterval {
+		interval = minChunkInterval
+	}
+	if interval > maxChunkInterval {
+		interval = maxChunkInterval
+	}
+	sizer := &chunkSizer{min: min, max: max, interval: interval}
+	sizer.size = sizer.clamp(initialChunkSize)
+	return sizer
+}
+
+// next returns the size of the next chunk
+func (c *chunkSizer) next() uint32 {
+	return c.size
+}
+
+// observe records that a chunk of n bytes took elapsed to read and send, and sizes the next chunk by the new average
+// throughput. Chunks at most double in size at a time, so a single fast measurement does not jump straight to max
+func (c *chunkSizer) observe(n int, elapsed time.Duration) {
+	if n == 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(n) / elapsed.Seconds()
+	if c.throughput == 0 {
+		c.throughput = rate
+	} else {
+		c.throughput += throughputSmoothing * (rate - c.throughput)
+	}
+	size := uint64(c.throughput * c.interval.Seconds())
+	if size > 2*uint64(c.size) {
+		size = 2 * uint64(c.size)
+	}
+	if size > uint64(c.max) {
+		size = uint64(c.max)
+	}
+	c.size = c.clamp(uint32(size) / chunkAlignment * chunkAlignment)
+}
+
+func (c *chunkSizer) clamp(size uint32) uint32 {
+	if size < c.min {
+		return c.min
+	}
+	if size > c.max {
+		return c.max
+	}
+	return size
+}
@@ -0,0 +1,65 @@
+package net
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChunkSizer(t *testing.T) {
+	sizer := newChunkSizer(0, 0, 100*time.Millisecond)
+	if sizer.next() != initialChunkSize || sizer.max != MaxChunkSize || sizer.min != chunkAlignment {
+		t.Errorf("Unexpected default sizer %+v", sizer)
+		return
+	}
+	// A fast link grows the chunks, but never more than double at a time
+	sizer.observe(int(initialChunkSize), time.Millisecond)
+	if sizer.next() != 2*initialChunkSize {
+		t.Errorf("Expected the chunk size to double, got %d", sizer.next())
+	}
+	for i := 0; i < 10; i++ {
+		sizer.observe(int(sizer.next()), time.Millisecond)
+	}
+	if sizer.next() != MaxChunkSize {
+		t.Errorf("Expected the chunk size to stop at the maximum, got %d", sizer.next())
+	}
+	// A slow link shrinks them down to the minimum
+	for i := 0; i < 50; i++ {
+		sizer.observe(int(sizer.next()), 10*time.Second)
+	}
+	if sizer.next() != chunkAlignment {
+		t.Errorf("Expected the chunk size to stop at the minimum, got %d", sizer.next())
+	}
+
+	// Configured bounds are aligned inwards
+	sizer = newChunkSizer(10000, 50000, 0)
+	if sizer.min != 3*chunkAlignment || sizer.max != 12*chunkAlignment || sizer.next() != sizer.max {
+		t.Errorf("Unexpected sizer for unaligned bounds %+v", sizer)
+	}
+	sizer.observe(30000, 100*time.Millisecond)
+	if sizer.next() != sizer.min {
+		t.Errorf("Expected a slow chunk to shrink the next one to the minimum, got %d", sizer.next())
+	}
+	if sizer.interval != minChunkInterval {
+		t.Errorf("Expected a fast round trip to use the minimum interval, got %s", sizer.interval)
+	}
+	if sizer := newChunkSizer(1<<20, 4096, time.Minute); sizer.next() != 4096 || sizer.interval != maxChunkInterval {
+		t.Errorf("Unexpected sizer for inverted bounds %+v", sizer)
+	}
+}
+
+func TestChunkBuffers(t *testing.T) {
+	buffer := getChunkBuffer(4096)
+	if len(*buffer) < 4096 {
+		t.Errorf("Expected a buffer of at least 4096 bytes, got %d", len(*buffer))
+		return
+	}
+	putChunkBuffer(buffer)
+	if buffer := getChunkBuffer(8192); len(*buffer) < 8192 {
+		t.Errorf("Expected a pooled buffer too small for the request to be replaced, got %d", len(*buffer))
+	}
+	// Buffers larger than a chunk are never pooled
+	putChunkBuffer(getChunkBuffer(MaxChunkSize + 1))
+	if buffer := getChunkBuffer(0); uint32(cap(*buffer)) > MaxChunkSize {
+		t.Errorf("Expected an oversized buffer not to be pooled, got %d bytes", cap(*buffer))
+	}
+}
@@ -0,0 +1,173 @@
+package net
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
+)
+
+const (
+	// CompressionZstd compresses requests with zstd. See zstdCompressor
+	CompressionZstd string = "zstd"
+	// CompressionAuto compresses each file with the preferred codec shared with the server, unless the file looks
+	// incompressible
+	CompressionAuto string = "auto"
+
+	// CompressionSampleSize is how much of the start of a file is sampled to decide whether to compress it
+	CompressionSampleSize = 64 << 10
+	// minCompressionSaving is the fraction of a sample compression has to save for a file to be compressed
+	minCompressionSaving = 0.1
+)
+
+// incompressibleExtensions are file types that are already compressed, so compressing them again only costs CPU
+var incompressibleExtensions = map[string]bool{
+	".mkv": true, ".mp4": true, ".m4v": true, ".avi": true, ".mov": true, ".webm": true, ".wmv": true, ".ts": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".flac": true, ".ogg": true, ".opus": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".zip": true, ".gz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".torrxfer-enc": true,
+}
+
+// compressionCodecs returns the codecs this build can compress and decompress requests with, most preferred first
+func compressionCodecs() []string {
+	codecs := make([]string, 0, 3)
+	for _, codec := range []string{CompressionZstd, CompressionGzip} {
+		if encoding.GetCompressor(codec) != nil {
+			codecs = append(codecs, codec)
+		}
+	}
+	return append(codecs, CompressionNone)
+}
+
+// ParseCompression validates a compression policy: none, auto or the name of a codec. An empty policy is auto. A codec
+// this build has no compressor for is refused
+func ParseCompression(policy string) (string, error) {
+	switch policy = strings.ToLower(policy); policy {
+	case "":
+		return CompressionAuto, nil
+	case "none", CompressionNone:
+		return CompressionNone, nil
+	case CompressionAuto:
+		return policy, nil
+	case CompressionGzip, CompressionZstd:
+		if encoding.GetCompressor(policy) == nil {
+			return "", fmt.Errorf("%s compression is not available in this build. Use none, gzip, zstd or auto", policy)
+		}
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q. Use none, gzip, zstd or auto", policy)
+	}
+}
+
+// CompressionFor returns the codec to send the file at name with under policy. sample returns the start of the data that
+// is sent, and is only called under auto for a file whose extension does not rule out compressing it. A codec the server
+// does not support falls back to auto
+func (n Negotiated) CompressionFor(policy, name string, sample func() []byte) string {
+	if policy == CompressionNone || contains(n.CompressionCodecs, policy) {
+		return policy
+	}
+	if !worthCompressing(name, sample) {
+		return CompressionNone
+	}
+	for _, codec := range n.CompressionCodecs {
+		if codec != CompressionNone {
+			return codec
+		}
+	}
+	return CompressionNone
+}
+
+// worthCompressing reports whether the file at name is worth compressing, judged by its extension and by how well the
+// start of its data from sample compresses
+func worthCompressing(name string, sample func() []byte) bool {
+	if incompressibleExtensions[strings.ToLower(filepath.Ext(name))] {
+		return false
+	}
+	data := sample()
+	if len(data) == 0 {
+		return true
+	}
+	var compressed countingWriter
+	writer, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	if err != nil {
+		return true
+	}
+	writer.Write(data)
+	writer.Close()
+	return float64(compressed) <= float64(len(data))*(1-minCompressionSaving)
+}
+
+// countingWriter discards what is written to it and counts the bytes
+type countingWriter uint64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// CompressionStats count the requests sent for a transfer before and after compression
+type CompressionStats struct {
+	Codec     string
+	RawBytes  uint64
+	WireBytes uint64
+}
+
+// Ratio returns how many times smaller compression made the requests. 0 if nothing was sent
+func (c CompressionStats) Ratio() float64 {
+	if c.WireBytes == 0 {
+		return 0
+	}
+	return float64(c.RawBytes) / float64(c.WireBytes)
+}
+
+// compressionCounter collects CompressionStats for a stream while it is sending
+type compressionCounter struct {
+	codec     string
+	rawBytes  uint64
+	wireBytes uint64
+}
+
+func (c *compressionCounter) stats() CompressionStats {
+	return CompressionStats{
+		Codec:     c.codec,
+		RawBytes:  atomic.LoadUint64(&c.rawBytes),
+		WireBytes: atomic.LoadUint64(&c.wireBytes),
+	}
+}
+
+type compressionCounterKey struct{}
+
+// withCompressionCounter returns a context that counts what the stream it starts sends in counter
+func withCompressionCounter(ctx context.Context, counter *compressionCounter) context.Context {
+	return context.WithValue(ctx, compressionCounterKey{}, counter)
+}
+
+// compressionStatsHandler is a gRPC stats handler that counts the payloads sent by streams with a compressionCounter
+type compressionStatsHandler struct{}
+
+func (compressionStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (compressionStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	payload, ok := s.(*stats.OutPayload)
+	if !ok {
+		return
+	}
+	if counter, ok := ctx.Value(compressionCounterKey{}).(*compressionCounter); ok {
+		atomic.AddUint64(&counter.rawBytes, uint64(payload.Length))
+		atomic.AddUint64(&counter.wireBytes, uint64(payload.WireLength))
+	}
+}
+
+func (compressionStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (compressionStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
@@ -0,0 +1,132 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
+)
+
+func TestCompressionFor(t *testing.T) {
+	negotiated := Negotiated{CompressionCodecs: []string{CompressionGzip, CompressionNone}}
+	text := bytes.Repeat([]byte("Season 1 Episode 1 subtitles\n"), 1000)
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		policy, name string
+		sample       []byte
+		expected     string
+		// sampled is set if the codec depends on the sample
+		sampled bool
+	}{
+		{CompressionAuto, "episode.srt", text, CompressionGzip, true},
+		{CompressionAuto, "episode.srt", random, CompressionNone, true},
+		// Media is skipped by its extension before the sample is looked at
+		{CompressionAuto, "episode.MKV", text, CompressionNone, false},
+		{CompressionAuto, "episode.nfo", nil, CompressionGzip, true},
+		{CompressionNone, "episode.srt", text, CompressionNone, false},
+		{CompressionGzip, "episode.srt", text, CompressionGzip, false},
+		{CompressionGzip, "episode.mkv", random, CompressionGzip, false},
+		// A codec the server does not support falls back to auto
+		{CompressionZstd, "episode.srt", text, CompressionGzip, true},
+		{CompressionZstd, "episode.mkv", text, CompressionNone, false},
+	}
+	for _, test := range tests {
+		sampled := false
+		sample := func() []byte {
+			sampled = true
+			return test.sample
+		}
+		if codec := negotiated.CompressionFor(test.policy, test.name, sample); codec != test.expected {
+			t.Errorf("Expected %s for %s under %s, got %s", test.expected, test.name, test.policy, codec)
+		}
+		if sampled != test.sampled {
+			t.Errorf("Expected %s under %s to be sampled: %t", test.name, test.policy, test.sampled)
+		}
+	}
+	if codec := (Negotiated{CompressionCodecs: []string{CompressionNone}}).CompressionFor(CompressionAuto, "episode.srt", func() []byte { return text }); codec != CompressionNone {
+		t.Errorf("Expected no compression without a shared codec, got %s", codec)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for policy, expected := range map[string]string{"": CompressionAuto, "None": CompressionNone, "gzip": CompressionGzip, "ZSTD": CompressionZstd} {
+		if parsed, err := ParseCompression(policy); err != nil || parsed != expected {
+			t.Errorf("Expected %q to parse as %s, got %s %v", policy, expected, parsed, err)
+		}
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Errorf("Expected an unknown codec to be refused")
+	}
+	if codecs := compressionCodecs(); len(codecs) != 3 || codecs[0] != CompressionZstd {
+		t.Errorf("Expected zstd to be the preferred codec, got %v", codecs)
+	}
+}
+
+func TestZstdCompressor(t *testing.T) {
+	compressor := encoding.GetCompressor(CompressionZstd)
+	if compressor == nil {
+		t.Errorf("Expected a zstd compressor to be registered")
+		return
+	}
+	message := bytes.Repeat([]byte("Season 1 Episode 1 subtitles\n"), 1000)
+	// Pooled encoders and decoders are reused for later messages
+	for i := 0; i < 3; i++ {
+		var compressed bytes.Buffer
+		writer, err := compressor.Compress(&compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := writer.Write(message); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := writer.Close(); err != nil {
+			t.Error(err)
+			return
+		}
+		if compressed.Len() >= len(message)/10 {
+			t.Errorf("Expected the message to compress, got %d bytes", compressed.Len())
+		}
+		reader, err := compressor.Decompress(&compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(decompressed, message) {
+			t.Errorf("Decompressed message does not match")
+		}
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	counter := &compressionCounter{codec: CompressionGzip}
+	handler := compressionStatsHandler{}
+	ctx := withCompressionCounter(context.Background(), counter)
+	handler.HandleRPC(ctx, &stats.OutPayload{Length: 1000, WireLength: 250})
+	handler.HandleRPC(ctx, &stats.OutPayload{Length: 1000, WireLength: 250})
+	handler.HandleRPC(ctx, &stats.InPayload{Length: 1000, WireLength: 1000})
+	// Streams without a counter are not counted
+	handler.HandleRPC(context.Background(), &stats.OutPayload{Length: 1000, WireLength: 1000})
+
+	if s := counter.stats(); s.Codec != CompressionGzip || s.RawBytes != 2000 || s.WireBytes != 500 || s.Ratio() != 4 {
+		t.Errorf("Unexpected compression stats %+v", s)
+	}
+	if ratio := (CompressionStats{}).Ratio(); ratio != 0 {
+		t.Errorf("Expected no ratio before anything was sent, got %f", ratio)
+	}
+}
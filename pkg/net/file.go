@@ -2,6 +2,7 @@ package net
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -18,6 +19,57 @@ type RPCFile struct {
 	file *pb.File
 }
 
+// TransferSummary is the server's account of a file after a transfer stream closes
+type TransferSummary struct {
+	BytesWritten uint64
+	SizeOnDisk   uint64
+	DataHash     string
+}
+
+func (s TransferSummary) toGrpc() *pb.TransferSummary {
+	return &pb.TransferSummary{
+		BytesWritten: s.BytesWritten,
+		SizeOnDisk:   s.SizeOnDisk,
+		DataHash:     s.DataHash,
+	}
+}
+
+// TransferAck is the server's acknowledgement of the data it has durably written while a transfer is in progress
+type TransferAck struct {
+	// CommittedOffset is how much of the start of the file is on disk
+	CommittedOffset uint64
+	// Window is how many bytes past CommittedOffset the client may have sent. 0 does not limit the client
+	Window uint64
+}
+
+func (a TransferAck) toGrpc() *pb.TransferFileResponse {
+	return &pb.TransferFileResponse{
+		CommittedOffset: a.CommittedOffset,
+		Window:          a.Window,
+	}
+}
+
+// ChunkRejection describes a chunk the server received but did not write, so the client has to send it again
+type ChunkRejection struct {
+	Offset uint64
+	Size   uint32
+	Reason string
+}
+
+func (r ChunkRejection) Error() string {
+	return fmt.Sprintf("chunk [%d, %d) rejected: %s", r.Offset, r.Offset+uint64(r.Size), r.Reason)
+}
+
+func (r ChunkRejection) toGrpc() *pb.TransferFileResponse {
+	return &pb.TransferFileResponse{
+		Rejected: &pb.ChunkRejection{
+			Offset: r.Offset,
+			Size:   r.Size,
+			Reason: r.Reason,
+		},
+	}
+}
+
 // NewFile constructs a new file object that wraps around the gRPC struct
 // This function can be called on files that don't exist
 func NewFile(filePath string) (*RPCFile, error) {
@@ -51,10 +103,25 @@ func NewFile(filePath string) (*RPCFile, error) {
 		CreatedTime:    uint64(modtime.Unix()),
 		ModifiedTime:   uint64(modtime.Unix()),
 		Size:           size,
+		SizeOnDisk:     size,
 	}
 	return file, nil
 }
 
+// NewFileFromData constructs a file object for data that is not read from a file on disk as is, such as a file that
+// is encrypted as it is sent
+func NewFileFromData(name string, size uint64, hash string, modTime time.Time) *RPCFile {
+	return &RPCFile{&pb.File{
+		Name:           name,
+		DataHash:       hash,
+		MediaDirectory: "",
+		CreatedTime:    uint64(modTime.Unix()),
+		ModifiedTime:   uint64(modTime.Unix()),
+		Size:           size,
+		SizeOnDisk:     size,
+	}}
+}
+
 // NewFileFromGrpc returns a RPCFile from a gRPC wire file object
 func NewFileFromGrpc(grpcFile *pb.File) *RPCFile {
 	return &RPCFile{grpcFile}
@@ -71,6 +138,17 @@ func (f *RPCFile) SetMediaPath(mediaDirectory string) error {
 	return nil
 }
 
+// SetFileName overrides the file name conveyed to the other side of the connection
+func (f *RPCFile) SetFileName(name string) error {
+	if f.file == nil {
+		err := errors.New("No grpc file. Construct with NewFile")
+		log.Fatal().Stack().Err(err).Msg("")
+		return err
+	}
+	f.file.Name = name
+	return nil
+}
+
 // GetFileName file name
 func (f *RPCFile) GetFileName() string {
 	return f.file.Name
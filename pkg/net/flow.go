@@ -0,0 +1,132 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errChunksRejected is returned to a waiting sender when the server rejected chunks that have to be sent again first
+var errChunksRejected = errors.New("chunks were rejected")
+
+// transferFlow tracks how much of a file has been sent and how much the server has acknowledged, and holds the sender
+// back while it is further ahead of the acknowledgements than the server allows
+type transferFlow struct {
+	sent  uint64
+	acked uint64
+	// window is how far past acked the sender may get. 0 does not limit the sender
+	window uint64
+	// rejected holds the chunks the server rejected that have not been sent again yet
+	rejected []ChunkRejection
+	// err is set once the transfer has stopped, and is returned to a waiting sender
+	err     error
+	changed *sync.Cond
+	sync.Mutex
+}
+
+func newTransferFlow(offset uint64) *transferFlow {
+	flow := &transferFlow{sent: offset, acked: offset}
+	flow.changed = sync.NewCond(&flow.Mutex)
+	return flow
+}
+
+// reserve waits until size more bytes may be sent and counts them as sent. A chunk larger than the window is let
+// through once everything before it has been acknowledged. Returns errChunksRejected without reserving anything while
+// there are rejected chunks to send again
+func (f *transferFlow) reserve(size uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	for f.err == nil && len(f.rejected) == 0 && f.window > 0 && f.sent > f.acked && f.sent+size > f.acked+f.window {
+		f.changed.Wait()
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if len(f.rejected) > 0 {
+		return errChunksRejected
+	}
+	f.sent += size
+	return nil
+}
+
+// settle waits until everything sent has been acknowledged, as chunks may be rejected until then. Returns
+// errChunksRejected while there are rejected chunks to send again
+func (f *transferFlow) settle() error {
+	f.Lock()
+	defer f.Unlock()
+
+	for f.err == nil && len(f.rejected) == 0 && f.acked < f.sent {
+		f.changed.Wait()
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if len(f.rejected) > 0 {
+		return errChunksRejected
+	}
+	return nil
+}
+
+// reject records a chunk the server rejected and wakes the sender to send it again. A rejection larger than a chunk or
+// of data that was never sent stops the transfer instead
+func (f *transferFlow) reject(rejection ChunkRejection) {
+	f.Lock()
+	defer f.Unlock()
+
+	if rejection.Size > MaxChunkSize || rejection.Offset > f.sent || uint64(rejection.Size) > f.sent-rejection.Offset {
+		if f.err == nil {
+			f.err = fmt.Errorf("server rejected a chunk that was not sent: %w", rejection)
+		}
+	} else {
+		f.rejected = append(f.rejected, rejection)
+	}
+	f.changed.Broadcast()
+}
+
+// takeRejections returns the chunks to send again and forgets them
+func (f *transferFlow) takeRejections() []ChunkRejection {
+	f.Lock()
+	defer f.Unlock()
+
+	rejected := f.rejected
+	f.rejected = nil
+	return rejected
+}
+
+// acknowledge records an acknowledgement from the server. Returns how many more bytes are acknowledged than before.
+// The server may acknowledge data from before the transfer started over, which is never counted
+func (f *transferFlow) acknowledge(offset, window uint64) uint64 {
+	f.Lock()
+	defer f.Unlock()
+
+	if offset > f.sent {
+		offset = f.sent
+	}
+	var advanced uint64
+	if offset > f.acked {
+		advanced = offset - f.acked
+		f.acked = offset
+	}
+	f.window = window
+	f.changed.Broadcast()
+	return advanced
+}
+
+// offset returns how much of the file the server has acknowledged
+func (f *transferFlow) offset() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.acked
+}
+
+// stop releases a waiting sender with err
+func (f *transferFlow) stop(err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.err == nil {
+		f.err = err
+	}
+	f.changed.Broadcast()
+}
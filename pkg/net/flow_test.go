@@ -0,0 +1,122 @@
+package net
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransferFlowWindow(t *testing.T) {
+	flow := newTransferFlow(100)
+	// Without a window the sender is never held back
+	if err := flow.reserve(1000); err != nil {
+		t.Error(err)
+		return
+	}
+	if advanced := flow.acknowledge(600, 500); advanced != 500 {
+		t.Errorf("Expected 500 bytes to be acknowledged, got %d", advanced)
+	}
+
+	reserved := make(chan error)
+	go func() { reserved <- flow.reserve(100) }()
+	select {
+	case err := <-reserved:
+		t.Errorf("Expected sender to wait for an acknowledgement, got %v", err)
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+	flow.acknowledge(700, 500)
+	if err := <-reserved; err != nil {
+		t.Error(err)
+	}
+	if offset := flow.offset(); offset != 700 {
+		t.Errorf("Expected offset 700, got %d", offset)
+	}
+}
+
+func TestTransferFlowAcknowledge(t *testing.T) {
+	flow := newTransferFlow(0)
+	// Data the server had before the transfer started over is not progress
+	if advanced := flow.acknowledge(500, 0); advanced != 0 || flow.offset() != 0 {
+		t.Errorf("Expected acknowledgement past the sent data to be ignored, got %d", advanced)
+	}
+	flow.reserve(200)
+	if advanced := flow.acknowledge(500, 0); advanced != 200 {
+		t.Errorf("Expected acknowledgement to stop at the sent data, got %d", advanced)
+	}
+	if advanced := flow.acknowledge(100, 0); advanced != 0 || flow.offset() != 200 {
+		t.Errorf("Expected acknowledgement to never go back, got %d", advanced)
+	}
+	// A chunk larger than the window is sent once nothing else is in flight
+	flow.acknowledge(200, 10)
+	if err := flow.reserve(100); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransferFlowStop(t *testing.T) {
+	flow := newTransferFlow(0)
+	flow.reserve(100)
+	flow.acknowledge(0, 100)
+	stopped := errors.New("stopped")
+	reserved := make(chan error)
+	go func() { reserved <- flow.reserve(100) }()
+	flow.stop(stopped)
+	if err := <-reserved; err != stopped {
+		t.Errorf("Expected waiting sender to be released with %v, got %v", stopped, err)
+	}
+}
+
+func TestTransferFlowRejections(t *testing.T) {
+	flow := newTransferFlow(0)
+	flow.reserve(100)
+	flow.acknowledge(0, 100)
+	// A sender held back by the window is woken up to send the rejected chunk again
+	reserved := make(chan error)
+	go func() { reserved <- flow.reserve(100) }()
+	rejection := ChunkRejection{Offset: 0, Size: 100, Reason: "checksum"}
+	flow.reject(rejection)
+	if err := <-reserved; err != errChunksRejected {
+		t.Errorf("Expected sender to be told about the rejection, got %v", err)
+	}
+	if rejected := flow.takeRejections(); len(rejected) != 1 || rejected[0] != rejection {
+		t.Errorf("Unexpected rejections %v", rejected)
+	}
+	if rejected := flow.takeRejections(); len(rejected) != 0 {
+		t.Errorf("Expected rejections to be forgotten once taken, got %v", rejected)
+	}
+
+	// Settling waits for everything sent to be acknowledged
+	settled := make(chan error)
+	go func() { settled <- flow.settle() }()
+	select {
+	case err := <-settled:
+		t.Errorf("Expected sender to wait for acknowledgements, got %v", err)
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+	flow.acknowledge(100, 100)
+	if err := <-settled; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransferFlowRejectsUnsentChunks(t *testing.T) {
+	rejections := map[string]ChunkRejection{
+		"past the data sent":  {Offset: 50, Size: 100},
+		"after the data sent": {Offset: 200, Size: 1},
+		"larger than a chunk": {Offset: 0, Size: MaxChunkSize + 1},
+		"overflowing":         {Offset: ^uint64(0), Size: 2},
+	}
+	for name, rejection := range rejections {
+		flow := newTransferFlow(0)
+		flow.reserve(100)
+		flow.reject(rejection)
+		if rejected := flow.takeRejections(); len(rejected) != 0 {
+			t.Errorf("Expected rejection %s to be refused, got %v", name, rejected)
+		}
+		if err := flow.settle(); !errors.As(err, new(ChunkRejection)) {
+			t.Errorf("Expected rejection %s to stop the transfer, got %v", name, err)
+		}
+	}
+}
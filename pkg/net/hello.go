@@ -0,0 +1,175 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/sushshring/torrxfer/pkg/common"
+	pb "github.com/sushshring/torrxfer/rpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	// ProtocolVersion is the newest protocol version this build speaks. Version 2 made TransferFile bidirectional,
+	// version 3 added chunk checksums
+	ProtocolVersion uint32 = 3
+	// MinProtocolVersion is the oldest protocol version this build speaks
+	MinProtocolVersion uint32 = 3
+	// MaxChunkSize is the largest chunk of file data this build sends or accepts in one request. It leaves room for
+	// the rest of the request within the default gRPC message size limit
+	MaxChunkSize uint32 = 1 << 20
+
+	// CompressionGzip compresses requests with gzip
+	CompressionGzip string = gzip.Name
+	// CompressionNone sends requests as they are
+	CompressionNone string = encoding.Identity
+	// HashAlgorithmSHA256 identifies files by their SHA-256 hash
+	HashAlgorithmSHA256 string = "sha256"
+	// FeaturePairing is set by servers that exchange pairing codes for credentials
+	FeaturePairing string = "pair"
+)
+
+// ErrIncompatiblePeer is returned when the other side of a connection has nothing in common with this side for one of
+// the negotiated parameters
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// Capabilities describe the protocol versions and features one side of a connection supports
+type Capabilities struct {
+	ProtocolVersion    uint32
+	MinProtocolVersion uint32
+	SoftwareVersion    string
+	// CompressionCodecs and HashAlgorithms are ordered most preferred first
+	CompressionCodecs []string
+	HashAlgorithms    []string
+	// MaxChunkSize is the largest chunk of file data sent or accepted in one request. 0 is no limit
+	MaxChunkSize uint32
+	Features     []string
+}
+
+// Negotiated holds the parameters both sides of a connection support
+type Negotiated struct {
+	ProtocolVersion uint32
+	// PeerVersion is the software version of the other side
+	PeerVersion string
+	// CompressionCodec is the preferred of CompressionCodecs, which holds every codec both sides support
+	CompressionCodec  string
+	CompressionCodecs []string
+	HashAlgorithm     string
+	// MaxChunkSize is the largest chunk of file data either side allows in one request. 0 is no limit
+	MaxChunkSize uint32
+	Features     []string
+}
+
+// DefaultCapabilities returns the capabilities of this build, with the optional features that are enabled
+func DefaultCapabilities(features ...string) Capabilities {
+	return Capabilities{
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		SoftwareVersion:    common.Version,
+		CompressionCodecs:  compressionCodecs(),
+		HashAlgorithms:     []string{HashAlgorithmSHA256},
+		MaxChunkSize:       MaxChunkSize,
+		Features:           features,
+	}
+}
+
+// Negotiate returns the parameters local and remote both support. Where there is a choice, the preference of local
+// wins. Returns ErrIncompatiblePeer if they share no protocol version, compression codec or hash algorithm
+func Negotiate(local, remote Capabilities) (Negotiated, error) {
+	negotiated := Negotiated{
+		ProtocolVersion: local.ProtocolVersion,
+		PeerVersion:     remote.SoftwareVersion,
+		MaxChunkSize:    local.MaxChunkSize,
+	}
+	if remote.ProtocolVersion < negotiated.ProtocolVersion {
+		negotiated.ProtocolVersion = remote.ProtocolVersion
+	}
+	if negotiated.ProtocolVersion < local.MinProtocolVersion || negotiated.ProtocolVersion < remote.MinProtocolVersion {
+		return negotiated, fmt.Errorf("%w: peer version %q speaks protocol versions %d to %d, this side %d to %d. Upgrade the older side",
+			ErrIncompatiblePeer, remote.SoftwareVersion, remote.MinProtocolVersion, remote.ProtocolVersion, local.MinProtocolVersion, local.ProtocolVersion)
+	}
+	var ok bool
+	if negotiated.CompressionCodec, ok = firstShared(local.CompressionCodecs, remote.CompressionCodecs); !ok {
+		return negotiated, fmt.Errorf("%w: no shared compression codec. This side supports %v, peer %v", ErrIncompatiblePeer, local.CompressionCodecs, remote.CompressionCodecs)
+	}
+	negotiated.CompressionCodecs = shared(local.CompressionCodecs, remote.CompressionCodecs)
+	if negotiated.HashAlgorithm, ok = firstShared(local.HashAlgorithms, remote.HashAlgorithms); !ok {
+		return negotiated, fmt.Errorf("%w: no shared hash algorithm. This side supports %v, peer %v", ErrIncompatiblePeer, local.HashAlgorithms, remote.HashAlgorithms)
+	}
+	if negotiated.MaxChunkSize == 0 || (remote.MaxChunkSize != 0 && remote.MaxChunkSize < negotiated.MaxChunkSize) {
+		negotiated.MaxChunkSize = remote.MaxChunkSize
+	}
+	negotiated.Features = shared(local.Features, remote.Features)
+	return negotiated, nil
+}
+
+// HasFeature reports whether both sides support feature
+func (n Negotiated) HasFeature(feature string) bool {
+	return contains(n.Features, feature)
+}
+
+// MarshalZerologObject implements the zerolog Object Marshaller for logging the negotiated parameters
+func (n Negotiated) MarshalZerologObject(e *zerolog.Event) {
+	e.Uint32("Protocol", n.ProtocolVersion).
+		Str("PeerVersion", n.PeerVersion).
+		Strs("Compression", n.CompressionCodecs).
+		Str("Hash", n.HashAlgorithm).
+		Uint32("MaxChunkSize", n.MaxChunkSize).
+		Strs("Features", n.Features)
+}
+
+// firstShared returns the first of preferred that is also in supported
+func firstShared(preferred, supported []string) (string, bool) {
+	for _, value := range preferred {
+		if contains(supported, value) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// shared returns the values of preferred that are also in supported, in the same order
+func shared(preferred, supported []string) []string {
+	values := make([]string, 0)
+	for _, value := range preferred {
+		if contains(supported, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Capabilities) toGrpc() *pb.Capabilities {
+	return &pb.Capabilities{
+		ProtocolVersion:    c.ProtocolVersion,
+		MinProtocolVersion: c.MinProtocolVersion,
+		SoftwareVersion:    c.SoftwareVersion,
+		CompressionCodecs:  c.CompressionCodecs,
+		HashAlgorithms:     c.HashAlgorithms,
+		MaxChunkSize:       c.MaxChunkSize,
+		Features:           c.Features,
+	}
+}
+
+func capabilitiesFromGrpc(c *pb.Capabilities) Capabilities {
+	return Capabilities{
+		ProtocolVersion:    c.GetProtocolVersion(),
+		MinProtocolVersion: c.GetMinProtocolVersion(),
+		SoftwareVersion:    c.GetSoftwareVersion(),
+		CompressionCodecs:  c.GetCompressionCodecs(),
+		HashAlgorithms:     c.GetHashAlgorithms(),
+		MaxChunkSize:       c.GetMaxChunkSize(),
+		Features:           c.GetFeatures(),
+	}
+}
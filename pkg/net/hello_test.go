@@ -0,0 +1,64 @@
+package net
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := DefaultCapabilities(FeaturePairing)
+	remote := Capabilities{
+		ProtocolVersion:    5,
+		MinProtocolVersion: 1,
+		SoftwareVersion:    "9.0",
+		CompressionCodecs:  []string{"lz4", CompressionNone, CompressionGzip},
+		HashAlgorithms:     []string{"blake3", HashAlgorithmSHA256},
+		MaxChunkSize:       4096,
+		Features:           []string{"future", FeaturePairing},
+	}
+	negotiated, err := Negotiate(local, remote)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if negotiated.ProtocolVersion != ProtocolVersion || negotiated.PeerVersion != "9.0" {
+		t.Errorf("Expected the newest shared protocol version, got %+v", negotiated)
+	}
+	// The local preference wins among shared codecs
+	if negotiated.CompressionCodec != CompressionGzip || negotiated.HashAlgorithm != HashAlgorithmSHA256 {
+		t.Errorf("Unexpected codec or hash %+v", negotiated)
+	}
+	if len(negotiated.CompressionCodecs) != 2 || negotiated.CompressionCodecs[1] != CompressionNone {
+		t.Errorf("Expected every shared codec in local order, got %v", negotiated.CompressionCodecs)
+	}
+	if negotiated.MaxChunkSize != 4096 {
+		t.Errorf("Expected the smaller chunk size, got %d", negotiated.MaxChunkSize)
+	}
+	if !negotiated.HasFeature(FeaturePairing) || negotiated.HasFeature("future") {
+		t.Errorf("Expected only shared features, got %v", negotiated.Features)
+	}
+
+	remote.MaxChunkSize = 0
+	if negotiated, _ := Negotiate(local, remote); negotiated.MaxChunkSize != MaxChunkSize {
+		t.Errorf("Expected a peer without a limit to use the local limit, got %d", negotiated.MaxChunkSize)
+	}
+	remote.CompressionCodecs = local.CompressionCodecs
+	if negotiated, _ := Negotiate(local, remote); negotiated.CompressionCodec != CompressionZstd {
+		t.Errorf("Expected zstd to be preferred by peers that both support it, got %s", negotiated.CompressionCodec)
+	}
+}
+
+func TestNegotiateIncompatible(t *testing.T) {
+	local := DefaultCapabilities()
+	incompatible := map[string]Capabilities{
+		"older peer":      {ProtocolVersion: 1, MinProtocolVersion: 1, CompressionCodecs: local.CompressionCodecs, HashAlgorithms: local.HashAlgorithms},
+		"newer peer":      {ProtocolVersion: 9, MinProtocolVersion: 8, CompressionCodecs: local.CompressionCodecs, HashAlgorithms: local.HashAlgorithms},
+		"no shared codec": {ProtocolVersion: ProtocolVersion, MinProtocolVersion: 1, CompressionCodecs: []string{"lz4"}, HashAlgorithms: local.HashAlgorithms},
+		"no shared hash":  {ProtocolVersion: ProtocolVersion, MinProtocolVersion: 1, CompressionCodecs: local.CompressionCodecs, HashAlgorithms: []string{"md5"}},
+	}
+	for name, remote := range incompatible {
+		if _, err := Negotiate(local, remote); !errors.Is(err, ErrIncompatiblePeer) {
+			t.Errorf("Expected %s to be incompatible, got %v", name, err)
+		}
+	}
+}
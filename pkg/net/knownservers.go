@@ -0,0 +1,214 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+// KnownServersFileName is the name of the known servers store in the client config directory
+const KnownServersFileName string = "known_servers"
+
+// ErrCertificateChanged is returned when a server presents a certificate that does not match the pin for it
+var ErrCertificateChanged = errors.New("server certificate does not match the pinned certificate")
+
+// KnownServer is a pinned server certificate, or the CA that signs it
+type KnownServer struct {
+	Address     string
+	Fingerprint string
+}
+
+// KnownServers is a trust on first use store of server certificate fingerprints. Like ssh known_hosts, each line of the
+// file holds a server address and the fingerprint of the certificate it presented the first time the client connected.
+// For a server that sends the CA its certificate is signed by, the CA is pinned instead, see crypto.PinFingerprint
+type KnownServers struct {
+	path string
+	sync.Mutex
+}
+
+// NewKnownServers opens the known servers store at path. The file is created when the first server is pinned
+func NewKnownServers(path string) *KnownServers {
+	return &KnownServers{path: path}
+}
+
+// List returns every pinned server sorted by address
+func (k *KnownServers) List() ([]KnownServer, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	pins, err := k.read()
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]KnownServer, 0, len(pins))
+	for address, fingerprint := range pins {
+		servers = append(servers, KnownServer{address, fingerprint})
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Address < servers[j].Address })
+	return servers, nil
+}
+
+// Add pins fingerprint for address, replacing any existing pin
+func (k *KnownServers) Add(address, fingerprint string) error {
+	k.Lock()
+	defer k.Unlock()
+
+	pins, err := k.read()
+	if err != nil {
+		return err
+	}
+	pins[address] = strings.ToLower(fingerprint)
+	return k.write(pins)
+}
+
+// Remove drops the pin for address. Returns false if the address was not pinned
+func (k *KnownServers) Remove(address string) (bool, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	pins, err := k.read()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := pins[address]; !ok {
+		return false, nil
+	}
+	delete(pins, address)
+	return true, k.write(pins)
+}
+
+// verifier returns a TLS peer verification function for address. A pinned server must present the pinned certificate
+// or a server certificate signed by the pinned CA. On first use the certificate must be trusted itself or be signed by
+// trusted if it is set, then it is pinned
+func (k *KnownServers) verifier(address, hostname string, trusted *x509.Certificate) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificate")
+		}
+		fingerprint := crypto.PinFingerprint(rawCerts)
+		k.Lock()
+		defer k.Unlock()
+
+		pins, err := k.read()
+		if err != nil {
+			return err
+		}
+		if pinned, ok := pins[address]; ok {
+			if !crypto.VerifyPin(rawCerts, pinned) {
+				log.Error().Str("Address", address).Str("Pinned", pinned).Str("Presented", fingerprint).Msg("Server certificate changed")
+				return fmt.Errorf("%w for %s: presented %s. Run torrxfer-client trust add %s to trust the new certificate",
+					ErrCertificateChanged, address, fingerprint, address)
+			}
+			// Servers pinned by their own certificate before they sent their CA move over to the CA pin
+			if pinned != fingerprint {
+				log.Info().Str("Address", address).Str("Fingerprint", fingerprint).Msg("Pinning the CA of the server certificate")
+				pins[address] = fingerprint
+				return k.write(pins)
+			}
+			return nil
+		}
+		if trusted != nil {
+			if err := verifyChain(rawCerts, hostname, trusted); err != nil {
+				return err
+			}
+		}
+		log.Warn().Str("Address", address).Str("Fingerprint", fingerprint).Msg("Trusting server certificate on first use")
+		pins[address] = fingerprint
+		return k.write(pins)
+	}
+}
+
+// verifyChain checks that the presented certificate is trusted or chains up to it
+func verifyChain(rawCerts [][]byte, hostname string, trusted *x509.Certificate) error {
+	// The configured certificate may be the server's own self signed certificate
+	if bytes.Equal(rawCerts[0], trusted.Raw) {
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(trusted)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{DNSName: hostname, Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+func (k *KnownServers) read() (map[string]string, error) {
+	pins := make(map[string]string)
+	file, err := os.Open(k.path)
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		pins[fields[0]] = strings.ToLower(fields[1])
+	}
+	return pins, scanner.Err()
+}
+
+// write replaces the store with pins. The file is swapped in with a rename so a crash never leaves it half written
+func (k *KnownServers) write(pins map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	addresses := make([]string, 0, len(pins))
+	for address := range pins {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	var text strings.Builder
+	for _, address := range addresses {
+		fmt.Fprintf(&text, "%s %s\n", address, pins[address])
+	}
+	tmpPath := k.path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(text.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, k.path)
+}
+
+// FetchServerFingerprint connects to a TLS server without verifying it and returns the fingerprint to pin for it
+func FetchServerFingerprint(address string) (string, error) {
+	conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("server presented no certificate")
+	}
+	chain := make([][]byte, 0, len(certs))
+	for _, cert := range certs {
+		chain = append(chain, cert.Raw)
+	}
+	return crypto.PinFingerprint(chain), nil
+}
@@ -0,0 +1,114 @@
+package net
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+func TestKnownServersTrustOnFirstUse(t *testing.T) {
+	dir, err := os.MkdirTemp("", "knownservers")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	knownServers := NewKnownServers(filepath.Join(dir, KnownServersFileName))
+	first := []byte("first certificate")
+	second := []byte("second certificate")
+
+	verify := knownServers.verifier("server:9650", "server", nil)
+	if err := verify([][]byte{first}, nil); err != nil {
+		t.Errorf("Expected first certificate to be trusted, got %v", err)
+		return
+	}
+	if err := verify([][]byte{first}, nil); err != nil {
+		t.Errorf("Expected pinned certificate to be trusted, got %v", err)
+	}
+	if err := verify([][]byte{second}, nil); !errors.Is(err, ErrCertificateChanged) {
+		t.Errorf("Expected changed certificate to be rejected, got %v", err)
+	}
+
+	// Pins survive reopening the store
+	servers, err := NewKnownServers(knownServers.path).List()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(servers) != 1 || servers[0].Address != "server:9650" || servers[0].Fingerprint != crypto.CertFingerprint(first) {
+		t.Errorf("Unexpected known servers %v", servers)
+	}
+
+	// Trusting the new certificate explicitly replaces the pin
+	if err := knownServers.Add("server:9650", crypto.CertFingerprint(second)); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := verify([][]byte{second}, nil); err != nil {
+		t.Errorf("Expected re-trusted certificate to be accepted, got %v", err)
+	}
+	if removed, err := knownServers.Remove("server:9650"); !removed || err != nil {
+		t.Errorf("Expected pin to be removed, got %v %v", removed, err)
+	}
+	if removed, _ := knownServers.Remove("server:9650"); removed {
+		t.Errorf("Removed a server that was not pinned")
+	}
+}
+
+func TestKnownServersRotation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "knownservers")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ca, err := crypto.InitCA(filepath.Join(dir, "certs"), "test CA")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	issue := func() [][]byte {
+		certPEM, keyPEM, err := ca.IssueServer([]string{"server"}, time.Hour)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return cert.Certificate
+	}
+	first, rotated := issue(), issue()
+	if first == nil || rotated == nil {
+		return
+	}
+
+	// A server pinned by its certificate is moved over to its CA, and can then rotate its certificate
+	knownServers := NewKnownServers(filepath.Join(dir, KnownServersFileName))
+	if err := knownServers.Add("server:9650", crypto.CertFingerprint(first[0])); err != nil {
+		t.Error(err)
+		return
+	}
+	verify := knownServers.verifier("server:9650", "server", nil)
+	if err := verify(first, nil); err != nil {
+		t.Errorf("Expected pinned certificate to be trusted, got %v", err)
+		return
+	}
+	servers, err := knownServers.List()
+	if err != nil || len(servers) != 1 || servers[0].Fingerprint != crypto.CertFingerprint(ca.Cert.Raw) {
+		t.Errorf("Expected the CA to be pinned, got %v %v", servers, err)
+	}
+	if err := verify(rotated, nil); err != nil {
+		t.Errorf("Expected rotated certificate signed by the pinned CA to be trusted, got %v", err)
+	}
+	if err := verify(rotated[:1], nil); !errors.Is(err, ErrCertificateChanged) {
+		t.Errorf("Expected rotated certificate without its CA to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	pb "github.com/sushshring/torrxfer/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// pairMethod is the full gRPC name of Pair. Clients call it before they hold a credential
+	pairMethod string = "/RpcTorrxferServer/Pair"
+	// pairTimeout bounds how long the client waits to reach the server when pairing
+	pairTimeout time.Duration = 30 * time.Second
+)
+
+var errPairRequest = status.Errorf(codes.Internal, "internal error on pair")
+
+// PairingRequest is what a client presents to pair with the server
+type PairingRequest struct {
+	// Proof is made with the pairing code over the fingerprint pinned for the server. See crypto.PairingProof
+	Proof []byte
+	// CertificateRequest is a PEM certificate signing request for the client key
+	CertificateRequest []byte
+}
+
+// PairingCredential is what a paired client authenticates with. Either Token or Certificate is set
+type PairingCredential struct {
+	Identity      string
+	Token         string
+	Certificate   []byte
+	CACertificate []byte
+	// Fingerprint is the fingerprint the client pins for the server. See crypto.PinFingerprint
+	Fingerprint string
+	// Proof is made by the server with the pairing code over Fingerprint
+	Proof []byte
+}
+
+func (c PairingCredential) toGrpc() *pb.PairResponse {
+	return &pb.PairResponse{
+		Identity:      c.Identity,
+		Token:         c.Token,
+		Certificate:   c.Certificate,
+		CaCertificate: c.CACertificate,
+		Fingerprint:   c.Fingerprint,
+		Proof:         c.Proof,
+	}
+}
+
+// Pair wrapper around gRPC Pair. Called by gRPC, should not be called directly
+func (s *RPCTorrxferServer) Pair(ctx context.Context, request *pb.PairRequest) (*pb.PairResponse, error) {
+	// The credential must never be sent in the clear
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, errPairRequest
+	}
+	if _, ok := p.AuthInfo.(credentials.TLSInfo); !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "pairing requires TLS")
+	}
+	credential, err := s.server.PairFunction(PairingRequest{
+		Proof:              request.GetProof(),
+		CertificateRequest: request.GetCertificateRequest(),
+	})
+	if err != nil {
+		log.Info().Err(err).Str("Peer", p.Addr.String()).Msg("Pairing failed")
+		return nil, rpcError(err, errPairRequest)
+	}
+	log.Info().Str("Peer", p.Addr.String()).Str("Identity", credential.Identity).Msg("Paired client")
+	return credential.toGrpc(), nil
+}
+
+// Pair exchanges a pairing code for a client credential with the TLS server at address. The server certificate is not
+// trusted beforehand. Instead the server has to prove it knows the code for the certificate it presented
+func Pair(address, code string, certificateRequest []byte) (PairingCredential, error) {
+	var fingerprint string
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			fingerprint = crypto.PinFingerprint(rawCerts)
+			return nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pairTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), grpc.WithBlock())
+	if err != nil {
+		log.Debug().Err(err).Msg("Could not grpc dial")
+		return PairingCredential{}, err
+	}
+	defer conn.Close()
+	response, err := pb.NewRpcTorrxferServerClient(conn).Pair(ctx, &pb.PairRequest{
+		Proof:              crypto.PairingProof(code, crypto.PairingRoleClient, fingerprint),
+		CertificateRequest: certificateRequest,
+	})
+	if err != nil {
+		return PairingCredential{}, err
+	}
+	if response.GetFingerprint() != fingerprint ||
+		!crypto.CheckPairingProof(response.GetProof(), code, crypto.PairingRoleServer, fingerprint) {
+		return PairingCredential{}, errors.New("server could not prove it knows the pairing code")
+	}
+	return PairingCredential{
+		Identity:      response.GetIdentity(),
+		Token:         response.GetToken(),
+		Certificate:   response.GetCertificate(),
+		CACertificate: response.GetCaCertificate(),
+		Fingerprint:   fingerprint,
+		Proof:         response.GetProof(),
+	}, nil
+}
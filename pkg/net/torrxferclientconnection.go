@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sushshring/torrxfer/pkg/common"
 	pb "github.com/sushshring/torrxfer/rpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -17,14 +19,34 @@ var (
 	errMissingMetadata = status.Errorf(codes.InvalidArgument, "missing metadata")
 	errTransferRequest = status.Errorf(codes.Internal, "internal error on transfer")
 	errQueryRequest    = status.Errorf(codes.Internal, "internal error on query")
+	errHelloRequest    = status.Errorf(codes.Internal, "internal error on hello")
 )
 
+// ClientInfo identifies the client making a request
+type ClientInfo struct {
+	// ID identifies a single transfer job of the client
+	ID string
+	// Identity is the authenticated identity of the client. Empty if the connection is not authenticated
+	Identity string
+	// Peer is the network address the request came from
+	Peer string
+}
+
 // ITorrxferServer Server interface representation for client
 type ITorrxferServer interface {
-	QueryFunction(clientID string, file *RPCFile) (*RPCFile, error)
-	TransferFunction(clientID string, fileBytes []byte, blockSize uint32, currentOffset uint64) error
-	RegisterForWriteNotification(clientID string) (chan error, chan struct{})
-	Close(clientID string)
+	// HelloFunction checks that the server can work with a client with capabilities. Returns the server's capabilities
+	HelloFunction(client ClientInfo, capabilities Capabilities) (Capabilities, error)
+	QueryFunction(client ClientInfo, file *RPCFile) (*RPCFile, error)
+	// TransferFunction writes a chunk of the active file of client. A ChunkRejection error leaves the transfer going,
+	// so the client can send the chunk again
+	TransferFunction(client ClientInfo, fileBytes []byte, blockSize uint32, currentOffset uint64, checksum uint32) error
+	// RegisterForWriteNotification returns the channels the outcome of the transfer of the active file of clientID is
+	// sent on, and the channel acknowledgements are sent on while it is in progress
+	RegisterForWriteNotification(clientID string) (chan error, chan TransferSummary, chan TransferAck)
+	// Close ends the transfer of the active file of clientID. err is why the stream ended early, nil if the client
+	// finished sending
+	Close(clientID string, err error)
+	PairFunction(request PairingRequest) (PairingCredential, error)
 }
 
 // RPCTorrxferServer wrapper around grpc server
@@ -42,77 +64,145 @@ func NewRPCTorrxferServer(torrxferServer ITorrxferServer) (server *RPCTorrxferSe
 	return
 }
 
-func (s *RPCTorrxferServer) validateIncomingRequest(ctx context.Context) (clientID string, err error) {
+func (s *RPCTorrxferServer) validateIncomingRequest(ctx context.Context) (client ClientInfo, err error) {
 	log.Debug().Msg("Validating incoming request")
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
 		err := errors.New("failed to get file metadata. Invalid argument")
 		log.Debug().Err(err).Msg("")
-		return "", errMissingMetadata
+		return ClientInfo{}, errMissingMetadata
 	}
 	clientIds, ok := md["clientdata"]
 	if !ok {
 		err := errors.New("client data not provided in request")
 		log.Debug().Err(err).Msg("")
-		return "", errMissingMetadata
+		return ClientInfo{}, errMissingMetadata
+	}
+	client = ClientInfo{ID: clientIds[0], Identity: clientIdentity(ctx)}
+	if p, ok := peer.FromContext(ctx); ok {
+		client.Peer = p.Addr.String()
 	}
-	clientID = clientIds[0]
 	err = nil
-	log.Debug().Str("Client ID", clientID).Msg("Processing request")
+	log.Debug().Str("Client ID", client.ID).Str("Identity", client.Identity).Msg("Processing request")
 
 	return
 }
 
 // TransferFile wrapper around gRPC TransferFile. Called by gRPC, should not be called directly
 func (s *RPCTorrxferServer) TransferFile(stream pb.RpcTorrxferServer_TransferFileServer) error {
-	clientID, err := s.validateIncomingRequest(stream.Context())
+	client, err := s.validateIncomingRequest(stream.Context())
 	if err != nil {
 		return err
 	}
-	defer s.server.Close(clientID)
-	errorChan, doneChan := s.server.RegisterForWriteNotification(clientID)
+	defer s.server.Close(client.ID, nil)
+	errorChan, doneChan, ackChan := s.server.RegisterForWriteNotification(client.ID)
+	if errorChan == nil || doneChan == nil {
+		log.Debug().Str("Client ID", client.ID).Msg("No file active for client")
+		return errTransferRequest
+	}
+	// Acknowledgements and rejected chunks are sent while chunks are received. The stream only has one sender at a
+	// time, so they stop before the summary is sent
+	stopAcks := make(chan struct{})
+	acksStopped := make(chan struct{})
+	rejections := make(chan ChunkRejection)
+	go func() {
+		defer close(acksStopped)
+		for {
+			var response *pb.TransferFileResponse
+			select {
+			case <-stopAcks:
+				return
+			case ack := <-ackChan:
+				response = ack.toGrpc()
+			case rejection := <-rejections:
+				response = rejection.toGrpc()
+			}
+			if err := stream.Send(response); err != nil {
+				log.Debug().Err(err).Str("Client ID", client.ID).Msg("Could not acknowledge transfer")
+				return
+			}
+		}
+	}()
+	var stopOnce sync.Once
+	stopAcking := func() {
+		stopOnce.Do(func() { close(stopAcks) })
+		<-acksStopped
+	}
+	defer stopAcking()
 	for {
 		fileReq, err := stream.Recv()
 		if err == io.EOF {
-			// Finished receiving file
+			// Finished receiving file. Wait for the server to flush and verify it before replying
 			log.Debug().Msg("File finished")
-			return nil
+			s.server.Close(client.ID, nil)
+			stopAcking()
+			select {
+			case err := <-errorChan:
+				log.Info().Err(err).Msg("Error while writing")
+				return errTransferRequest
+			case summary := <-doneChan:
+				return stream.Send(&pb.TransferFileResponse{
+					CommittedOffset: summary.SizeOnDisk,
+					Summary:         summary.toGrpc(),
+				})
+			}
 		} else if err != nil {
 			common.LogErrorStack(err, "Error receiving transfer request")
+			s.server.Close(client.ID, err)
 			return errTransferRequest
 		}
-		log.Trace().Bytes("File data", fileReq.Data).Str("Client ID", clientID).Msg("Received transfer file data")
-		err = s.server.TransferFunction(clientID, fileReq.GetData(), fileReq.GetSize(), fileReq.GetOffset())
+		log.Trace().Bytes("File data", fileReq.Data).Str("Client ID", client.ID).Msg("Received transfer file data")
+		err = s.server.TransferFunction(client, fileReq.GetData(), fileReq.GetSize(), fileReq.GetOffset(), fileReq.GetChecksum())
+		var rejection ChunkRejection
+		if errors.As(err, &rejection) {
+			log.Debug().Err(rejection).Str("Client ID", client.ID).Msg("Rejected file data")
+			select {
+			case rejections <- rejection:
+				continue
+			case <-acksStopped:
+				return errTransferRequest
+			}
+		}
 		if err != nil {
 			common.LogErrorStack(err, "Failed to write file data")
-			return errTransferRequest
+			return rpcError(err, errTransferRequest)
 		}
+	}
+}
 
-		select {
-		case err := <-errorChan:
-			log.Info().Err(err).Msg("Error while writing")
-			return errTransferRequest
-		case <-doneChan:
-			log.Info().Msg("File transfer finished")
-			return nil
-		default:
-			// no-op
-		}
+// rpcError passes gRPC status errors raised by the server implementation through to the client and masks any other error
+func rpcError(err error, fallback error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return fallback
+}
+
+// Hello wrapper around gRPC Hello. Called by gRPC, should not be called directly
+func (s *RPCTorrxferServer) Hello(ctx context.Context, capabilities *pb.Capabilities) (*pb.Capabilities, error) {
+	client, err := s.validateIncomingRequest(ctx)
+	if err != nil {
+		return nil, err
 	}
+	serverCapabilities, err := s.server.HelloFunction(client, capabilitiesFromGrpc(capabilities))
+	if err != nil {
+		return nil, rpcError(err, errHelloRequest)
+	}
+	return serverCapabilities.toGrpc(), nil
 }
 
 // QueryFile wrapper around gRPC query file. Called by gRPC, should not be called directly
 func (s *RPCTorrxferServer) QueryFile(ctx context.Context, file *pb.File) (*pb.File, error) {
 	log.Info().Str("File name", file.Name).Msg("Received file transfer request")
-	clientID, err := s.validateIncomingRequest(ctx)
+	client, err := s.validateIncomingRequest(ctx)
 	if err != nil {
 		return nil, errQueryRequest
 	}
 	rpcFile := NewFileFromGrpc(file)
-	rpcFile, err = s.server.QueryFunction(clientID, rpcFile)
+	rpcFile, err = s.server.QueryFunction(client, rpcFile)
 	if err != nil {
 		log.Debug().Err(err).Msg("Server query failed")
-		return nil, errQueryRequest
+		return nil, rpcError(err, errQueryRequest)
 	}
 	return rpcFile.file, nil
 }
@@ -2,9 +2,13 @@ package net
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -13,22 +17,42 @@ import (
 	"github.com/sushshring/torrxfer/pkg/crypto"
 	pb "github.com/sushshring/torrxfer/rpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/encoding/gzip"
 	_ "google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // TorrxferServerConnection represents a wrapper around the gRPC mechanisms to
 // talk to the torrxfer server
 type TorrxferServerConnection interface {
-	QueryFile(file string, mediaPrefix string, correlationUUID string) (*RPCFile, error)
-	TransferFile(fileBytes *io.PipeReader, blockSize uint32, offset uint64, correlationUUID string) (fileSummaryChan chan FileTransferNotification, err error)
+	QueryFile(file *RPCFile, correlationUUID string) (*RPCFile, error)
+	TransferFile(fileBytes *io.PipeReader, reopen RangeOpener, offset uint64, compression string, correlationUUID string) (fileSummaryChan chan FileTransferNotification, err error)
+	// CompressionFor returns the codec to transfer the file at name with. sample returns the start of its data, and is
+	// only called if the codec depends on it
+	CompressionFor(name string, sample func() []byte) string
+	// Negotiated returns the parameters agreed with the server when connecting
+	Negotiated() Negotiated
 }
 
+// RangeOpener opens the data of a file being transferred from offset, so chunks the server rejected can be read again
+type RangeOpener func(offset uint64) (io.ReadCloser, error)
+
+// maxChunkRetransmits is how many times a chunk is sent again after the server rejects it before the transfer fails
+const maxChunkRetransmits = 3
+
 type torrxferServerConnection struct {
-	cc   grpc.ClientConnInterface
-	uuid uuid.UUID
+	cc         grpc.ClientConnInterface
+	uuid       uuid.UUID
+	negotiated Negotiated
+	// rtt is how long the handshake with the server took
+	rtt time.Duration
+	// minChunkSize and maxChunkSize bound the chunks files are sent in
+	minChunkSize uint32
+	maxChunkSize uint32
+	// compression is the policy files are compressed with
+	compression string
 }
 
 // TransferNotificationType is an iota
@@ -37,7 +61,7 @@ type TransferNotificationType uint8
 const (
 	// TransferNotificationTypeError Error
 	TransferNotificationTypeError TransferNotificationType = iota
-	// TransferNotificationTypeBytes sent bytes
+	// TransferNotificationTypeBytes bytes acknowledged by the server
 	TransferNotificationTypeBytes
 	// TransferNotificationTypeClosed Closed connection
 	TransferNotificationTypeClosed
@@ -47,36 +71,82 @@ const (
 type FileTransferNotification struct {
 	NotificationType TransferNotificationType
 	Filepath         string
-	LastTransferred  uint64
-	CurrentOffset    uint64
-	Error            error
+	// LastTransferred is how many more bytes the server has acknowledged since the last notification
+	LastTransferred uint64
+	// CurrentOffset is how much of the file the server has acknowledged as written
+	CurrentOffset uint64
+	Error         error
+	// Summary is the server's view of the file. Only set for TransferNotificationTypeClosed
+	Summary *TransferSummary
+	// Compression counts what was sent before and after compression. Only set once the transfer ends
+	Compression CompressionStats
 }
 
-// NewTorrxferServerConnection constructs a new server connection given server config
-func NewTorrxferServerConnection(server common.ServerConnectionConfig) (TorrxferServerConnection, error) {
+// NewTorrxferServerConnection constructs a new server connection given server config. TLS servers must present the
+// certificate pinned for them in knownServers, and are pinned on first use. Without knownServers the server certificate
+// must verify against CertFile or the system roots
+func NewTorrxferServerConnection(server common.ServerConnectionConfig, knownServers *KnownServers) (TorrxferServerConnection, error) {
 	if server.Address == "" {
 		err := errors.New("No server address provided")
 		common.LogError(err, "")
 		return nil, err
 	}
 	address := fmt.Sprintf("%s:%d", server.Address, server.Port)
+	compression, err := ParseCompression(server.Compression)
+	if err != nil {
+		common.LogError(err, "")
+		return nil, err
+	}
 	var opts []grpc.DialOption
-	if server.UseTLS {
-		certPool := x509.NewCertPool()
-		valid, cert, _ := crypto.VerifyCert(server.CertFile, server.Address)
-		if !valid {
-			log.Debug().Msg("Cert could not be validted. Continuing anyway for now")
+	if server.PSK != "" || server.PSKFile != "" {
+		tlsConfig, err := pskTLSConfig(server)
+		if err != nil {
+			common.LogError(err, "Could not set up pre-shared key")
+			return nil, err
 		}
-		if cert != nil {
-			certPool.AddCert(cert)
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else if server.UseTLS {
+		var cert *x509.Certificate
+		if server.CertFile != "" {
+			// A self signed server certificate does not verify on its own but can still be trusted explicitly
+			_, cert, _ = crypto.VerifyCert(server.CertFile, server.Address)
+			if cert == nil {
+				err := fmt.Errorf("could not read server certificate %s", server.CertFile)
+				common.LogError(err, "")
+				return nil, err
+			}
 		}
-
-		creds := credentials.NewClientTLSFromCert(certPool, server.Address)
-		opts = append(opts, grpc.WithTransportCredentials(creds))
+		tlsConfig := &tls.Config{ServerName: server.Address}
+		if knownServers != nil {
+			// Verification is done against the pinned certificate instead
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = knownServers.verifier(address, server.Address, cert)
+		} else if cert != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AddCert(cert)
+		}
+		if server.ClientCertFile != "" {
+			clientCert, err := tls.LoadX509KeyPair(server.ClientCertFile, server.ClientKeyFile)
+			if err != nil {
+				common.LogError(err, "Could not load client certificate")
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{clientCert}
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
-	opts = append(opts, grpc.WithBlock(), grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	// Tokens are only sent over a secure transport
+	if server.OAuthFile != "" && (server.UseTLS || server.PSK != "" || server.PSKFile != "") {
+		token, err := os.ReadFile(server.OAuthFile)
+		if err != nil {
+			common.LogError(err, "Could not read token file")
+			return nil, err
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(NewTokenCredentials(strings.TrimSpace(string(token)))))
+	}
+	opts = append(opts, grpc.WithBlock(), grpc.WithStatsHandler(compressionStatsHandler{}))
 	grpc.EnableTracing = true
 	conn, err := grpc.Dial(address, opts...)
 	if err != nil {
@@ -84,27 +154,62 @@ func NewTorrxferServerConnection(server common.ServerConnectionConfig) (Torrxfer
 		return nil, err
 	}
 	log.Debug().Msg("Connected!")
-	serverConnection := &torrxferServerConnection{conn, uuid.New()}
+	serverConnection := &torrxferServerConnection{
+		cc:           conn,
+		uuid:         uuid.New(),
+		minChunkSize: uint32(server.MinChunkSize),
+		maxChunkSize: uint32(server.MaxChunkSize),
+		compression:  compression,
+	}
+	if err := serverConnection.hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Chunks must fit within what the server accepts
+	if negotiated := serverConnection.negotiated.MaxChunkSize; negotiated > 0 && (serverConnection.maxChunkSize == 0 || serverConnection.maxChunkSize > negotiated) {
+		serverConnection.maxChunkSize = negotiated
+	}
 	return serverConnection, nil
 }
 
-// QueryFile makes a gRPC call to the provided server and either returns a file summary or FileNotFoundException
-func (client *torrxferServerConnection) QueryFile(filePath string, mediaPrefix string, correlationUUID string) (*RPCFile, error) {
-	log.Trace().Msg("Starting Query File")
-	file, err := NewFile(filePath)
-	log.Trace().Str("Hash", file.file.DataHash).Msg("File hash")
-	if err := file.SetMediaPath(mediaPrefix); err != nil {
-		common.LogError(err, "Could not set media prefix")
-		return nil, err
+// hello exchanges capabilities with the server and records what both support
+func (client *torrxferServerConnection) hello() error {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "clientdata", client.uuid.String())
+	local := DefaultCapabilities(FeaturePairing)
+	started := time.Now()
+	remote, err := pb.NewRpcTorrxferServerClient(client.cc).Hello(ctx, local.toGrpc())
+	client.rtt = time.Since(started)
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("%w: the server predates protocol version %d and cannot negotiate it. Upgrade the server", ErrIncompatiblePeer, MinProtocolVersion)
 	}
-	ctx := context.Background()
-	ctx = metadata.AppendToOutgoingContext(ctx, "clientdata", correlationUUID)
 	if err != nil {
-		common.LogError(err, "Could not create file")
-		return nil, err
+		log.Debug().Err(err).Msg("Server refused hello")
+		return err
 	}
+	client.negotiated, err = Negotiate(local, capabilitiesFromGrpc(remote))
+	if err != nil {
+		return err
+	}
+	log.Info().Object("Negotiated", client.negotiated).Dur("RTT", client.rtt).Msg("Connected to server")
+	return nil
+}
+
+// Negotiated returns the parameters agreed with the server when connecting
+func (client *torrxferServerConnection) Negotiated() Negotiated {
+	return client.negotiated
+}
+
+// CompressionFor returns the codec to transfer the file at name with under the compression policy for the server
+func (client *torrxferServerConnection) CompressionFor(name string, sample func() []byte) string {
+	return client.negotiated.CompressionFor(client.compression, name, sample)
+}
+
+// QueryFile makes a gRPC call to the provided server and either returns a file summary or FileNotFoundException
+func (client *torrxferServerConnection) QueryFile(file *RPCFile, correlationUUID string) (*RPCFile, error) {
+	log.Trace().Str("Hash", file.file.DataHash).Msg("Starting Query File")
+	ctx := context.Background()
+	ctx = metadata.AppendToOutgoingContext(ctx, "clientdata", correlationUUID)
 	conn := pb.NewRpcTorrxferServerClient(client.cc)
-	log.Trace().Msg("Starting query")
 	fileSummary, err := conn.QueryFile(ctx, file.file)
 	if err != nil {
 		return nil, err
@@ -112,15 +217,23 @@ func (client *torrxferServerConnection) QueryFile(filePath string, mediaPrefix s
 	return NewFileFromGrpc(fileSummary), nil
 }
 
-// TransferFile makes a gRPC call to the provided server and transfer the file data as a stream
-func (client *torrxferServerConnection) TransferFile(fileBytes *io.PipeReader, blockSize uint32, offset uint64, correlationUUID string) (fileSummaryChan chan FileTransferNotification, err error) {
+// TransferFile makes a gRPC call to the provided server and transfer the file data as a stream. Progress is reported as
+// the server acknowledges the data it has written, and sending is held back while the server asks the client to slow down.
+// The data is compressed with the compression codec. Chunks the server rejects are read again with reopen and resent
+func (client *torrxferServerConnection) TransferFile(fileBytes *io.PipeReader, reopen RangeOpener, offset uint64, compression string, correlationUUID string) (fileSummaryChan chan FileTransferNotification, err error) {
 	conn := pb.NewRpcTorrxferServerClient(client.cc)
 	fileSummaryChan = make(chan FileTransferNotification)
 
-	go func(blockSize uint32, startingOffset uint64) {
-		ctx := context.Background()
+	go func(startingOffset uint64) {
+		defer close(fileSummaryChan)
+		defer fileBytes.Close()
+		// Cancelling the context tears down the stream if the transfer is abandoned midway
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 		ctx = metadata.AppendToOutgoingContext(ctx, "clientdata", correlationUUID)
-		stream, err := conn.TransferFile(ctx)
+		counter := &compressionCounter{codec: compression}
+		ctx = withCompressionCounter(ctx, counter)
+		stream, err := conn.TransferFile(ctx, grpc.UseCompressor(compression))
 		if err != nil {
 			log.Debug().Err(err).Msg("Could not start transferring the file")
 			fileSummaryChan <- FileTransferNotification{
@@ -131,59 +244,185 @@ func (client *torrxferServerConnection) TransferFile(fileBytes *io.PipeReader, b
 			}
 			return
 		}
-		defer close(fileSummaryChan)
-		defer stream.CloseAndRecv()
-		defer fileBytes.Close()
-		currentOffset := startingOffset
-		bytes := make([]byte, blockSize)
+		flow := newTransferFlow(startingOffset)
+		sendErrors := make(chan error, 1)
+		go func() {
+			sizer := newChunkSizer(client.minChunkSize, client.maxChunkSize, client.rtt)
+			if err := sendFileData(stream, fileBytes, reopen, sizer, startingOffset, flow); err != nil {
+				// The error is ready before the stream is torn down, so the receiver reports it instead of the cancellation
+				sendErrors <- err
+				cancel()
+			}
+		}()
+
 		for {
-			n, err := fileBytes.Read(bytes)
+			response, err := stream.Recv()
 			if err != nil {
-				if err == io.EOF {
-					log.Trace().Msg("Finished reading")
-					break
+				select {
+				case sendErr := <-sendErrors:
+					err = sendErr
+				default:
 				}
-				log.Debug().Err(err).Msg("Failure while reading")
+				log.Debug().Err(err).Msg("Server failed to complete the transfer")
+				flow.stop(err)
 				fileSummaryChan <- FileTransferNotification{
 					NotificationType: TransferNotificationTypeError,
 					LastTransferred:  0,
-					CurrentOffset:    currentOffset,
+					CurrentOffset:    flow.offset(),
 					Error:            err,
+					Compression:      counter.stats(),
 				}
 				return
 			}
-			log.Trace().Int("size", n).Bytes("data", bytes).Msg("Sending file bytes")
-			internalErr := stream.Send(&pb.TransferFileRequest{
-				Data:   bytes[:n],
-				Size:   uint32(n),
-				Offset: currentOffset,
-			})
-			if internalErr != nil {
-				log.Debug().Err(err).Msg("Error transmitting file data")
+			if rejected := response.GetRejected(); rejected != nil {
+				rejection := ChunkRejection{Offset: rejected.GetOffset(), Size: rejected.GetSize(), Reason: rejected.GetReason()}
+				log.Debug().Err(rejection).Msg("Server rejected a chunk. Sending it again")
+				flow.reject(rejection)
+				continue
+			}
+			if advanced := flow.acknowledge(response.GetCommittedOffset(), response.GetWindow()); advanced > 0 {
 				fileSummaryChan <- FileTransferNotification{
-					NotificationType: TransferNotificationTypeError,
+					NotificationType: TransferNotificationTypeBytes,
+					LastTransferred:  advanced,
+					CurrentOffset:    flow.offset(),
+					Error:            nil,
+				}
+			}
+			// The server replies with the summary once it has flushed and verified the file
+			if summary := response.GetSummary(); summary != nil {
+				fileSummaryChan <- FileTransferNotification{
+					NotificationType: TransferNotificationTypeClosed,
 					LastTransferred:  0,
-					CurrentOffset:    currentOffset,
-					Error:            internalErr,
+					CurrentOffset:    flow.offset(),
+					Error:            nil,
+					Summary: &TransferSummary{
+						BytesWritten: summary.GetBytesWritten(),
+						SizeOnDisk:   summary.GetSizeOnDisk(),
+						DataHash:     summary.GetDataHash(),
+					},
+					Compression: counter.stats(),
 				}
 				return
 			}
+		}
+	}(offset)
+	return
+}
 
-			// Send file transmit notification
-			currentOffset += uint64(n)
-			fileSummaryChan <- FileTransferNotification{
-				NotificationType: TransferNotificationTypeBytes,
-				LastTransferred:  uint64(n),
-				CurrentOffset:    currentOffset,
-				Error:            nil,
+// sendFileData sends the data read from fileBytes to the server in chunks sized by sizer, starting at offset, as fast as
+// flow allows. Chunks the server rejects are sent again from reopen
+func sendFileData(stream pb.RpcTorrxferServer_TransferFileClient, fileBytes io.Reader, reopen RangeOpener, sizer *chunkSizer, offset uint64, flow *transferFlow) error {
+	err := sendFileChunks(stream, fileBytes, reopen, sizer, offset, flow)
+	if err == io.EOF {
+		// The server ended the stream. Its reason is received by the caller
+		return nil
+	}
+	return err
+}
+
+func sendFileChunks(stream pb.RpcTorrxferServer_TransferFileClient, fileBytes io.Reader, reopen RangeOpener, sizer *chunkSizer, offset uint64, flow *transferFlow) error {
+	currentOffset := offset
+	// The request is marshalled before Send returns, so one buffer serves every chunk
+	buffer := getChunkBuffer(sizer.max)
+	defer putChunkBuffer(buffer)
+	retransmits := make(map[uint64]int)
+	// whenSent waits for wait to return, sending the chunks the server rejected meanwhile again
+	whenSent := func(wait func() error) error {
+		err := wait()
+		for err == errChunksRejected {
+			for _, rejection := range flow.takeRejections() {
+				if retransmits[rejection.Offset]++; retransmits[rejection.Offset] > maxChunkRetransmits {
+					return fmt.Errorf("giving up after sending a chunk %d times: %w", maxChunkRetransmits+1, rejection)
+				}
+				if err := resendChunk(stream, reopen, rejection); err != nil {
+					return err
+				}
+			}
+			err = wait()
+		}
+		return err
+	}
+	lastSent := time.Now()
+	for {
+		// The data arrives through a pipe in writes of any size, so chunks are filled before they are sent
+		n, err := io.ReadFull(fileBytes, (*buffer)[:sizer.next()])
+		if err == io.EOF {
+			log.Trace().Msg("Finished reading")
+			if err := whenSent(flow.settle); err != nil {
+				return err
 			}
+			return stream.CloseSend()
 		}
-		fileSummaryChan <- FileTransferNotification{
-			NotificationType: TransferNotificationTypeClosed,
-			LastTransferred:  0,
-			CurrentOffset:    currentOffset,
-			Error:            nil,
+		if err != nil && err != io.ErrUnexpectedEOF {
+			log.Debug().Err(err).Msg("Failure while reading")
+			return err
 		}
-	}(blockSize, offset)
-	return
+		if err := whenSent(func() error { return flow.reserve(uint64(n)) }); err != nil {
+			return err
+		}
+		log.Trace().Int("size", n).Uint64("offset", currentOffset).Msg("Sending file bytes")
+		if err := sendChunk(stream, (*buffer)[:n], currentOffset); err != nil {
+			return err
+		}
+		currentOffset += uint64(n)
+		now := time.Now()
+		sizer.observe(n, now.Sub(lastSent))
+		lastSent = now
+	}
+}
+
+// sendChunk sends data to the server as the chunk of the file at offset
+func sendChunk(stream pb.RpcTorrxferServer_TransferFileClient, data []byte, offset uint64) error {
+	err := stream.Send(&pb.TransferFileRequest{
+		Data:     data,
+		Size:     uint32(len(data)),
+		Offset:   offset,
+		Checksum: ChunkChecksum(data),
+	})
+	if err != nil && err != io.EOF {
+		log.Debug().Err(err).Msg("Error transmitting file data")
+	}
+	return err
+}
+
+// resendChunk reads the chunk the server rejected from reopen and sends it again
+func resendChunk(stream pb.RpcTorrxferServer_TransferFileClient, reopen RangeOpener, rejection ChunkRejection) error {
+	if reopen == nil {
+		return rejection
+	}
+	data, err := reopen(rejection.Offset)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	buffer := getChunkBuffer(rejection.Size)
+	defer putChunkBuffer(buffer)
+	chunk := (*buffer)[:rejection.Size]
+	if _, err := io.ReadFull(data, chunk); err != nil {
+		return fmt.Errorf("could not read rejected chunk at offset %d again: %w", rejection.Offset, err)
+	}
+	log.Trace().Uint32("size", rejection.Size).Uint64("offset", rejection.Offset).Msg("Sending rejected chunk again")
+	return sendChunk(stream, chunk, rejection.Offset)
+}
+
+// pskTLSConfig returns the TLS configuration for a server secured with a pre-shared key
+func pskTLSConfig(server common.ServerConnectionConfig) (*tls.Config, error) {
+	if server.UseTLS {
+		return nil, errors.New("pre-shared key can not be used with TLS certificates")
+	}
+	if server.PSK != "" && server.PSKFile != "" {
+		return nil, errors.New("only one of PSK and PSKFile can be set")
+	}
+	passphrase := server.PSK
+	if server.PSKFile != "" {
+		var err error
+		if passphrase, err = crypto.ReadPSK(server.PSKFile); err != nil {
+			return nil, err
+		}
+	}
+	identity, err := crypto.DerivePSKIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return identity.TLSConfig(), nil
 }
@@ -0,0 +1,86 @@
+package net
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	pb "github.com/sushshring/torrxfer/rpc"
+)
+
+// corruptingStream stands in for the server end of a transfer. It rejects the first chunk sent at corruptOffset as
+// if it was corrupted in transit, and acknowledges the rest as they complete the file
+type corruptingStream struct {
+	pb.RpcTorrxferServer_TransferFileClient
+	flow          *transferFlow
+	corruptOffset uint64
+	corrupted     bool
+	received      []byte
+	sent          map[uint64]int
+	closed        bool
+}
+
+func (s *corruptingStream) Send(request *pb.TransferFileRequest) error {
+	s.sent[request.GetOffset()]++
+	if ChunkChecksum(request.GetData()) != request.GetChecksum() {
+		s.flow.stop(io.ErrUnexpectedEOF)
+		return io.ErrUnexpectedEOF
+	}
+	if request.GetOffset() == s.corruptOffset && !s.corrupted {
+		s.corrupted = true
+		s.flow.reject(ChunkRejection{Offset: request.GetOffset(), Size: request.GetSize(), Reason: "checksum"})
+		return nil
+	}
+	copy(s.received[request.GetOffset():], request.GetData())
+	if !s.corrupted || s.sent[s.corruptOffset] > 1 {
+		s.flow.acknowledge(request.GetOffset()+uint64(request.GetSize()), 0)
+	}
+	return nil
+}
+
+func (s *corruptingStream) CloseSend() error {
+	s.closed = true
+	return nil
+}
+
+func TestSendFileDataRetransmits(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	flow := newTransferFlow(0)
+	stream := &corruptingStream{flow: flow, corruptOffset: 4096, received: make([]byte, len(data)), sent: make(map[uint64]int)}
+	reopen := func(offset uint64) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	}
+	// Chunks stay at the minimum size so the file is sent as many chunks
+	sizer := newChunkSizer(4096, 4096, 0)
+	if err := sendFileData(stream, bytes.NewReader(data), reopen, sizer, 0, flow); err != nil {
+		t.Error(err)
+		return
+	}
+	if !stream.closed || !bytes.Equal(stream.received, data) {
+		t.Errorf("Expected the whole file to arrive before the stream was closed")
+	}
+	// Only the rejected chunk is sent twice
+	for offset, count := range stream.sent {
+		if expected := map[bool]int{true: 2, false: 1}[offset == stream.corruptOffset]; count != expected {
+			t.Errorf("Expected the chunk at offset %d to be sent %d times, got %d", offset, expected, count)
+		}
+	}
+}
+
+func TestSendFileDataGivesUp(t *testing.T) {
+	data := make([]byte, 4096)
+	flow := newTransferFlow(0)
+	stream := &corruptingStream{flow: flow, corruptOffset: 0, received: make([]byte, len(data)), sent: make(map[uint64]int)}
+	// The chunk is corrupted every time it is sent
+	reopen := func(offset uint64) (io.ReadCloser, error) {
+		stream.corrupted = false
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	}
+	err := sendFileData(stream, bytes.NewReader(data), reopen, newChunkSizer(4096, 4096, 0), 0, flow)
+	if err == nil || stream.closed {
+		t.Errorf("Expected the transfer to fail")
+	}
+	if stream.sent[0] != maxChunkRetransmits+1 {
+		t.Errorf("Expected the chunk to be sent %d times, got %d", maxChunkRetransmits+1, stream.sent[0])
+	}
+}
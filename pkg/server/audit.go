@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// AuditEventQuery records the outcome of a QueryFile request
+	AuditEventQuery string = "query"
+	// AuditEventTransfer records the outcome of a TransferFile stream
+	AuditEventTransfer string = "transfer"
+)
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Event string `json:"Event"`
+	// Client is the authenticated identity of the client. Empty if the connection is not authenticated
+	Client string `json:"Client"`
+	// ClientID identifies the transfer job of the client
+	ClientID string `json:"ClientID"`
+	Peer     string `json:"Peer"`
+	// MediaPath and Name are where the client asked the file to be stored
+	MediaPath string `json:"MediaPath"`
+	Name      string `json:"Name"`
+	// Path is where the file is stored, relative to the media directory. Empty if the request was refused before the
+	// file was given a path
+	Path         string `json:"Path,omitempty"`
+	Size         uint64 `json:"Size"`
+	BytesWritten uint64 `json:"BytesWritten"`
+	// Hash is the hash the client declared for queries, and the hash of the data received so far after a transfer
+	Hash string `json:"Hash"`
+	// Complete is set when the server has the whole file: already stored for queries, received and verified for transfers
+	Complete bool      `json:"Complete"`
+	Code     string    `json:"Code"`
+	Error    string    `json:"Error,omitempty"`
+	Started  time.Time `json:"Started"`
+	// Duration is in nanoseconds
+	Duration time.Duration `json:"Duration"`
+}
+
+// AuditFilter selects records from the audit log. Zero fields match every record
+type AuditFilter struct {
+	Client string
+	// Path matches records for the file or directory at this path relative to the media directory
+	Path  string
+	Since time.Time
+	Until time.Time
+}
+
+// auditLog appends a record of every query and transfer outcome to a file, one json object per line
+type auditLog struct {
+	file *os.File
+	sync.Mutex
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file}, nil
+}
+
+// newAuditRecord starts a record of a request by client
+func newAuditRecord(event string, client net.ClientInfo) AuditRecord {
+	return AuditRecord{
+		Event:    event,
+		Client:   client.Identity,
+		ClientID: client.ID,
+		Peer:     client.Peer,
+		Started:  time.Now(),
+	}
+}
+
+// record finishes record with the outcome err and appends it to the log. Failures are logged, as the request itself
+// has already been handled
+func (a *auditLog) record(record AuditRecord, err error) {
+	if a == nil {
+		return
+	}
+	record.Duration = time.Since(record.Started)
+	record.Code = status.Code(err).String()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		common.LogError(err, "Could not marshal audit record")
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	// A single write per record keeps lines whole even if the file is appended to by something else
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		common.LogError(err, "Could not write audit record")
+	}
+}
+
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.file.Close()
+}
+
+// matches reports whether filter selects record
+func (filter AuditFilter) matches(record AuditRecord) bool {
+	if filter.Client != "" && record.Client != filter.Client {
+		return false
+	}
+	if !filter.Since.IsZero() && record.Started.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !record.Started.Before(filter.Until) {
+		return false
+	}
+	if filter.Path == "" {
+		return true
+	}
+	prefix := path.Clean(filepath.ToSlash(filter.Path))
+	for _, candidate := range []string{record.Path, path.Join(record.MediaPath, record.Name)} {
+		candidate = path.Clean(filepath.ToSlash(candidate))
+		if candidate == prefix || strings.HasPrefix(candidate, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadAudit calls fn with every record of the audit log at path that filter selects, oldest first, until fn returns
+// false. Lines that cannot be read, such as one cut short by a crash, are skipped
+func ReadAudit(path string, filter AuditFilter, fn func(record AuditRecord) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Debug().Err(err).Int("Line", line).Msg("Skipping unreadable audit record")
+			continue
+		}
+		if filter.matches(record) && !fn(record) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// auditPath returns fullPath relative to the media directory, for audit records
+func (s *TorrxferServer) auditPath(fullPath string) string {
+	relativePath, err := filepath.Rel(s.serverRootDir, fullPath)
+	if err != nil {
+		return fullPath
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+// auditTransfer records the outcome of the transfer of serverFile once its stream has closed. err is the error the
+// transfer ended with, if any
+func (s *TorrxferServer) auditTransfer(client net.ClientInfo, serverFile *File, err error) {
+	if s.audit == nil {
+		return
+	}
+	record := newAuditRecord(AuditEventTransfer, client)
+	serverFile.RLock()
+	record.Started = serverFile.started
+	record.MediaPath = serverFile.mediaPrefix
+	record.Name = filepath.Base(serverFile.fullPath)
+	record.Path = s.auditPath(serverFile.fullPath)
+	record.Size = serverFile.size
+	record.BytesWritten = serverFile.bytesWritten
+	record.Hash = serverFile.prefixHash
+	if err == nil {
+		// A refused chunk ends the stream without failing the file
+		err = serverFile.transferErr
+	}
+	record.Complete = err == nil && serverFile.currentSize == serverFile.size
+	serverFile.RUnlock()
+	s.audit.record(record, err)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sushshring/torrxfer/internal/db"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+)
+
+func readTestAudit(t *testing.T, path string, filter AuditFilter) []AuditRecord {
+	records := make([]AuditRecord, 0)
+	if err := ReadAudit(path, filter, func(record AuditRecord) bool {
+		records = append(records, record)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAuditTransfer(t *testing.T) {
+	dir := t.TempDir()
+	fileDb, err := db.GetDb("audit.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer fileDb.Close()
+	auditPath := filepath.Join(dir, "audit.log")
+	audit, err := openAuditLog(auditPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	mediaDir := filepath.Join(dir, "media")
+	if err := os.Mkdir(mediaDir, 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	s := &TorrxferServer{
+		activeFiles:   make(map[string]*File),
+		serverRootDir: mediaDir,
+		fileDb:        fileDb,
+		paths:         newPathSanitizer(common.ServerConfig{MaxNameLength: 255}),
+		audit:         audit,
+	}
+	alice := net.ClientInfo{ID: "job", Identity: "alice", Peer: "10.0.0.2:5000"}
+
+	data := []byte("episode data")
+	hash := fmt.Sprintf("%x", sha256.Sum256(data))
+	file := net.NewFileFromData("episode.mkv", uint64(len(data)), hash, time.Now())
+	file.SetMediaPath("tv/Show")
+	if _, err := s.QueryFunction(alice, file); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := s.TransferFunction(alice, data, uint32(len(data)), 0, net.ChunkChecksum(data)); err != nil {
+		t.Error(err)
+		return
+	}
+	_, doneChannel, _ := s.RegisterForWriteNotification(alice.ID)
+	s.Close(alice.ID, nil)
+	<-doneChannel
+	s.writers.Wait()
+
+	// A refused query is recorded with its code
+	rejected := net.NewFileFromData("film.mkv", 10, "other", time.Now())
+	rejected.SetMediaPath("../movies")
+	if _, err := s.QueryFunction(net.ClientInfo{ID: "other job", Peer: "10.0.0.3:5000"}, rejected); err == nil {
+		t.Errorf("Expected query outside the media directory to be refused")
+	}
+	audit.close()
+
+	records := readTestAudit(t, auditPath, AuditFilter{})
+	if len(records) != 3 {
+		t.Errorf("Expected 3 records, got %v", records)
+		return
+	}
+	query, transfer, refused := records[0], records[1], records[2]
+	if query.Event != AuditEventQuery || query.Code != codes.OK.String() || query.Path != "tv/Show/episode.mkv" || query.Client != "alice" || query.Peer != alice.Peer || query.Complete {
+		t.Errorf("Unexpected query record %+v", query)
+	}
+	if transfer.Event != AuditEventTransfer || transfer.Code != codes.OK.String() || !transfer.Complete || transfer.Hash != hash || transfer.BytesWritten != uint64(len(data)) {
+		t.Errorf("Unexpected transfer record %+v", transfer)
+	}
+	if refused.Code != codes.InvalidArgument.String() || refused.Path != "" || refused.Error == "" {
+		t.Errorf("Unexpected refused query record %+v", refused)
+	}
+
+	if records := readTestAudit(t, auditPath, AuditFilter{Client: "alice", Path: "tv"}); len(records) != 2 {
+		t.Errorf("Expected both records of alice under tv, got %v", records)
+	}
+	if records := readTestAudit(t, auditPath, AuditFilter{Path: "tv/Sho"}); len(records) != 0 {
+		t.Errorf("Expected path to match whole names only, got %v", records)
+	}
+	if records := readTestAudit(t, auditPath, AuditFilter{Since: time.Now()}); len(records) != 0 {
+		t.Errorf("Expected no records after now, got %v", records)
+	}
+}
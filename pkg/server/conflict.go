@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// conflictsDirName is the directory under the server root that holds new files kept alongside existing ones
+const conflictsDirName string = ".torrxfer-conflicts"
+
+// conflictPolicy returns the policy that applies to files under mediaPrefix. The longest configured prefix wins
+func (s *TorrxferServer) conflictPolicy(mediaPrefix string) common.ConflictPolicy {
+	policy := s.defaultConflictPolicy
+	if policy == "" {
+		policy = common.ConflictPolicyOverwrite
+	}
+	mediaPrefix = normalizeMediaPrefix(mediaPrefix)
+	longest := -1
+	for prefix, prefixPolicy := range s.conflictPolicies {
+		prefix = normalizeMediaPrefix(prefix)
+		if len(prefix) <= longest {
+			continue
+		}
+		if prefix == "" || mediaPrefix == prefix || strings.HasPrefix(mediaPrefix, prefix+"/") {
+			policy = prefixPolicy
+			longest = len(prefix)
+		}
+	}
+	return policy
+}
+
+// reservePath returns the path a new file requested at fullPath is written to, and reserves it until releasePath is
+// called. The conflict policy for mediaPrefix decides where the file goes if a different file already exists or is
+// staged at fullPath, is being received there, or another query reserved it. Reservations keep concurrent queries
+// from choosing the same path before either staging file exists
+func (s *TorrxferServer) reservePath(fullPath, mediaPrefix string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	inUse := s.pathInUse(fullPath)
+	if inUse || pathExists(fullPath) || pathExists(stagingPathFor(fullPath)) {
+		var err error
+		if fullPath, err = s.resolveConflict(fullPath, mediaPrefix, inUse); err != nil {
+			return "", err
+		}
+	}
+	s.reserveLocked(fullPath)
+	return fullPath, nil
+}
+
+// claimPath reserves fullPath for a file that is resumed there until releasePath is called, unless another query
+// reserved it first
+func (s *TorrxferServer) claimPath(fullPath string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.reservedPaths[fullPath] > 0 {
+		return errPathBusy(fullPath)
+	}
+	s.reserveLocked(fullPath)
+	return nil
+}
+
+// reserveLocked adds a reservation for fullPath. Callers must hold the server lock
+func (s *TorrxferServer) reserveLocked(fullPath string) {
+	if s.reservedPaths == nil {
+		s.reservedPaths = make(map[string]int)
+	}
+	s.reservedPaths[fullPath]++
+}
+
+// releasePath drops a reservation made by reservePath or claimPath
+func (s *TorrxferServer) releasePath(fullPath string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.reservedPaths[fullPath]--; s.reservedPaths[fullPath] <= 0 {
+		delete(s.reservedPaths, fullPath)
+	}
+}
+
+// pathInUse reports whether another query reserved fullPath or an active transfer is writing to it. Callers must hold
+// the server lock
+func (s *TorrxferServer) pathInUse(fullPath string) bool {
+	if s.reservedPaths[fullPath] > 0 {
+		return true
+	}
+	for _, file := range s.activeFiles {
+		if file != nil && file.fullPath == fullPath {
+			return true
+		}
+	}
+	return false
+}
+
+// errPathBusy is returned for a new file whose path another transfer is using. The client retries later
+func errPathBusy(fullPath string) error {
+	return status.Errorf(codes.Aborted, "a different file named %s is being received", filepath.Base(fullPath))
+}
+
+// resolveConflict is called when a new file would be written to fullPath but a different file already exists, is
+// staged or is being received there. inUse is set if another transfer is using fullPath. Returns the path the new file
+// should be written to according to the conflict policy for its media prefix. A file that is overwritten is only
+// discarded once its replacement has been received and verified, and a transfer in progress is never overwritten.
+// Callers must hold the server lock
+func (s *TorrxferServer) resolveConflict(fullPath, mediaPrefix string, inUse bool) (string, error) {
+	policy := s.conflictPolicy(mediaPrefix)
+	log.Debug().Str("Name", fullPath).Str("Policy", string(policy)).Msg("File exists")
+	switch policy {
+	case common.ConflictPolicyRename:
+		return nextFreePath(fullPath, s.pathInUse), nil
+	case common.ConflictPolicyKeepBoth:
+		relativePath, err := filepath.Rel(s.serverRootDir, fullPath)
+		if err != nil {
+			return "", err
+		}
+		return nextFreePath(filepath.Join(s.serverRootDir, conflictsDirName, relativePath), s.pathInUse), nil
+	case common.ConflictPolicyReject:
+		return "", status.Errorf(codes.AlreadyExists, "a different file named %s already exists", filepath.Base(fullPath))
+	default:
+		if inUse {
+			return "", errPathBusy(fullPath)
+		}
+		return fullPath, nil
+	}
+}
+
+// nextFreePath returns path if nothing exists there, otherwise the first "name (n).ext" that is neither a file nor
+// being staged, and is not inUse. inUse may be nil
+func nextFreePath(path string, inUse func(path string) bool) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	candidate := path
+	for n := 1; ; n++ {
+		if !pathExists(candidate) && !pathExists(stagingPathFor(candidate)) && (inUse == nil || !inUse(candidate)) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+}
+
+// pathExists reports whether anything may exist at path. Paths that cannot be checked are treated as existing
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+func normalizeMediaPrefix(mediaPrefix string) string {
+	return strings.Trim(filepath.ToSlash(mediaPrefix), "/")
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sushshring/torrxfer/internal/db"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConflictPolicyPrefix(t *testing.T) {
+	s := &TorrxferServer{
+		defaultConflictPolicy: common.ConflictPolicyRename,
+		conflictPolicies: map[string]common.ConflictPolicy{
+			"tv":             common.ConflictPolicyKeepBoth,
+			"/tv/Show":       common.ConflictPolicyReject,
+			"movies/archive": common.ConflictPolicyOverwrite,
+		},
+	}
+	expected := map[string]common.ConflictPolicy{
+		"":                  common.ConflictPolicyRename,
+		"/tv":               common.ConflictPolicyKeepBoth,
+		"/tv/Other":         common.ConflictPolicyKeepBoth,
+		"/tv/Show/Season 1": common.ConflictPolicyReject,
+		"/tv/Showcase":      common.ConflictPolicyKeepBoth,
+		"/movies":           common.ConflictPolicyRename,
+	}
+	for prefix, policy := range expected {
+		if actual := s.conflictPolicy(prefix); actual != policy {
+			t.Errorf("Incorrect policy for %s. Expected: %s got %s", prefix, policy, actual)
+		}
+	}
+}
+
+func TestNextFreePath(t *testing.T) {
+	dir, err := os.MkdirTemp("", "conflict")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "episode.mkv")
+	for _, existing := range []string{path, stagingPathFor(filepath.Join(dir, "episode (1).mkv"))} {
+		if err := os.WriteFile(existing, []byte("data"), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if actual := nextFreePath(path, nil); actual != filepath.Join(dir, "episode (2).mkv") {
+		t.Errorf("Incorrect free path. Got %s", actual)
+	}
+	reserved := func(path string) bool { return path == filepath.Join(dir, "episode (2).mkv") }
+	if actual := nextFreePath(path, reserved); actual != filepath.Join(dir, "episode (3).mkv") {
+		t.Errorf("Expected reserved path to be skipped. Got %s", actual)
+	}
+}
+
+func TestReservePath(t *testing.T) {
+	dir, err := os.MkdirTemp("", "conflict")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s := &TorrxferServer{serverRootDir: dir, defaultConflictPolicy: common.ConflictPolicyRename}
+
+	// Concurrent queries for the same new file are given different paths until one of them is released
+	path := filepath.Join(dir, "episode.mkv")
+	first, err := s.reservePath(path, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := s.reservePath(path, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first != path || second != filepath.Join(dir, "episode (1).mkv") {
+		t.Errorf("Incorrect reserved paths %s and %s", first, second)
+	}
+	s.releasePath(first)
+	s.releasePath(second)
+	if len(s.reservedPaths) != 0 {
+		t.Errorf("Expected all reservations to be released, got %v", s.reservedPaths)
+	}
+
+	// A file that is overwritten stays in place until its replacement is promoted
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	s.defaultConflictPolicy = common.ConflictPolicyOverwrite
+	reserved, err := s.reservePath(path, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.releasePath(reserved)
+	if reserved != path {
+		t.Errorf("Expected overwrite to keep the path, got %s", reserved)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected the existing file to be kept until promotion: %v", err)
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	dir, err := os.MkdirTemp("", "conflict")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// Write threads record files concurrently
+	fileDb, err := db.GetDb("conflict.dat", t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer fileDb.Close()
+	s := &TorrxferServer{
+		serverRootDir:         dir,
+		fileDb:                fileDb,
+		activeFiles:           make(map[string]*File),
+		defaultConflictPolicy: common.ConflictPolicyRename,
+	}
+	var files []*File
+	defer func() {
+		for _, file := range files {
+			file.close()
+		}
+		s.writers.Wait()
+	}()
+	query := func(clientID, hash string) (*File, error) {
+		client := net.ClientInfo{ID: clientID, Identity: clientID}
+		file := net.NewFileFromData("episode.mkv", 8, hash, time.Now())
+		file.SetMediaPath("tv")
+		if _, err := s.queryFile(client, file, &AuditRecord{}); err != nil {
+			return nil, err
+		}
+		active := s.isFileActive(clientID)
+		files = append(files, active)
+		return active, nil
+	}
+
+	// A second client sending different content to the same path while the first is still receiving it is given a
+	// different path
+	first, err := query("first", "a")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := first.writeChunk([]byte("firs"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := query("second", "b")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first.fullPath == second.fullPath {
+		t.Errorf("Expected concurrent transfers to be given different paths, both got %s", first.fullPath)
+	}
+	if data, err := os.ReadFile(first.stagingPath()); err != nil || string(data) != "firs" {
+		t.Errorf("Expected the first transfer to keep its staged data, got %q %v", data, err)
+	}
+
+	// Overwriting a file that is being received is refused until the transfer is done
+	s.defaultConflictPolicy = common.ConflictPolicyOverwrite
+	if _, err := query("third", "c"); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected overwriting a transfer in progress to be refused, got %v", err)
+	}
+	if data, err := os.ReadFile(first.stagingPath()); err != nil || string(data) != "firs" {
+		t.Errorf("Expected the first transfer to keep its staged data, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package server
+
+import "errors"
+
+// freeSpace is not supported on this platform, so files are admitted without a space check
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("free space check is not supported on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package server
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the number of bytes available to the server on the filesystem holding path
+func freeSpace(path string) (uint64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
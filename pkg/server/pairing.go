@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/fslock"
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// pairingFileName holds the pending pairing codes in the certificate directory
+	pairingFileName string = "pairing.json"
+	// pairingLockTimeout is how long to wait for another process updating the pending pairing codes
+	pairingLockTimeout time.Duration = 10 * time.Second
+	// maxPairingFailures is how many pairing attempts with a wrong or expired code are answered within
+	// pairingFailureWindow. Further attempts are refused until the oldest failure is out of the window
+	maxPairingFailures   int           = 10
+	pairingFailureWindow time.Duration = 10 * time.Minute
+)
+
+// pendingPairing is a pairing code that has not been used yet
+type pendingPairing struct {
+	Code     string
+	Identity string
+	Expires  time.Time
+}
+
+// pairingCodes are the single use pairing codes created by the pair command. They are kept in a file so the command
+// works while the server is running
+type pairingCodes struct {
+	path string
+}
+
+func openPairingCodes(serverConf common.ServerConfig) *pairingCodes {
+	return &pairingCodes{filepath.Join(serverConf.CertDirectory(), pairingFileName)}
+}
+
+// CreatePairingCode creates a pairing code that lets one client pair as identity until ttl has passed
+func CreatePairingCode(serverConf common.ServerConfig, identity string, ttl time.Duration) (string, error) {
+	if identity == "" {
+		return "", status.Errorf(codes.InvalidArgument, "identity must not be empty")
+	}
+	code, err := crypto.GeneratePairingCode()
+	if err != nil {
+		return "", err
+	}
+	err = openPairingCodes(serverConf).update(func(pending []pendingPairing) []pendingPairing {
+		return append(pending, pendingPairing{Code: code, Identity: identity, Expires: time.Now().Add(ttl)})
+	})
+	return code, err
+}
+
+// redeem finds the pending code a client proof was made with and removes it so it cannot be used again
+func (p *pairingCodes) redeem(proof []byte, fingerprint string) (redeemed pendingPairing, ok bool, err error) {
+	err = p.update(func(pending []pendingPairing) []pendingPairing {
+		for i, pairing := range pending {
+			if crypto.CheckPairingProof(proof, pairing.Code, crypto.PairingRoleClient, fingerprint) {
+				redeemed, ok = pairing, true
+				return append(pending[:i], pending[i+1:]...)
+			}
+		}
+		return pending
+	})
+	return redeemed, ok, err
+}
+
+// update replaces the pending codes with what fn returns. Expired codes are dropped first
+func (p *pairingCodes) update(fn func([]pendingPairing) []pendingPairing) error {
+	if err := os.MkdirAll(filepath.Dir(p.path), 0700); err != nil {
+		return err
+	}
+	lock := fslock.New(p.path + ".lock")
+	if err := lock.LockWithTimeout(pairingLockTimeout); err != nil {
+		common.LogError(err, "Could not lock pairing codes")
+		return err
+	}
+	defer lock.Unlock()
+
+	var pending []pendingPairing
+	data, err := os.ReadFile(p.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &pending); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	now := time.Now()
+	unexpired := pending[:0]
+	for _, pairing := range pending {
+		if now.Before(pairing.Expires) {
+			unexpired = append(unexpired, pairing)
+		}
+	}
+	data, err = json.Marshal(fn(unexpired))
+	if err != nil {
+		return err
+	}
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p.path)
+}
+
+// pairing hands out credentials to clients that present a valid pairing code
+type pairing struct {
+	codes *pairingCodes
+	// fingerprint returns the fingerprint of the certificate the server currently presents
+	fingerprint func() string
+	// tokenKey signs tokens for paired clients. nil if the server does not use tokens
+	tokenKey []byte
+	// ca signs certificates for paired clients. nil if the server does not require client certificates
+	ca *crypto.CertificateAuthority
+	// credentialTTL is how long credentials handed out are valid for
+	credentialTTL time.Duration
+	// failures are the times of recent pairing attempts that failed, oldest first
+	failures []time.Time
+	sync.Mutex
+}
+
+// allowAttempt reports whether a pairing attempt may be checked, or too many have failed recently
+func (p *pairing) allowAttempt() bool {
+	p.Lock()
+	defer p.Unlock()
+	cutoff := time.Now().Add(-pairingFailureWindow)
+	for len(p.failures) > 0 && p.failures[0].Before(cutoff) {
+		p.failures = p.failures[1:]
+	}
+	return len(p.failures) < maxPairingFailures
+}
+
+// recordFailure counts a pairing attempt that failed against the limit
+func (p *pairing) recordFailure() {
+	p.Lock()
+	defer p.Unlock()
+	p.failures = append(p.failures, time.Now())
+}
+
+// pair redeems the pairing code the request was made with for a credential of every kind the server requires
+func (p *pairing) pair(request net.PairingRequest) (net.PairingCredential, error) {
+	if p.tokenKey == nil && p.ca == nil {
+		return net.PairingCredential{}, status.Errorf(codes.FailedPrecondition, "server does not authenticate clients")
+	}
+	if p.ca != nil && len(request.CertificateRequest) == 0 {
+		return net.PairingCredential{}, status.Errorf(codes.InvalidArgument, "certificate request required")
+	}
+	// Each attempt is a guess at a pending code, so guessing is cut short
+	if !p.allowAttempt() {
+		log.Warn().Int("Failures", maxPairingFailures).Dur("Window", pairingFailureWindow).Msg("Too many failed pairing attempts")
+		return net.PairingCredential{}, status.Errorf(codes.ResourceExhausted, "too many failed pairing attempts. Try again later")
+	}
+	// The client saw the certificate that is current now unless it was swapped during the handshake, which only
+	// makes the pairing fail
+	fingerprint := p.fingerprint()
+	redeemed, ok, err := p.codes.redeem(request.Proof, fingerprint)
+	if err != nil {
+		common.LogError(err, "Could not read pairing codes")
+		return net.PairingCredential{}, err
+	}
+	if !ok {
+		p.recordFailure()
+		return net.PairingCredential{}, status.Errorf(codes.PermissionDenied, "invalid or expired pairing code")
+	}
+	identity := redeemed.Identity
+	credential := net.PairingCredential{
+		Identity:    identity,
+		Fingerprint: fingerprint,
+		Proof:       crypto.PairingProof(redeemed.Code, crypto.PairingRoleServer, fingerprint),
+	}
+	if p.tokenKey != nil {
+		if credential.Token, err = crypto.IssueToken(p.tokenKey, identity, p.credentialTTL); err != nil {
+			return net.PairingCredential{}, err
+		}
+	}
+	if p.ca != nil {
+		credential.Certificate, err = p.ca.SignClientRequest(identity, request.CertificateRequest, p.credentialTTL)
+		if err != nil {
+			return net.PairingCredential{}, status.Errorf(codes.InvalidArgument, "invalid certificate request: %v", err)
+		}
+		credential.CACertificate = p.ca.CertPEM()
+	}
+	return credential, nil
+}
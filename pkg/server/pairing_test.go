@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPairing(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pairing")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	serverConf := common.ServerConfig{CertDir: dir}
+	ca, err := crypto.InitCA(dir, "test CA")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tokenKey := make([]byte, 32)
+	const fingerprint = "0123abcd"
+	serverPairing := &pairing{
+		codes:         openPairingCodes(serverConf),
+		fingerprint:   func() string { return fingerprint },
+		tokenKey:      tokenKey,
+		ca:            ca,
+		credentialTTL: time.Hour,
+	}
+
+	code, err := CreatePairingCode(serverConf, "alice", time.Minute)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	keyPEM, requestPEM, err := crypto.GenerateClientKey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// A proof for a different server certificate is refused
+	_, err = serverPairing.pair(net.PairingRequest{
+		Proof:              crypto.PairingProof(code, crypto.PairingRoleClient, "ffff"),
+		CertificateRequest: requestPEM,
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected proof for another certificate to be refused, got %v", err)
+	}
+
+	request := net.PairingRequest{
+		Proof:              crypto.PairingProof(code, crypto.PairingRoleClient, fingerprint),
+		CertificateRequest: requestPEM,
+	}
+	credential, err := serverPairing.pair(request)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !crypto.CheckPairingProof(credential.Proof, code, crypto.PairingRoleServer, fingerprint) {
+		t.Errorf("Server proof does not verify")
+	}
+	if subject, err := crypto.VerifyToken(tokenKey, credential.Token); err != nil || subject != "alice" {
+		t.Errorf("Expected token for alice, got %s %v", subject, err)
+	}
+	clientCert, err := tls.X509KeyPair(credential.Certificate, keyPEM)
+	if err != nil {
+		t.Errorf("Certificate does not match the requested key: %v", err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if leaf.Subject.CommonName != "alice" || leaf.CheckSignatureFrom(ca.Cert) != nil {
+		t.Errorf("Expected certificate for alice signed by the CA, got %s", leaf.Subject)
+	}
+
+	// Codes are single use
+	if _, err := serverPairing.pair(request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected used code to be refused, got %v", err)
+	}
+
+	// Expired codes are refused
+	code, err = CreatePairingCode(serverConf, "bob", -time.Minute)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = serverPairing.pair(net.PairingRequest{
+		Proof:              crypto.PairingProof(code, crypto.PairingRoleClient, fingerprint),
+		CertificateRequest: requestPEM,
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected expired code to be refused, got %v", err)
+	}
+}
+
+func TestPairingAttemptLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pairing")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	serverConf := common.ServerConfig{CertDir: dir}
+	const fingerprint = "0123abcd"
+	serverPairing := &pairing{
+		codes:         openPairingCodes(serverConf),
+		fingerprint:   func() string { return fingerprint },
+		tokenKey:      make([]byte, 32),
+		credentialTTL: time.Hour,
+	}
+	code, err := CreatePairingCode(serverConf, "alice", time.Minute)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if length := len(crypto.NormalizePairingCode(code)); length != 25 {
+		t.Errorf("Expected a 25 character pairing code, got %d in %s", length, code)
+	}
+
+	// Once too many guesses have failed, even the right code is refused until the failures are out of the window
+	for i := 0; i < maxPairingFailures; i++ {
+		_, err := serverPairing.pair(net.PairingRequest{Proof: crypto.PairingProof("WRONG", crypto.PairingRoleClient, fingerprint)})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Expected wrong code to be refused, got %v", err)
+		}
+	}
+	request := net.PairingRequest{Proof: crypto.PairingProof(code, crypto.PairingRoleClient, fingerprint)}
+	if _, err := serverPairing.pair(request); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected pairing to be refused after too many failures, got %v", err)
+	}
+	serverPairing.failures[0] = time.Now().Add(-pairingFailureWindow - time.Second)
+	if _, err := serverPairing.pair(request); err != nil {
+		t.Errorf("Expected pairing to be allowed once a failure left the window, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sushshring/torrxfer/pkg/common"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errAbsolutePath  = errors.New("path must be relative to the media directory")
+	errParentSegment = errors.New("path must not contain .. segments")
+	errNulByte       = errors.New("path must not contain NUL bytes")
+	errBadFileName   = errors.New("file name must be a single path component")
+	errNameTooLong   = errors.New("path component is too long")
+	errSymlinkEscape = errors.New("path resolves outside the media directory")
+	errReservedName  = errors.New("name is reserved by the server")
+)
+
+// reservedNames are the directories the server keeps its own files in under the media directory
+var reservedNames = []string{trashDirName, conflictsDirName}
+
+// reservedSuffixes mark the staging files, trash entries and rekeyed copies the server keeps next to media files
+var reservedSuffixes = []string{partialFileSuffix, trashEntrySuffix, rekeyFileSuffix}
+
+// windowsReservedNames cannot be used as the base name of a file on Windows, whatever the extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// pathSanitizer validates paths supplied by clients and rewrites them according to the configured profile
+type pathSanitizer struct {
+	profile       common.PathProfile
+	maxNameLength int
+	normalize     bool
+}
+
+func newPathSanitizer(serverConf common.ServerConfig) pathSanitizer {
+	return pathSanitizer{
+		profile:       serverConf.PathProfile,
+		maxNameLength: serverConf.MaxNameLength,
+		normalize:     serverConf.NormalizeUnicode,
+	}
+}
+
+// components splits a client supplied relative path into validated and sanitized components.
+// Both / and \ are treated as separators so a path means the same thing whatever OS the server runs on
+func (p pathSanitizer) components(clientPath string) ([]string, error) {
+	if strings.ContainsRune(clientPath, 0) {
+		return nil, errNulByte
+	}
+	if filepath.IsAbs(clientPath) || filepath.VolumeName(clientPath) != "" || strings.HasPrefix(clientPath, "/") || strings.HasPrefix(clientPath, `\`) {
+		return nil, errAbsolutePath
+	}
+	components := make([]string, 0)
+	for _, component := range strings.FieldsFunc(clientPath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		switch component {
+		case ".":
+			continue
+		case "..":
+			return nil, errParentSegment
+		}
+		if p.normalize {
+			component = norm.NFC.String(component)
+		}
+		if p.profile == common.PathProfileWindows {
+			component = sanitizeWindowsName(component)
+		}
+		if isReservedName(component) {
+			return nil, fmt.Errorf("%w: %q", errReservedName, component)
+		}
+		if p.maxNameLength > 0 && len(component) > p.maxNameLength {
+			return nil, fmt.Errorf("%w: %q is longer than %d bytes", errNameTooLong, component, p.maxNameLength)
+		}
+		components = append(components, component)
+	}
+	return components, nil
+}
+
+// isReservedName reports whether name could be mistaken for one of the server's own files. Names are compared
+// ignoring case, as the media directory may be on a case insensitive filesystem
+func isReservedName(name string) bool {
+	for _, reserved := range reservedNames {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	for _, suffix := range reservedSuffixes {
+		if strings.HasSuffix(strings.ToLower(name), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeWindowsName replaces characters Windows does not allow in names, trailing dots and spaces, and reserved
+// device names
+func sanitizeWindowsName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+	if windowsReservedNames[strings.ToUpper(strings.SplitN(name, ".", 2)[0])] {
+		name = "_" + name
+	}
+	return name
+}
+
+// clientFilePath validates the media path and file name supplied by a client. Returns the path the file is stored
+// at under the server root and the sanitized media prefix. Invalid paths are rejected with InvalidArgument
+func (s *TorrxferServer) clientFilePath(mediaPath, fileName string) (fullPath, mediaPrefix string, err error) {
+	directories, err := s.paths.components(mediaPath)
+	if err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "invalid media path %q: %v", mediaPath, err)
+	}
+	names, err := s.paths.components(fileName)
+	if err == nil && len(names) != 1 {
+		err = errBadFileName
+	}
+	if err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "invalid file name %q: %v", fileName, err)
+	}
+	fullPath = filepath.Join(append(append([]string{s.serverRootDir}, directories...), names[0])...)
+	if err := resolvesWithin(s.serverRootDir, fullPath); err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "invalid path %q: %v", filepath.Join(mediaPath, fileName), err)
+	}
+	return fullPath, strings.Join(directories, "/"), nil
+}
+
+// resolvesWithin returns an error if following the symlinks in the existing part of path leads outside of root
+func resolvesWithin(root, path string) error {
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		resolvedRoot = root
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSymlinkEscape, err)
+	}
+	relativePath, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return errSymlinkEscape
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sushshring/torrxfer/pkg/common"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPathComponentsReject(t *testing.T) {
+	p := pathSanitizer{maxNameLength: 10}
+	expected := map[string]error{
+		"/etc":           errAbsolutePath,
+		`\Windows`:       errAbsolutePath,
+		"../../etc":      errParentSegment,
+		"tv/../../etc":   errParentSegment,
+		`tv\..\..\etc`:   errParentSegment,
+		"tv\x00/show":    errNulByte,
+		"tv/a long name": errNameTooLong,
+		// Names the server uses for its own files
+		".trash/x":            errReservedName,
+		"tv/.TRASH":           errReservedName,
+		".torrxfer-conflicts": errReservedName,
+		"a.torrxfer-partial":  errReservedName,
+		"tv/a.torrxfer-trash": errReservedName,
+		"a.Torrxfer-Partial":  errReservedName,
+	}
+	for path, expectedErr := range expected {
+		if _, err := p.components(path); !errors.Is(err, expectedErr) {
+			t.Errorf("Incorrect error for %q. Expected: %v got %v", path, expectedErr, err)
+		}
+	}
+}
+
+func TestPathComponentsSanitize(t *testing.T) {
+	p := pathSanitizer{profile: common.PathProfileWindows, normalize: true}
+	expected := map[string]string{
+		"":                    "",
+		"./tv//Show/":         "tv/Show",
+		`tv\Show: Part 1?`:    "tv/Show_ Part 1_",
+		"Season 1.../con.nfo": "Season 1/_con.nfo",
+		"Cafe\u0301":          "Caf\u00e9",
+	}
+	for path, sanitized := range expected {
+		components, err := p.components(path)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", path, err)
+			continue
+		}
+		if actual := strings.Join(components, "/"); actual != sanitized {
+			t.Errorf("Incorrect sanitized path for %q. Expected: %q got %q", path, sanitized, actual)
+		}
+	}
+}
+
+func TestClientFilePathSymlinkEscape(t *testing.T) {
+	root, err := os.MkdirTemp("", "media")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	outside, err := os.MkdirTemp("", "outside")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(outside) })
+	if err := os.Symlink(outside, filepath.Join(root, "tv")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := &TorrxferServer{serverRootDir: root}
+	if _, _, err := s.clientFilePath("tv/Show", "episode.mkv"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected symlink escape to be rejected, got %v", err)
+	}
+	if _, _, err := s.clientFilePath("movies", "sub/episode.mkv"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected file name with separator to be rejected, got %v", err)
+	}
+	// Clients can not write into the trash or conflicts directories, or as staging files, trash entries and rekeyed copies
+	reserved := map[string]string{
+		trashDirName + "/2021-01-01": "film.mkv",
+		conflictsDirName:             "film.mkv",
+		"movies":                     "film.mkv" + trashEntrySuffix,
+		"movies/Film":                "." + "film.mkv" + partialFileSuffix,
+		"tv":                         "episode.mkv" + rekeyFileSuffix,
+	}
+	for mediaPath, fileName := range reserved {
+		if _, _, err := s.clientFilePath(mediaPath, fileName); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected %s to be rejected, got %v", filepath.Join(mediaPath, fileName), err)
+		}
+	}
+	fullPath, mediaPrefix, err := s.clientFilePath("movies/Film", "film.mkv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if fullPath != filepath.Join(root, "movies", "Film", "film.mkv") || mediaPrefix != "movies/Film" {
+		t.Errorf("Incorrect path %s with prefix %s", fullPath, mediaPrefix)
+	}
+}
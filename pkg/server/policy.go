@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/internal/db"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	quotaDbName string = "quota.dat"
+	// chargeKeyPrefix prefixes the quota DB entries recording who each stored file was charged to, keyed by the file DB
+	// key of the file
+	chargeKeyPrefix string = "file/"
+)
+
+// clientPolicies enforces the policy file. Quota usage is kept in its own DB keyed by client identity, next to the
+// charge for each stored file so the usage can be released when the file is discarded
+type clientPolicies struct {
+	clients map[string]common.ClientPolicy
+	quotaDb db.KvDB
+	sync.Mutex
+}
+
+// openClientPolicies reads the policy file in the server config. Returns nil if no policy is configured
+func openClientPolicies(serverConf common.ServerConfig) (*clientPolicies, error) {
+	if serverConf.PolicyFile == "" {
+		return nil, nil
+	}
+	text, err := os.ReadFile(serverConf.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	var policyConfig common.PolicyConfig
+	if err := json.Unmarshal(text, &policyConfig); err != nil {
+		return nil, err
+	}
+	var quotaDb db.KvDB
+	if serverConf.DbDir == "" {
+		quotaDb, err = db.GetDb(quotaDbName)
+	} else {
+		quotaDb, err = db.GetDb(quotaDbName, serverConf.DbDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Int("Clients", len(policyConfig.Clients)).Msg("Loaded client policies")
+	return &clientPolicies{clients: policyConfig.Clients, quotaDb: quotaDb}, nil
+}
+
+// policy returns the policy for a client identity, falling back to the default entry
+func (p *clientPolicies) policy(client net.ClientInfo) (common.ClientPolicy, error) {
+	if policy, ok := p.clients[client.Identity]; ok && client.Identity != "" {
+		return policy, nil
+	}
+	if policy, ok := p.clients[common.DefaultPolicyName]; ok {
+		return policy, nil
+	}
+	return common.ClientPolicy{}, status.Errorf(codes.PermissionDenied, "client %q may not write to this server", client.Identity)
+}
+
+// admit checks that the client may write a file of the given size under mediaPrefix. pending is the size of the
+// client's other transfers that have not been charged to its quota yet
+func (p *clientPolicies) admit(client net.ClientInfo, mediaPrefix string, size, pending uint64) error {
+	policy, err := p.policy(client)
+	if err != nil {
+		return err
+	}
+	if !prefixAllowed(policy.MediaPrefixes, mediaPrefix) {
+		return status.Errorf(codes.PermissionDenied, "client %q may not write to %q", client.Identity, mediaPrefix)
+	}
+	if policy.MaxFileSize > 0 && size > uint64(policy.MaxFileSize) {
+		return status.Errorf(codes.PermissionDenied, "file of %d bytes is larger than the %d bytes allowed for client %q",
+			size, uint64(policy.MaxFileSize), client.Identity)
+	}
+	if policy.Quota > 0 {
+		used := p.usage(client.Identity)
+		if used+pending+size > uint64(policy.Quota) {
+			return status.Errorf(codes.ResourceExhausted, "file of %d bytes exceeds the quota of client %q: %d of %d bytes used, %d in progress",
+				size, client.Identity, used, uint64(policy.Quota), pending)
+		}
+	}
+	return nil
+}
+
+// usage returns the bytes already charged to the quota of a client identity
+func (p *clientPolicies) usage(identity string) uint64 {
+	if !p.quotaDb.Has(identity) {
+		return 0
+	}
+	value, err := p.quotaDb.Get(identity)
+	if err != nil {
+		return 0
+	}
+	used, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		log.Debug().Err(err).Str("Identity", identity).Msg("Unreadable quota usage")
+		return 0
+	}
+	return used
+}
+
+// charge adds a completed transfer to the quota usage of a client identity. key is the file DB key of the stored
+// file. A file charged before is released first, so a file that is transferred again is only counted once
+func (p *clientPolicies) charge(identity, key string, size uint64) error {
+	p.Lock()
+	defer p.Unlock()
+	if err := p.releaseLocked(key); err != nil {
+		return err
+	}
+	if err := p.quotaDb.Put(identity, strconv.FormatUint(p.usage(identity)+size, 10)); err != nil {
+		return err
+	}
+	return p.quotaDb.Put(chargeKeyPrefix+key, strconv.FormatUint(size, 10)+" "+identity)
+}
+
+// release takes the size of the stored file with file DB key key off the quota usage of the identity it was charged
+// to. Files that were never charged are ignored
+func (p *clientPolicies) release(key string) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.releaseLocked(key)
+}
+
+func (p *clientPolicies) releaseLocked(key string) error {
+	if !p.quotaDb.Has(chargeKeyPrefix + key) {
+		return nil
+	}
+	value, err := p.quotaDb.Get(chargeKeyPrefix + key)
+	if err != nil {
+		return err
+	}
+	tokens := strings.SplitN(value, " ", 2)
+	size, err := strconv.ParseUint(tokens[0], 10, 64)
+	if err != nil || len(tokens) != 2 {
+		log.Debug().Err(err).Str("Key", key).Msg("Unreadable quota charge")
+		return p.quotaDb.Delete(chargeKeyPrefix + key)
+	}
+	identity := tokens[1]
+	used := p.usage(identity)
+	if size > used {
+		size = used
+	}
+	if err := p.quotaDb.Put(identity, strconv.FormatUint(used-size, 10)); err != nil {
+		return err
+	}
+	return p.quotaDb.Delete(chargeKeyPrefix + key)
+}
+
+// close closes the quota DB
+func (p *clientPolicies) close() {
+	p.quotaDb.Close()
+}
+
+// prefixAllowed reports whether mediaPrefix lies under one of the allowed prefixes. No prefixes allows any
+func prefixAllowed(allowed []string, mediaPrefix string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaPrefix = normalizeMediaPrefix(mediaPrefix)
+	for _, prefix := range allowed {
+		prefix = normalizeMediaPrefix(prefix)
+		if prefix == "" || mediaPrefix == prefix || strings.HasPrefix(mediaPrefix, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseCharge takes a stored file that is being discarded off the quota usage of the client that transferred it.
+// key is the file DB key of the file
+func (s *TorrxferServer) releaseCharge(key string) {
+	if s.policies == nil || key == "" {
+		return
+	}
+	if err := s.policies.release(key); err != nil {
+		common.LogError(err, "Could not release quota usage")
+	}
+}
+
+// checkPolicy admits a new transfer for the client under the configured policy. Callers must hold the server lock
+func (s *TorrxferServer) checkPolicy(client net.ClientInfo, mediaPrefix string, size uint64) error {
+	if s.policies == nil {
+		return nil
+	}
+	var pending uint64
+	for activeClientID, file := range s.activeFiles {
+		if activeClientID != client.ID && file.owner == client.Identity {
+			pending += file.size
+		}
+	}
+	if err := s.policies.admit(client, mediaPrefix, size, pending); err != nil {
+		log.Info().Err(err).Str("Identity", client.Identity).Str("Media prefix", mediaPrefix).Msg("Rejected by client policy")
+		return err
+	}
+	return nil
+}
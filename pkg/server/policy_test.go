@@ -0,0 +1,89 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// memoryDb is a KvDB kept in memory
+type memoryDb map[string]string
+
+func (m memoryDb) Close()                         {}
+func (m memoryDb) Put(key, value string) error    { m[key] = value; return nil }
+func (m memoryDb) Get(key string) (string, error) { return m[key], nil }
+func (m memoryDb) Delete(key string) error        { delete(m, key); return nil }
+func (m memoryDb) Has(key string) bool            { _, ok := m[key]; return ok }
+func (m memoryDb) Walk(fn func(value string) (string, bool)) error {
+	for key, value := range m {
+		if newValue, keep := fn(value); keep {
+			m[key] = newValue
+		} else {
+			delete(m, key)
+		}
+	}
+	return nil
+}
+
+func TestClientPolicyAdmit(t *testing.T) {
+	p := &clientPolicies{
+		clients: map[string]common.ClientPolicy{
+			"alice":                  {MediaPrefixes: []string{"tv"}, Quota: 100, MaxFileSize: 60},
+			common.DefaultPolicyName: {MediaPrefixes: []string{"public"}},
+		},
+		quotaDb: memoryDb{},
+	}
+	alice := net.ClientInfo{ID: "job", Identity: "alice"}
+	anonymous := net.ClientInfo{ID: "job"}
+	expected := []struct {
+		client      net.ClientInfo
+		mediaPrefix string
+		size        uint64
+		pending     uint64
+		code        codes.Code
+	}{
+		{alice, "tv/Show", 50, 0, codes.OK},
+		{alice, "tvshows", 50, 0, codes.PermissionDenied},
+		{alice, "tv", 70, 0, codes.PermissionDenied},
+		{alice, "tv", 50, 60, codes.ResourceExhausted},
+		{anonymous, "public/files", 1000, 0, codes.OK},
+		{anonymous, "tv", 10, 0, codes.PermissionDenied},
+	}
+	for i, test := range expected {
+		if err := p.admit(test.client, test.mediaPrefix, test.size, test.pending); status.Code(err) != test.code {
+			t.Errorf("Incorrect result for case %d. Expected: %s got %v", i, test.code, err)
+		}
+	}
+
+	if err := p.charge("alice", "hash", 60); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := p.admit(alice, "tv", 50, 0); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected quota to be exhausted after charge, got %v", err)
+	}
+	if err := p.admit(alice, "tv", 40, 0); err != nil {
+		t.Errorf("Expected file within remaining quota to be admitted, got %v", err)
+	}
+	// A file that is transferred again is only charged once, and discarding it gives the space back
+	if err := p.charge("alice", "hash", 60); err != nil {
+		t.Error(err)
+		return
+	}
+	if used := p.usage("alice"); used != 60 {
+		t.Errorf("Expected a file charged twice to count once, got %d", used)
+	}
+	if err := p.release("hash"); err != nil {
+		t.Error(err)
+		return
+	}
+	if used := p.usage("alice"); used != 0 {
+		t.Errorf("Expected released file to free its quota, got %d", used)
+	}
+	if err := p.release("unknown"); err != nil {
+		t.Errorf("Expected releasing a file that was never charged to be ignored, got %v", err)
+	}
+}
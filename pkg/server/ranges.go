@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	errChunkOutOfRange = errors.New("chunk is outside the declared file size")
+	errChunkOverlap    = errors.New("chunk overlaps data already committed")
+)
+
+// byteRange is the half open interval [start, end) of a file
+type byteRange struct {
+	start uint64
+	end   uint64
+}
+
+// byteRanges tracks the regions of a file that have been committed to disk.
+// Ranges are kept sorted and adjacent ranges are merged, so a fully written file is a single range
+type byteRanges []byteRange
+
+// newByteRanges returns the committed ranges of a file whose first prefix bytes are already on disk
+func newByteRanges(prefix uint64) byteRanges {
+	if prefix == 0 {
+		return byteRanges{}
+	}
+	return byteRanges{{0, prefix}}
+}
+
+// check verifies that [start, end) lies within limit and does not overlap any committed range
+func (r byteRanges) check(start, end, limit uint64) error {
+	if end < start || end > limit {
+		return fmt.Errorf("%w: [%d, %d) exceeds %d", errChunkOutOfRange, start, end, limit)
+	}
+	if start == end {
+		return nil
+	}
+	// First range that ends after the chunk starts
+	i := sort.Search(len(r), func(i int) bool { return r[i].end > start })
+	if i < len(r) && r[i].start < end {
+		return fmt.Errorf("%w: [%d, %d) overlaps [%d, %d)", errChunkOverlap, start, end, r[i].start, r[i].end)
+	}
+	return nil
+}
+
+// add commits [start, end) and returns the updated ranges. The range must have passed check
+func (r byteRanges) add(start, end uint64) byteRanges {
+	if start == end {
+		return r
+	}
+	i := sort.Search(len(r), func(i int) bool { return r[i].start > start })
+	r = append(r, byteRange{})
+	copy(r[i+1:], r[i:])
+	r[i] = byteRange{start, end}
+
+	// Coalesce with neighbours that now touch the new range
+	if i+1 < len(r) && r[i].end == r[i+1].start {
+		r[i].end = r[i+1].end
+		r = append(r[:i+1], r[i+2:]...)
+	}
+	if i > 0 && r[i-1].end == r[i].start {
+		r[i-1].end = r[i].end
+		r = append(r[:i], r[i+1:]...)
+	}
+	return r
+}
+
+// total returns the number of bytes committed, including any past gaps
+func (r byteRanges) total() (total uint64) {
+	for _, committed := range r {
+		total += committed.end - committed.start
+	}
+	return total
+}
+
+// contiguous returns the number of bytes committed without gaps from the start of the file
+func (r byteRanges) contiguous() uint64 {
+	if len(r) == 0 || r[0].start != 0 {
+		return 0
+	}
+	return r[0].end
+}
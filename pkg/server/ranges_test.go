@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestByteRangesContiguous(t *testing.T) {
+	r := newByteRanges(0)
+	chunks := []byteRange{{10, 20}, {0, 5}, {30, 40}, {5, 10}, {20, 30}}
+	expected := []uint64{0, 5, 5, 20, 40}
+	for i, chunk := range chunks {
+		if err := r.check(chunk.start, chunk.end, 40); err != nil {
+			t.Error(err)
+			return
+		}
+		r = r.add(chunk.start, chunk.end)
+		if r.contiguous() != expected[i] {
+			t.Errorf("Incorrect contiguous size after chunk %d. Expected: %d got %d", i, expected[i], r.contiguous())
+		}
+	}
+	if len(r) != 1 {
+		t.Errorf("Ranges were not coalesced: %v", r)
+	}
+}
+
+func TestByteRangesTotal(t *testing.T) {
+	r := newByteRanges(10).add(20, 30).add(35, 40)
+	if r.total() != 25 {
+		t.Errorf("Incorrect total. Expected: 25 got %d", r.total())
+	}
+	if r.contiguous() != 10 {
+		t.Errorf("Incorrect contiguous size. Expected: 10 got %d", r.contiguous())
+	}
+}
+
+func TestByteRangesReject(t *testing.T) {
+	r := newByteRanges(10).add(20, 30)
+	if err := r.check(5, 15, 100); !errors.Is(err, errChunkOverlap) {
+		t.Errorf("Expected overlap error with prefix, got %v", err)
+	}
+	if err := r.check(15, 25, 100); !errors.Is(err, errChunkOverlap) {
+		t.Errorf("Expected overlap error with middle range, got %v", err)
+	}
+	if err := r.check(90, 110, 100); !errors.Is(err, errChunkOutOfRange) {
+		t.Errorf("Expected out of range error, got %v", err)
+	}
+	if err := r.check(10, 20, 100); err != nil {
+		t.Errorf("Expected gap to be writable, got %v", err)
+	}
+}
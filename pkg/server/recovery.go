@@ -0,0 +1,144 @@
+package server
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/internal/db"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+// RecoverySummary counts the outcome of reconciling the file DB with the media directory
+type RecoverySummary struct {
+	Scanned   int
+	Complete  int
+	Resumable int
+	Truncated int
+	Reset     int
+	Dropped   int
+}
+
+// MarshalZerologObject implements the zerolog Object Marshaller for logging the summary
+func (r RecoverySummary) MarshalZerologObject(e *zerolog.Event) {
+	e.Int("Scanned", r.Scanned).
+		Int("Complete", r.Complete).
+		Int("Resumable", r.Resumable).
+		Int("Truncated", r.Truncated).
+		Int("Reset", r.Reset).
+		Int("Dropped", r.Dropped)
+}
+
+// Fsck checks every file recorded in the server DB against the media directory. If repair is set, partial files are
+// truncated back to their last verified checkpoint and records for files that no longer exist are dropped.
+// The server must not be running
+func Fsck(serverConf common.ServerConfig, repair bool) (RecoverySummary, error) {
+	fileStorage, err := openStorage(serverConf)
+	if err != nil {
+		return RecoverySummary{}, err
+	}
+	fileDb, err := openFileDb(serverConf, fileStorage)
+	if err != nil {
+		return RecoverySummary{}, err
+	}
+	defer fileDb.Close()
+	return recoverFiles(fileDb, fileStorage, repair)
+}
+
+// recoverFiles walks every record in the file DB and reconciles it with the file on disk
+func recoverFiles(fileDb db.KvDB, fileStorage storage, repair bool) (RecoverySummary, error) {
+	var summary RecoverySummary
+	err := fileDb.Walk(func(value string) (string, bool) {
+		summary.Scanned++
+		file := new(File)
+		if err := file.UnmarshalText([]byte(value)); err != nil {
+			log.Info().Err(err).Msg("Unreadable record")
+			summary.Dropped++
+			return value, !repair
+		}
+		logger := log.With().Str("Name", file.fullPath).Logger()
+
+		// A file at the final path is only this record's once the record is complete. Until then it is the file an
+		// overwrite is replacing, and the transfer is in the staging file. Any staging file next to a complete record
+		// belongs to such a newer transfer
+		_, err := os.Stat(file.fullPath)
+		finalExists := err == nil
+		if finalExists && file.currentSize == file.size {
+			summary.Complete++
+			return value, true
+		}
+		if _, err := os.Stat(file.stagingPath()); err != nil {
+			// The server may have stopped between moving the file out of staging and recording it as complete
+			if finalExists {
+				if size, err := fileStorage.size(file.fullPath); err == nil && size == file.size {
+					summary.Complete++
+					if !repair {
+						return value, true
+					}
+					file.currentSize = file.size
+					file.prefixHash = ""
+					text, err := file.MarshalText()
+					if err != nil {
+						common.LogErrorStack(err, "Could not marshal file data")
+						return value, true
+					}
+					return string(text), true
+				}
+			}
+			logger.Info().Err(err).Msg("File no longer exists")
+			summary.Dropped++
+			return value, !repair
+		}
+		stagedSize, err := fileStorage.size(file.stagingPath())
+		if err != nil {
+			logger.Info().Err(err).Msg("Staged file can not be read")
+			stagedSize = 0
+		}
+
+		// Work out how much of the staged file can be trusted
+		verified := file.currentSize
+		if stagedSize < file.currentSize {
+			logger.Info().Uint64("Size", stagedSize).Uint64("Checkpoint", file.currentSize).Msg("Staged file is shorter than its checkpoint")
+			verified = 0
+		} else if file.prefixHash != "" {
+			hash, err := fileStorage.hashPrefix(file.stagingPath(), file.currentSize)
+			if err != nil || hash != file.prefixHash {
+				logger.Info().Err(err).Uint64("Checkpoint", file.currentSize).Msg("Staged file does not match its checkpoint")
+				verified = 0
+			}
+		}
+
+		switch {
+		case verified == 0 && file.currentSize > 0:
+			summary.Reset++
+		case stagedSize > verified:
+			summary.Truncated++
+		default:
+			summary.Resumable++
+			return value, true
+		}
+		if !repair {
+			return value, true
+		}
+		if err := fileStorage.truncate(file.stagingPath(), verified); err != nil {
+			common.LogErrorStack(err, "Could not truncate staged file")
+			return value, true
+		}
+		if verified != file.currentSize {
+			file.currentSize = verified
+			file.prefixHash = ""
+			text, err := file.MarshalText()
+			if err != nil {
+				common.LogErrorStack(err, "Could not marshal file data")
+				return value, true
+			}
+			return string(text), true
+		}
+		return value, true
+	})
+	if err != nil {
+		common.LogErrorStack(err, "Could not walk file DB")
+		return summary, err
+	}
+	return summary, nil
+}
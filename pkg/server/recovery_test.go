@@ -0,0 +1,65 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverOverwrite(t *testing.T) {
+	dir, err := os.MkdirTemp("", "recovery")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	// A complete file is being overwritten by a new version that is still staged
+	path := filepath.Join(dir, "episode.mkv")
+	replaced := newFile(path, "", 3, storage{})
+	replaced.currentSize = 3
+	replacement := newFile(path, "", 10, storage{})
+	replacement.currentSize = 4
+	// The server stopped after moving this file out of staging, before recording it as complete
+	promoted := newFile(filepath.Join(dir, "film.mkv"), "", 4, storage{})
+	if err := os.WriteFile(promoted.fullPath, []byte("film"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := os.WriteFile(replacement.stagingPath(), []byte("new da"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	fileDb := memoryDb{}
+	for key, file := range map[string]*File{"replaced": replaced, "replacement": replacement, "promoted": promoted} {
+		text, err := file.MarshalText()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fileDb.Put(key, string(text))
+	}
+
+	summary, err := recoverFiles(fileDb, storage{}, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Scanned != 3 || summary.Complete != 2 || summary.Truncated != 1 || summary.Dropped != 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if data, err := os.ReadFile(replacement.stagingPath()); err != nil || string(data) != "new " {
+		t.Errorf("Expected the staged file to be truncated to its checkpoint, got %q: %v", data, err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "old" {
+		t.Errorf("Expected the replaced file to be kept, got %q: %v", data, err)
+	}
+	recovered := new(File)
+	if err := recovered.UnmarshalText([]byte(fileDb["promoted"])); err != nil || recovered.currentSize != 4 {
+		t.Errorf("Expected the promoted file to be recorded as complete, got %+v: %v", recovered, err)
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/juju/fslock"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+var errFileBusy = errors.New("file is being written")
+
+// rekeyFileSuffix marks the copy of a file that is being encrypted with the current key, before it replaces the file
+const rekeyFileSuffix string = ".torrxfer-rekey"
+
+// RekeySummary counts the outcome of encrypting stored data again with the current key
+type RekeySummary struct {
+	Files   int
+	Rekeyed int
+	Blocks  int
+	// Busy files were being written and are left for the next pass
+	Busy int
+	// Sealed files were stored before encryption was enabled and are now encrypted
+	Sealed int
+	// Plain files were stored before encryption was enabled and are left as they are until ENCRYPTION_MIGRATE is set
+	Plain  int
+	Failed int
+}
+
+// MarshalZerologObject implements the zerolog Object Marshaller for logging the summary
+func (r RekeySummary) MarshalZerologObject(e *zerolog.Event) {
+	e.Int("Files", r.Files).
+		Int("Rekeyed", r.Rekeyed).
+		Int("Blocks", r.Blocks).
+		Int("Busy", r.Busy).
+		Int("Sealed", r.Sealed).
+		Int("Plain", r.Plain).
+		Int("Failed", r.Failed)
+}
+
+// watchKeyring encrypts everything stored with an older key again with the current key, then does so again each time
+// the keyring at path is reloaded on SIGHUP, until done is closed. A keyring from the environment is never reloaded
+func (s *TorrxferServer) watchKeyring(path string, done <-chan struct{}) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		summary, err := s.rekey()
+		if err != nil {
+			common.LogError(err, "Could not encrypt stored data with the current key")
+		} else if summary.Plain > 0 {
+			log.Warn().Object("Summary", summary).Msg("Some stored files are not encrypted and are refused. Set ENCRYPTION_MIGRATE to encrypt them")
+		} else if summary.Busy == 0 && summary.Failed == 0 {
+			log.Info().Object("Summary", summary).Str("Key", s.storage.keys.CurrentID()).Msg("All stored data is encrypted with the current key. Older keys can be removed from the keyring")
+		} else {
+			log.Info().Object("Summary", summary).Msg("Some stored data is still encrypted with an older key. Send SIGHUP to try again")
+		}
+		select {
+		case <-done:
+			return
+		case <-hangups:
+		}
+		if path == "" {
+			continue
+		}
+		keys, err := crypto.ReadKeyring(path)
+		if err != nil {
+			common.LogError(err, "Could not reload encryption keyring. Keeping the current keyring")
+			continue
+		}
+		s.storage.keys.Replace(keys)
+		log.Info().Str("Key", keys.CurrentID()).Msg("Reloaded encryption keyring")
+	}
+}
+
+// rekey encrypts everything the server stores with an older key again with the current key: the file DB, the trash
+// entries, and the data of every file the DB and trash know of. Files are copied with the current key and the copy
+// replaces them, so readers never see a file that is partly encrypted again. While migrating, whatever was stored
+// before encryption was enabled is encrypted the same way
+func (s *TorrxferServer) rekey() (RekeySummary, error) {
+	var summary RekeySummary
+	paths := make([]string, 0)
+	// Walking the DB seals every record with the current key
+	err := s.fileDb.Walk(func(value string) (string, bool) {
+		file := new(File)
+		if err := file.UnmarshalText([]byte(value)); err == nil {
+			paths = append(paths, file.fullPath, file.stagingPath())
+		}
+		return value, true
+	})
+	if err != nil {
+		return summary, err
+	}
+	if s.trash != nil {
+		trashed, err := s.trash.rekeyEntries()
+		if err != nil {
+			return summary, err
+		}
+		paths = append(paths, trashed...)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		summary.Files++
+		blocks, plain, err := s.rekeyFile(path)
+		switch {
+		case err == errFileBusy:
+			summary.Busy++
+		case err == crypto.ErrNotSealed:
+			summary.Plain++
+		case err == nil && plain:
+			summary.Sealed++
+		case err != nil:
+			log.Info().Err(err).Str("Name", path).Msg("Could not encrypt file with the current key")
+			summary.Failed++
+		case blocks > 0:
+			summary.Rekeyed++
+			summary.Blocks += blocks
+		}
+	}
+	return summary, nil
+}
+
+// rekeyFile encrypts the file at path with the current key if any of its blocks use an older key, or while migrating if
+// it is not encrypted at all. Returns the number of blocks that used an older key, and whether the file was not
+// encrypted. Returns crypto.ErrNotSealed for files that are not encrypted when not migrating. Staged files that are
+// being written are left alone
+func (s *TorrxferServer) rekeyFile(path string) (int, bool, error) {
+	if strings.HasSuffix(path, partialFileSuffix) {
+		mux := fslock.New(path)
+		if err := mux.TryLock(); err != nil {
+			return 0, false, errFileBusy
+		}
+		defer mux.Unlock()
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, false, err
+	}
+	handle, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	var source storedFile
+	stale, plain := 0, false
+	sealed, err := crypto.OpenSealedFile(handle, s.storage.keys)
+	switch {
+	case errors.Is(err, crypto.ErrNotSealed) && s.storage.migrate:
+		source, plain = plainFile{handle}, true
+	case err != nil:
+		handle.Close()
+		return 0, false, err
+	default:
+		if stale, err = sealed.StaleBlocks(); err != nil || stale == 0 {
+			sealed.Close()
+			return 0, false, err
+		}
+		source = sealed
+	}
+	defer source.Close()
+	size, err := source.Size()
+	if err != nil {
+		return 0, false, err
+	}
+	// A copy left behind by an interrupted rekey is started over
+	tmpPath := path + rekeyFileSuffix
+	os.Remove(tmpPath)
+	if err := s.storage.copyFile(io.NewSectionReader(source, 0, size), tmpPath, size); err != nil {
+		return 0, false, err
+	}
+	// Clients are shown when files were modified, which encrypting them again does not change
+	if err := os.Chtimes(tmpPath, stat.ModTime(), stat.ModTime()); err != nil {
+		os.Remove(tmpPath)
+		return 0, false, err
+	}
+	if err := s.replaceRekeyed(path, tmpPath, stat); err != nil {
+		os.Remove(tmpPath)
+		return 0, false, err
+	}
+	return stale, plain, nil
+}
+
+// replaceRekeyed moves the copy of the file at path encrypted with the current key over it, unless the file was replaced,
+// moved or removed since stat was taken
+func (s *TorrxferServer) replaceRekeyed(path, tmpPath string, stat os.FileInfo) error {
+	s.replaceMux.Lock()
+	defer s.replaceMux.Unlock()
+	if s.trash != nil {
+		s.trash.Lock()
+		defer s.trash.Unlock()
+	}
+	if current, err := os.Stat(path); err != nil || !os.SameFile(current, stat) {
+		return errFileBusy
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// checkPlainEntry returns an error unless text is a trash entry that restores into the media directory
+func (t *trash) checkPlainEntry(text []byte) error {
+	var entry TrashEntry
+	if err := json.Unmarshal(text, &entry); err != nil {
+		return err
+	}
+	return t.checkOriginalPath(entry)
+}
+
+// rekeyEntries seals every trash entry with the current key. Returns the paths of the trashed files
+func (t *trash) rekeyEntries() ([]string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	paths := make([]string, 0)
+	err := filepath.Walk(t.rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == t.rootDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, trashEntrySuffix) {
+			return nil
+		}
+		paths = append(paths, strings.TrimSuffix(path, trashEntrySuffix))
+		text, err := os.ReadFile(path)
+		if err != nil || t.storage.keys.SealedWithCurrent(text) {
+			return nil
+		}
+		if crypto.IsSealed(text) {
+			if text, err = t.storage.openMetadata(text); err != nil {
+				log.Info().Err(err).Str("Path", path).Msg("Could not read trash entry")
+				return nil
+			}
+		} else if !t.storage.migrate {
+			log.Info().Str("Path", path).Msg("Not sealing trash entry that is not encrypted. Set ENCRYPTION_MIGRATE to seal it")
+			return nil
+		} else if err := t.checkPlainEntry(text); err != nil {
+			// Entries written before encryption was enabled are sealed while migrating, as long as they only point
+			// into the media directory
+			log.Info().Err(err).Str("Path", path).Msg("Not sealing trash entry")
+			return nil
+		}
+		if text, err = t.storage.sealMetadata(text); err != nil {
+			return err
+		}
+		tmpPath := path + ".tmp"
+		if err := os.WriteFile(tmpPath, text, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmpPath, path)
+	})
+	return paths, err
+}
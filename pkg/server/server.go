@@ -3,7 +3,6 @@ package server
 import (
 	"errors"
 	"fmt"
-	"io"
 	gnet "net"
 	"os"
 	"os/signal"
@@ -12,15 +11,17 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/juju/fslock"
 	"github.com/rs/zerolog/log"
 	"github.com/sushshring/torrxfer/internal/db"
 	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
 	"github.com/sushshring/torrxfer/pkg/net"
 	pb "github.com/sushshring/torrxfer/rpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
 )
 
 // TorrxferServer server struct
@@ -28,108 +29,333 @@ type TorrxferServer struct {
 	activeFiles   map[string]*File
 	serverRootDir string
 	fileDb        db.KvDB
+	writers       sync.WaitGroup
+	// defaultConflictPolicy applies to media prefixes without an entry in conflictPolicies
+	defaultConflictPolicy common.ConflictPolicy
+	conflictPolicies      map[string]common.ConflictPolicy
+	// checkpointInterval is how often in-progress files are flushed and recorded in the DB
+	checkpointInterval time.Duration
+	// ackInterval is how often in-progress files are flushed and acknowledged to their client
+	ackInterval time.Duration
+	// transferWindow is how much unacknowledged data all clients together may have sent. 0 does not limit clients
+	transferWindow uint64
+	// trash holds files the server replaces or discards. nil if the trash is disabled
+	trash *trash
+	// paths validates and sanitizes the paths clients ask files to be stored at
+	paths pathSanitizer
+	// diskReserve is the free space on the media filesystem that is never promised to transfers
+	diskReserve uint64
+	// policies limits what each client may write. nil if no policy file is configured
+	policies *clientPolicies
+	// pairing exchanges pairing codes for client credentials. nil without TLS
+	pairing *pairing
+	// storage encrypts the files under serverRootDir if encryption at rest is enabled
+	storage storage
+	// audit records the outcome of every query and transfer
+	audit *auditLog
+	// reservedPaths counts the queries that are preparing a file at each path and have not made it active yet
+	reservedPaths map[string]int
+	// replaceMux serializes moving files into and out of place with rekeying them, so a file that was moved while it
+	// was copied is never brought back
+	replaceMux sync.Mutex
 	sync.RWMutex
 }
 
 const (
 	serverDbName string = "sfdb.dat"
+	// minTransferWindow is the least unacknowledged data a client is ever allowed to have sent
+	minTransferWindow uint64 = 1 << 20
+	// slowSyncTime is how long flushing a file may take before its client is asked to slow down
+	slowSyncTime = 500 * time.Millisecond
+	// idleAckTime is how long a client may stop sending before what it sent is acknowledged, when files are not
+	// acknowledged periodically
+	idleAckTime = 500 * time.Millisecond
 )
 
+// TransportConfig describes how the server secures and authenticates connections
+type TransportConfig struct {
+	EnableTLS bool
+	// CertFile and KeyFile hold the server certificate
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables mutual TLS. Clients must present a certificate signed by one of the CAs in the bundle
+	ClientCAFile string
+	// TokenKeyFile enables bearer token authentication. Tokens must be signed with the key in the file
+	TokenKeyFile string
+	// PSKFile secures connections with the pre-shared key in the file instead of certificates. Clients must hold the same
+	// key. Cannot be combined with EnableTLS
+	PSKFile string
+}
+
 // RunServer starts the server
-func RunServer(serverConf common.ServerConfig, enableTLS bool, cafilePath, keyfilePath string) *TorrxferServer {
+func RunServer(serverConf common.ServerConfig, transport TransportConfig) *TorrxferServer {
 	lis, err := gnet.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", serverConf.Port))
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not start server")
 	}
 	var opts []grpc.ServerOption
-	if enableTLS {
-		if cafilePath == "" {
+	var serverPairing *pairing
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	if transport.ClientCAFile != "" && !transport.EnableTLS {
+		log.Fatal().Msg("Client CA file can only be used with TLS")
+	}
+	if transport.PSKFile != "" {
+		if transport.EnableTLS {
+			log.Fatal().Msg("Pre-shared key can not be used with TLS certificates")
+		}
+		passphrase, err := crypto.ReadPSK(transport.PSKFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not read pre-shared key")
+		}
+		identity, err := crypto.DerivePSKIdentity(passphrase)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not derive pre-shared key identity")
+		}
+		opts = []grpc.ServerOption{grpc.Creds(credentials.NewTLS(identity.TLSConfig()))}
+	}
+	if transport.EnableTLS {
+		if transport.CertFile == "" && transport.KeyFile == "" {
+			// Without a certificate of its own the server uses one issued by the built-in CA
+			transport.CertFile, transport.KeyFile, err = crypto.EnsureServerCert(serverConf.CertDirectory(), ServerCertHosts(serverConf), crypto.DefaultCertValidity)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Could not issue server certificate")
+			}
+		}
+		if transport.CertFile == "" {
 			log.Fatal().Msg("CA File must be provided to run with TLS")
 		}
-		if _, err := os.Stat(cafilePath); os.IsNotExist(err) {
+		if _, err := os.Stat(transport.CertFile); os.IsNotExist(err) {
 			log.Fatal().Msg("Valid CA file must be provided to run with TLS")
 		}
-		if keyfilePath == "" {
+		if transport.KeyFile == "" {
 			log.Fatal().Msg("CA File must be provided to run with TLS")
 		}
-		if _, err := os.Stat(keyfilePath); os.IsNotExist(err) {
+		if _, err := os.Stat(transport.KeyFile); os.IsNotExist(err) {
 			log.Fatal().Msg("Valid CA file must be provided to run with TLS")
 		}
-		creds, err := credentials.NewServerTLSFromFile(cafilePath, keyfilePath)
+		certificates, err := newCertificateReloader(transport.CertFile, transport.KeyFile)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to generate credentials")
 		}
-		opts = []grpc.ServerOption{grpc.Creds(creds)}
-
-		// grpc.ChainStreamInterceptor(net.EnsureValidTokenStream)
-		// grpc.ChainUnaryInterceptor(net.EnsureValidToken)
+		tlsConfig, err := serverTLSConfig(certificates, transport.ClientCAFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate credentials")
+		}
+		// Certificates are swapped in place, so short lived certificates can be rotated without a restart
+		go certificates.watch(serverConf.CertReloadInterval, stopWatching)
+		opts = []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}
+		serverPairing = &pairing{
+			codes:         openPairingCodes(serverConf),
+			fingerprint:   certificates.fingerprint,
+			credentialTTL: serverConf.PairCredentialTTL,
+		}
+		if transport.ClientCAFile != "" {
+			// The handshake lets clients without a certificate through so they can pair
+			opts = append(opts,
+				grpc.ChainStreamInterceptor(net.EnsureClientCertificateStream),
+				grpc.ChainUnaryInterceptor(net.EnsureClientCertificate))
+			// Paired clients get a certificate from the built-in CA, which must be in the client CA bundle
+			if _, err := os.Stat(filepath.Join(serverConf.CertDirectory(), crypto.CAKeyFileName)); err == nil {
+				if serverPairing.ca, err = crypto.LoadCA(serverConf.CertDirectory()); err != nil {
+					log.Fatal().Err(err).Msg("Could not load certificate authority")
+				}
+			}
+		}
+	}
+	if transport.TokenKeyFile != "" {
+		// Clients only send tokens over TLS
+		if !transport.EnableTLS && transport.PSKFile == "" {
+			log.Fatal().Msg("Token authentication can only be used with TLS or a pre-shared key")
+		}
+		tokenKey, err := crypto.ReadTokenKey(transport.TokenKeyFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not read token key")
+		}
+		if serverPairing != nil {
+			serverPairing.tokenKey = tokenKey
+		}
+		validator := net.NewTokenValidator(tokenKey)
+		opts = append(opts,
+			grpc.ChainStreamInterceptor(validator.EnsureValidTokenStream),
+			grpc.ChainUnaryInterceptor(validator.EnsureValidToken))
 	}
 
-	var serverDb db.KvDB
-	if serverConf.DbDir == "" {
-		serverDb, err = db.GetDb(serverDbName)
-	} else {
-		serverDb, err = db.GetDb(serverDbName, serverConf.DbDir)
+	fileStorage, err := openStorage(serverConf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not load encryption keyring")
 	}
+	serverDb, err := openFileDb(serverConf, fileStorage)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not initialize db")
 	}
+	// Reconcile transfers that were interrupted while the server was down
+	summary, err := recoverFiles(serverDb, fileStorage, true)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not recover interrupted transfers")
+	}
+	log.Info().Object("Summary", summary).Msg("Recovered file DB")
+	policies, err := openClientPolicies(serverConf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not load client policy file")
+	}
+	var fileTrash *trash
+	if serverConf.Trash {
+		fileTrash = openTrash(serverConf, fileStorage)
+		if err := fileTrash.purge(); err != nil {
+			common.LogError(err, "Could not purge trash")
+		}
+	}
+	audit, err := openAuditLog(serverConf.AuditLogPath())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not open audit log")
+	}
 	grpcServer := grpc.NewServer(opts...)
 	server := &TorrxferServer{
-		activeFiles:   make(map[string]*File),
-		fileDb:        serverDb,
-		serverRootDir: serverConf.SaveDir.Filepath,
+		activeFiles:           make(map[string]*File),
+		fileDb:                serverDb,
+		serverRootDir:         serverConf.SaveDir.Filepath,
+		checkpointInterval:    serverConf.CheckpointInterval,
+		ackInterval:           serverConf.AckInterval,
+		transferWindow:        uint64(serverConf.TransferWindow),
+		defaultConflictPolicy: serverConf.ConflictPolicy,
+		conflictPolicies:      serverConf.ConflictPolicies,
+		trash:                 fileTrash,
+		paths:                 newPathSanitizer(serverConf),
+		diskReserve:           uint64(serverConf.DiskReserve),
+		policies:              policies,
+		pairing:               serverPairing,
+		storage:               fileStorage,
+		audit:                 audit,
 	}
 	rpcserver := net.NewRPCTorrxferServer(server)
 	pb.RegisterRpcTorrxferServerServer(grpcServer, rpcserver)
 	grpc.EnableTracing = true
 	doneChan := server.configureSignals()
+	if fileStorage.keys != nil {
+		// Data left encrypted with an older key is encrypted again while the server runs
+		go server.watchKeyring(serverConf.EncryptionKeyFile, stopWatching)
+	}
 	log.Debug().Msg("Starting server")
 	go grpcServer.Serve(lis)
 	<-doneChan
 	grpcServer.Stop()
-	for activeClient := range server.activeFiles {
-		server.Close(activeClient)
-	}
+	server.closeAll()
 	server.fileDb.Close()
+	server.audit.close()
+	if server.policies != nil {
+		server.policies.close()
+	}
 	return server
 }
 
+// ServerCertHosts returns the names clients are expected to reach the server by
+func ServerCertHosts(serverConf common.ServerConfig) []string {
+	hosts := []string{serverConf.Address}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	hosts = append(hosts, "localhost", "127.0.0.1", "::1")
+	unique := hosts[:0]
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+// openFileDb opens the file DB, encrypted with the keyring of fileStorage if encryption at rest is enabled
+func openFileDb(serverConf common.ServerConfig, fileStorage storage) (db.KvDB, error) {
+	var fileDb db.KvDB
+	var err error
+	if serverConf.DbDir == "" {
+		fileDb, err = db.GetDb(serverDbName)
+	} else {
+		fileDb, err = db.GetDb(serverDbName, serverConf.DbDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fileStorage.sealDb(fileDb), nil
+}
+
+// HelloFunction gRPC Hello implementation. Refuses clients the server shares no protocol version or required
+// parameter with, and returns the server's capabilities
+func (s *TorrxferServer) HelloFunction(client net.ClientInfo, capabilities net.Capabilities) (net.Capabilities, error) {
+	serverCapabilities := s.capabilities()
+	negotiated, err := net.Negotiate(serverCapabilities, capabilities)
+	if err != nil {
+		log.Info().Err(err).Str("Identity", client.Identity).Str("Peer", client.Peer).Msg("Refused incompatible client")
+		return serverCapabilities, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	log.Info().Str("Identity", client.Identity).Str("Peer", client.Peer).Object("Negotiated", negotiated).Msg("Client connected")
+	return serverCapabilities, nil
+}
+
+// capabilities returns the capabilities of the server, with its optional features that are enabled
+func (s *TorrxferServer) capabilities() net.Capabilities {
+	features := make([]string, 0)
+	if s.pairing != nil {
+		features = append(features, net.FeaturePairing)
+	}
+	return net.DefaultCapabilities(features...)
+}
+
 // QueryFunction implementation for gRPC call query file. Returns current file information and sets the file as a target for that connection clientID
-func (s *TorrxferServer) QueryFunction(clientID string, file *net.RPCFile) (*net.RPCFile, error) {
+func (s *TorrxferServer) QueryFunction(client net.ClientInfo, file *net.RPCFile) (*net.RPCFile, error) {
+	record := newAuditRecord(AuditEventQuery, client)
+	record.MediaPath = file.GetMediaPath()
+	record.Name = file.GetFileName()
+	record.Size = file.GetSize()
+	record.Hash = file.GetDataHash()
+	rpcFile, err := s.queryFile(client, file, &record)
+	if err == nil {
+		record.Complete = rpcFile.GetDataHash() == file.GetDataHash()
+	}
+	s.audit.record(record, err)
+	return rpcFile, err
+}
+
+// queryFile looks up file and prepares it to be received. Sets the path the file is stored at in record
+func (s *TorrxferServer) queryFile(client net.ClientInfo, file *net.RPCFile, record *AuditRecord) (*net.RPCFile, error) {
 	// Three cases:
 	// Brand new file
 	if !s.fileDb.Has(file.GetDataHash()) {
 		log.Debug().Str("File name", file.GetFileName()).Msg("File not found in DB")
 
-		// If a file with the name exists, remove it
-		if _, err := os.Stat(s.getFullServerFilePath(file.GetMediaPath(), file.GetFileName())); err == nil {
-			log.Debug().Err(err).Msg("File exists. Removing now")
-			if err := os.Remove(s.getFullServerFilePath(file.GetMediaPath(), file.GetFileName())); err != nil {
-				common.LogErrorStack(err, "File exists but could not remove")
-				return nil, err
-			}
+		fullPath, mediaPrefix, err := s.clientFilePath(file.GetMediaPath(), file.GetFileName())
+		if err != nil {
+			log.Info().Err(err).Str("Client", client.ID).Msg("Rejected file path")
+			return nil, err
+		}
+		// Refuse before anything on disk is touched. Admission is checked again when the file is opened
+		s.RLock()
+		err = s.admitTransfer(client, mediaPrefix, file.GetSize(), file.GetSize())
+		s.RUnlock()
+		if err != nil {
+			return nil, err
 		}
+		// If a different file with the name exists or is being received, the conflict policy decides where the new file
+		// goes. The path stays reserved until the file is active
+		fullPath, err = s.reservePath(fullPath, mediaPrefix)
+		if err != nil {
+			return nil, err
+		}
+		defer s.releasePath(fullPath)
+		record.Path = s.auditPath(fullPath)
 		// Add file to file DB
-		readChan, writeChan := io.Pipe()
 		// Set client's marked file to provided file
-		serverFile := &File{
-			fullPath:     s.getFullServerFilePath(file.GetMediaPath(), file.GetFileName()),
-			mediaPrefix:  file.GetMediaPath(),
-			size:         file.GetSize(),
-			currentSize:  0,
-			creationTime: time.Now(),
-			modifiedTime: time.Now(),
-			writeChannel: writeChan,
-			readChannel:  readChan,
-			errorChannel: make(chan error, 1),
-			doneChannel:  make(chan struct{}, 1),
-			mux:          fslock.Lock{},
-			Cond: sync.Cond{
-				L: &sync.RWMutex{},
-			},
-			RWMutex: sync.RWMutex{},
-			Once:    sync.Once{},
+		serverFile := newFile(fullPath, mediaPrefix, file.GetSize(), s.storage)
+		// Partial data staged for a different version of this file cannot be resumed. The reservation guarantees no
+		// transfer is writing it
+		if _, err := os.Stat(serverFile.stagingPath()); err == nil {
+			if err := s.discardFile(serverFile.stagingPath()); err != nil {
+				common.LogErrorStack(err, "Staged file exists but could not remove")
+				return nil, err
+			}
 		}
 		bytes, err := serverFile.MarshalText()
 		if err != nil {
@@ -137,7 +363,9 @@ func (s *TorrxferServer) QueryFunction(clientID string, file *net.RPCFile) (*net
 			return nil, err
 		}
 		s.fileDb.Put(file.GetDataHash(), string(bytes))
-		s.setActiveFile(clientID, file.GetDataHash(), serverFile)
+		if err := s.setActiveFile(client, file.GetDataHash(), serverFile); err != nil {
+			return nil, err
+		}
 		return serverFile.GenerateRPCFile()
 	}
 
@@ -158,81 +386,161 @@ func (s *TorrxferServer) QueryFunction(clientID string, file *net.RPCFile) (*net
 		return nil, err
 	}
 
-	stat, err := os.Stat(s.getFullServerFilePath(file.GetMediaPath(), file.GetFileName()))
-	var fileSize int64
-	var modifiedTime time.Time
+	// The file may have been stored somewhere other than its requested path to resolve a conflict
+	serverFile := newFile(currentFile.fullPath, currentFile.mediaPrefix, file.GetSize(), s.storage)
+	serverFile.creationTime = file.GetCreationTime()
+	record.Path = s.auditPath(serverFile.fullPath)
+	if stat, err := os.Stat(serverFile.fullPath); err == nil {
+		if serverFile.currentSize, err = s.storage.size(serverFile.fullPath); err != nil {
+			common.LogErrorStack(err, "Could not read file")
+			return nil, err
+		}
+		serverFile.modifiedTime = stat.ModTime()
+		rpcFile, err := serverFile.GenerateRPCFile()
+		if err != nil {
+			common.LogErrorStack(err, "Could not generate rpc representation")
+			return nil, err
+		}
+		// File fully transferred
+		if rpcFile.GetDataHash() == file.GetDataHash() {
+			return rpcFile, nil
+		}
+		log.Debug().Str("Name", serverFile.fullPath).Msg("File on disk does not match DB. Transferring again")
+	}
 
-	if err != nil {
-		log.Debug().Err(err).Msg("Could not stat existing file")
-		fileSize = 0
-		modifiedTime = time.Unix(0, 0)
+	// A new file that is about to replace the staged data keeps it reserved
+	if err := s.claimPath(serverFile.fullPath); err != nil {
+		return nil, err
+	}
+	defer s.releasePath(serverFile.fullPath)
+	// Partially transferred files are resumed from the last checkpoint in the staging area.
+	// Anything written after the checkpoint may not have reached the disk and is discarded when the file is opened
+	serverFile.currentSize = currentFile.currentSize
+	serverFile.prefixHash = currentFile.prefixHash
+	stat, err := os.Stat(serverFile.stagingPath())
+	var stagedSize uint64
+	if err == nil {
+		stagedSize, err = s.storage.size(serverFile.stagingPath())
+	}
+	if err != nil || stagedSize < serverFile.currentSize {
+		log.Debug().Err(err).Str("Name", serverFile.fullPath).Msg("Staged file is missing data. Restarting transfer")
+		serverFile.currentSize = 0
+		serverFile.prefixHash = ""
+		serverFile.modifiedTime = time.Unix(0, 0)
 	} else {
-		fileSize = stat.Size()
-		modifiedTime = stat.ModTime()
-	}
-	readChan, writeChan := io.Pipe()
-	serverFile := &File{
-		fullPath:     s.getFullServerFilePath(file.GetMediaPath(), file.GetFileName()),
-		mediaPrefix:  file.GetMediaPath(),
-		size:         file.GetSize(),
-		currentSize:  uint64(fileSize),
-		creationTime: file.GetCreationTime(),
-		modifiedTime: modifiedTime,
-		writeChannel: writeChan,
-		readChannel:  readChan,
-		errorChannel: make(chan error, 1),
-		doneChannel:  make(chan struct{}, 1),
-		mux:          fslock.Lock{},
-		Cond: sync.Cond{
-			L: &sync.RWMutex{},
-		},
-		RWMutex: sync.RWMutex{},
-		Once:    sync.Once{},
+		serverFile.modifiedTime = stat.ModTime()
+	}
+	if err := s.setActiveFile(client, file.GetDataHash(), serverFile); err != nil {
+		return nil, err
 	}
 	rpcFile, err := serverFile.GenerateRPCFile()
 	if err != nil {
 		common.LogErrorStack(err, "Could not generate rpc representation")
+		serverFile.close()
 		return nil, err
 	}
-	// File not fully transferred
-	if rpcFile.GetDataHash() != file.GetDataHash() {
-		s.setActiveFile(clientID, file.GetDataHash(), serverFile)
-	}
 	return rpcFile, nil
 }
 
 // TransferFunction gRPC TransferFile implementation. Writes the file bytes at the specified offset to the currently active file for the clientID
-func (s *TorrxferServer) TransferFunction(clientID string, fileBytes []byte, blockSize uint32, currentOffset uint64) error {
-	file := s.isFileActive(clientID)
+// A chunk that does not match its checksum is not written, and is rejected with a net.ChunkRejection so the client can
+// send it again
+func (s *TorrxferServer) TransferFunction(client net.ClientInfo, fileBytes []byte, blockSize uint32, currentOffset uint64, checksum uint32) error {
+	file := s.isFileActive(client.ID)
 	if file == nil {
 		err := errors.New("no file active for client")
-		common.LogErrorStack(err, clientID)
+		common.LogErrorStack(err, client.ID)
+		return err
+	}
+	err := s.writeChunk(client, file, fileBytes, blockSize, currentOffset, checksum)
+	var rejection net.ChunkRejection
+	if errors.As(err, &rejection) {
+		log.Warn().Err(err).Str("Name", file.fullPath).Str("Client", client.ID).Msg("Chunk corrupted in transit")
+		return err
+	}
+	if err != nil {
+		file.refuse(err)
 		return err
 	}
-	file.Once.Do(func() {
-		file.currentSize = currentOffset
-		file.Signal()
-	})
-	file.writeChannel.Write(fileBytes)
 	return nil
 }
 
-// Close closes the active file for the clientID
-func (s *TorrxferServer) Close(clientID string) {
+// writeChunk checks a chunk sent by client and writes it to file
+func (s *TorrxferServer) writeChunk(client net.ClientInfo, file *File, fileBytes []byte, blockSize uint32, currentOffset uint64, checksum uint32) error {
+	// The policy was checked for the identity that queried the file
+	if file.owner != client.Identity {
+		return status.Errorf(codes.PermissionDenied, "file was queried by a different client")
+	}
+	if uint32(len(fileBytes)) != blockSize {
+		return status.Errorf(codes.InvalidArgument, "chunk at offset %d has %d bytes but declares %d", currentOffset, len(fileBytes), blockSize)
+	}
+	if blockSize > net.MaxChunkSize {
+		return status.Errorf(codes.InvalidArgument, "chunk at offset %d has %d bytes but at most %d are accepted", currentOffset, blockSize, net.MaxChunkSize)
+	}
+	if actual := net.ChunkChecksum(fileBytes); actual != checksum {
+		return net.ChunkRejection{
+			Offset: currentOffset,
+			Size:   blockSize,
+			Reason: fmt.Sprintf("checksum is %08x but %08x was sent", actual, checksum),
+		}
+	}
+	err := file.writeChunk(fileBytes, currentOffset)
+	switch {
+	case errors.Is(err, errChunkOutOfRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, errChunkOverlap):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, syscall.ENOSPC):
+		return status.Errorf(codes.ResourceExhausted, "server ran out of space writing chunk at offset %d", currentOffset)
+	case err != nil:
+		common.LogErrorStack(err, "Could not write chunk")
+		return err
+	}
+	return nil
+}
+
+// Close closes the active file for the clientID. err is recorded as the reason the transfer stopped early
+func (s *TorrxferServer) Close(clientID string, err error) {
 	file := s.isFileActive(clientID)
 	if file == nil {
 		return
 	}
-	file.writeChannel.Close()
+	if err != nil {
+		file.refuse(err)
+	}
+	file.close()
 }
 
-// RegisterForWriteNotification returns the notification channel for the clientID
-func (s *TorrxferServer) RegisterForWriteNotification(clientID string) (chan error, chan struct{}) {
+// PairFunction gRPC Pair implementation. Exchanges a pairing code created with CreatePairingCode for a client credential
+func (s *TorrxferServer) PairFunction(request net.PairingRequest) (net.PairingCredential, error) {
+	if s.pairing == nil {
+		return net.PairingCredential{}, status.Errorf(codes.FailedPrecondition, "pairing requires TLS")
+	}
+	return s.pairing.pair(request)
+}
+
+// RegisterForWriteNotification returns the notification channels for the clientID
+func (s *TorrxferServer) RegisterForWriteNotification(clientID string) (chan error, chan net.TransferSummary, chan net.TransferAck) {
 	file := s.isFileActive(clientID)
 	if file == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
-	return file.errorChannel, file.doneChannel
+	return file.errorChannel, file.doneChannel, file.ackChannel
+}
+
+// closeAll closes every active file and waits for the writer threads to record them
+func (s *TorrxferServer) closeAll() {
+	s.RLock()
+	files := make([]*File, 0, len(s.activeFiles))
+	for _, file := range s.activeFiles {
+		files = append(files, file)
+	}
+	s.RUnlock()
+
+	for _, file := range files {
+		file.close()
+	}
+	s.writers.Wait()
 }
 
 func (s *TorrxferServer) isFileActive(clientID string) *File {
@@ -257,72 +565,226 @@ func (s *TorrxferServer) configureSignals() chan bool {
 	return done
 }
 
-func (s *TorrxferServer) setActiveFile(clientID string, dbFileKey string, file *File) {
+func (s *TorrxferServer) setActiveFile(client net.ClientInfo, dbFileKey string, file *File) error {
+	file.trash = s.trash
+	file.owner = client.Identity
+	file.started = time.Now()
 	s.Lock()
 	defer s.Unlock()
 
-	s.activeFiles[clientID] = file
+	// Checked while holding the lock so concurrent queries cannot promise the same space or quota twice
+	if err := s.admitTransfer(client, file.mediaPrefix, file.size, file.remaining()); err != nil {
+		return err
+	}
+	if err := file.open(); err != nil {
+		return err
+	}
+	s.activeFiles[client.ID] = file
 	// Start file listener thread
-	go s.startFileWriteThread(file, dbFileKey)
+	s.writers.Add(1)
+	go s.startFileWriteThread(client, file, dbFileKey)
+	return nil
 }
 
-func (s *TorrxferServer) getFullServerFilePath(mediaPath, filename string) string {
-	return filepath.Join(s.serverRootDir, mediaPath, filename)
+// admitTransfer checks a transfer against the client policy and the free space on the media filesystem.
+// Callers must hold the server lock
+func (s *TorrxferServer) admitTransfer(client net.ClientInfo, mediaPrefix string, size, remaining uint64) error {
+	if err := s.checkPolicy(client, mediaPrefix, size); err != nil {
+		return err
+	}
+	return s.admitFile(client.ID, remaining)
 }
 
-func (s *TorrxferServer) startFileWriteThread(serverFile *File, dbFileKey string) {
-	log.Debug().Str("Name", serverFile.fullPath).Msg("Starting writer thread")
-	defer close(serverFile.errorChannel)
-	defer close(serverFile.doneChannel)
-
-	if err := os.MkdirAll(filepath.Dir(serverFile.fullPath), 0755); err != nil {
-		common.LogErrorStack(err, "Could not create file directory structure")
-		serverFile.errorChannel <- err
-		return
-	}
-	fileHandle, err := os.OpenFile(serverFile.fullPath, os.O_CREATE|os.O_RDWR, 0755)
+// admitFile refuses a transfer that needs more space than the media filesystem has left once the bytes promised to
+// other active transfers and the configured reserve are set aside. Sizes are counted as they are stored on disk.
+// Callers must hold the server lock
+func (s *TorrxferServer) admitFile(clientID string, required uint64) error {
+	required = s.storage.diskSize(required)
+	free, err := freeSpace(s.serverRootDir)
 	if err != nil {
-		common.LogErrorStack(err, "Could not open server file for writing")
-		serverFile.errorChannel <- err
-		return
+		log.Debug().Err(err).Msg("Could not check free space. Admitting file")
+		return nil
 	}
-	defer fileHandle.Close()
+	var promised uint64
+	for activeClientID, file := range s.activeFiles {
+		// The client's current file is replaced by the new one
+		if activeClientID != clientID {
+			promised += s.storage.diskSize(file.remaining())
+		}
+	}
+	if required+promised+s.diskReserve > free {
+		log.Info().Str("Client", clientID).Uint64("Required", required).Uint64("Free", free).Uint64("Promised", promised).Msg("Not enough space for file")
+		return status.Errorf(codes.ResourceExhausted, "file needs %d bytes but the server has %d bytes free, %d promised to other transfers and %d reserved",
+			required, free, promised, s.diskReserve)
+	}
+	return nil
+}
 
-	// Lock file on filesystem for writing
-	serverFile.mux.Lock()
-	defer serverFile.mux.Unlock()
+func (s *TorrxferServer) removeActiveFile(clientID string, file *File) {
+	s.Lock()
+	defer s.Unlock()
+
+	// A retried job may have already replaced this file with a new one
+	if s.activeFiles[clientID] == file {
+		delete(s.activeFiles, clientID)
+	}
+}
 
-	// Wait for Transfer func to get called first and set offset
-	serverFile.L.Lock()
-	serverFile.Wait()
-	serverFile.L.Unlock()
+// startFileWriteThread checkpoints the progress of a file at the configured interval until its transfer stream closes,
+// then finalizes the file and records it in the DB. Chunks are written by TransferFunction as they arrive
+func (s *TorrxferServer) startFileWriteThread(client net.ClientInfo, serverFile *File, dbFileKey string) {
+	log.Debug().Str("Name", serverFile.fullPath).Str("Identity", serverFile.owner).Msg("Starting writer thread")
+	defer s.writers.Done()
+	defer s.removeActiveFile(client.ID, serverFile)
+	defer serverFile.release()
+	// Exactly one result is sent on either the error or done channel. Both are buffered so the thread
+	// never blocks if the client has already gone away
 
-	err = func() error {
-		serverFile.RLock()
-		defer serverFile.RUnlock()
-		_, err = fileHandle.Seek(int64(serverFile.currentSize), 0)
-		return err
-	}()
+	var checkpointChannel <-chan time.Time
+	if s.checkpointInterval > 0 {
+		ticker := time.NewTicker(s.checkpointInterval)
+		defer ticker.Stop()
+		checkpointChannel = ticker.C
+	}
+	var ackChannel <-chan time.Time
+	if s.ackInterval > 0 {
+		ticker := time.NewTicker(s.ackInterval)
+		defer ticker.Stop()
+		ackChannel = ticker.C
+	}
+	// A client that stops short of the end of the file and of half its window would otherwise never be told the rest
+	// of what it sent is durable, and waits for that before it closes the transfer
+	var idleChannel <-chan time.Time
+	if s.ackInterval == 0 {
+		ticker := time.NewTicker(idleAckTime)
+		defer ticker.Stop()
+		idleChannel = ticker.C
+	}
+	// The client learns where the transfer resumes from and its window straight away
+	s.acknowledge(serverFile)
+	for closed := false; !closed; {
+		select {
+		case <-serverFile.closeChannel:
+			closed = true
+		case <-checkpointChannel:
+			// A failed checkpoint only means a restart resumes from further back
+			if bytes, err := serverFile.checkpoint(); err == nil {
+				s.fileDb.Put(dbFileKey, string(bytes))
+			}
+		case <-ackChannel:
+			s.acknowledge(serverFile)
+		case <-idleChannel:
+			if serverFile.idle(idleAckTime) {
+				s.acknowledge(serverFile)
+			}
+		case <-serverFile.ackRequests:
+			s.acknowledge(serverFile)
+		}
+	}
+
+	bytes, err := serverFile.checkpoint()
 	if err != nil {
-		common.LogErrorStack(err, "Could not seek file to specified location")
+		s.auditTransfer(client, serverFile, err)
 		serverFile.errorChannel <- err
 		return
 	}
+	summary := net.TransferSummary{
+		BytesWritten: serverFile.bytesWritten,
+		SizeOnDisk:   serverFile.currentSize,
+		DataHash:     serverFile.prefixHash,
+	}
+	if serverFile.currentSize == serverFile.size {
+		if summary.DataHash != dbFileKey {
+			log.Error().Str("Name", serverFile.fullPath).Str("Expected", dbFileKey).Str("Actual", summary.DataHash).Msg("Staged file does not match declared hash. Discarding")
+			// The staged data is unusable, so let the client restart the transfer from scratch.
+			// Report the mismatch so the client can retry
+			if err := s.discardFile(serverFile.stagingPath()); err != nil {
+				common.LogError(err, "Could not discard staged file")
+			}
+			s.fileDb.Delete(dbFileKey)
+			s.auditTransfer(client, serverFile, status.Errorf(codes.DataLoss, "received data hashes to %s but %s was declared", summary.DataHash, dbFileKey))
+			serverFile.doneChannel <- summary
+			return
+		}
+		if err := s.promoteFile(serverFile); err != nil {
+			s.auditTransfer(client, serverFile, err)
+			serverFile.errorChannel <- err
+			return
+		}
+		if s.policies != nil {
+			if err := s.policies.charge(serverFile.owner, dbFileKey, serverFile.size); err != nil {
+				common.LogError(err, "Could not record quota usage")
+			}
+		}
+	}
+	s.fileDb.Put(dbFileKey, string(bytes))
+	s.auditTransfer(client, serverFile, nil)
+	//  File transfer is closed (may be complete or not)
+	serverFile.doneChannel <- summary
+}
 
-	n, err := io.Copy(fileHandle, serverFile.readChannel)
+// acknowledge flushes serverFile and tells its client how much of it is durable and how much more it may send
+func (s *TorrxferServer) acknowledge(serverFile *File) {
+	started := time.Now()
+	offset, err := serverFile.sync()
 	if err != nil {
-		common.LogErrorStack(err, "Write failed")
-		serverFile.errorChannel <- err
+		// The final checkpoint reports the failure once the transfer closes
+		log.Debug().Err(err).Str("Name", serverFile.fullPath).Msg("Could not flush file to acknowledge it")
 		return
 	}
-	serverFile.currentSize += uint64(n)
-	bytes, err := serverFile.MarshalText()
+	serverFile.RLock()
+	previous := serverFile.window
+	serverFile.RUnlock()
+	serverFile.acknowledge(offset, s.flowWindow(previous, time.Since(started)))
+}
+
+// flowWindow returns how much unacknowledged data a client may have sent, given its previous window and how long it
+// took to flush its file. Clients share the transfer window equally. A client is asked to slow down while its file
+// takes longer than slowSyncTime to flush, as the disk is not keeping up, and speeds back up to its share otherwise
+func (s *TorrxferServer) flowWindow(previous uint64, syncTime time.Duration) uint64 {
+	if s.transferWindow == 0 {
+		return 0
+	}
+	s.RLock()
+	active := uint64(len(s.activeFiles))
+	s.RUnlock()
+	if active == 0 {
+		active = 1
+	}
+	share := s.transferWindow / active
+	window := share
+	if previous > 0 {
+		if syncTime > slowSyncTime {
+			window = previous / 2
+		} else {
+			window = previous * 2
+		}
+	}
+	if window > share {
+		window = share
+	}
+	if window < minTransferWindow {
+		window = minTransferWindow
+	}
+	return window
+}
+
+// promoteFile moves a fully received and verified staged file into its final location
+func (s *TorrxferServer) promoteFile(serverFile *File) error {
+	// A different file left at the final path is being replaced
+	if _, err := os.Stat(serverFile.fullPath); err == nil {
+		if err := s.discardFile(serverFile.fullPath); err != nil {
+			common.LogErrorStack(err, "Could not move replaced file to trash")
+			return err
+		}
+	}
+	s.replaceMux.Lock()
+	err := os.Rename(serverFile.stagingPath(), serverFile.fullPath)
+	s.replaceMux.Unlock()
 	if err != nil {
-		common.LogErrorStack(err, "Could not marshal file data")
-		serverFile.errorChannel <- err
-		return
+		common.LogErrorStack(err, "Could not move staged file to final location")
+		return err
 	}
-	s.fileDb.Put(dbFileKey, string(bytes))
-	//  File transfer is closed (may be complete or not)
-	serverFile.doneChannel <- struct{}{}
+	log.Debug().Str("Name", serverFile.fullPath).Msg("File verified and moved out of staging")
+	return nil
 }
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sushshring/torrxfer/pkg/net"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFlowWindow(t *testing.T) {
+	s := &TorrxferServer{activeFiles: map[string]*File{"a": nil, "b": nil}, transferWindow: 64 << 20}
+	if window := s.flowWindow(0, 0); window != 32<<20 {
+		t.Errorf("Expected a new client to get its share of the window, got %d", window)
+	}
+	if window := s.flowWindow(32<<20, time.Second); window != 16<<20 {
+		t.Errorf("Expected a client with a slow disk to be slowed down, got %d", window)
+	}
+	if window := s.flowWindow(16<<20, 0); window != 32<<20 {
+		t.Errorf("Expected a client to speed back up, got %d", window)
+	}
+	if window := s.flowWindow(32<<20, 0); window != 32<<20 {
+		t.Errorf("Expected a client to never exceed its share, got %d", window)
+	}
+	if window := s.flowWindow(minTransferWindow, time.Second); window != minTransferWindow {
+		t.Errorf("Expected a client to always be allowed the minimum window, got %d", window)
+	}
+	if window := (&TorrxferServer{}).flowWindow(0, 0); window != 0 {
+		t.Errorf("Expected no window without a transfer window, got %d", window)
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	s := &TorrxferServer{activeFiles: make(map[string]*File), transferWindow: 4 << 20}
+	file := newFile(filepath.Join(t.TempDir(), "episode.mkv"), "tv", 8<<20, storage{})
+	if err := file.open(); err != nil {
+		t.Error(err)
+		return
+	}
+	defer file.release()
+
+	s.acknowledge(file)
+	if ack := <-file.ackChannel; ack.CommittedOffset != 0 || ack.Window != 4<<20 {
+		t.Errorf("Unexpected first acknowledgement %+v", ack)
+	}
+	// Writing half the window asks for an acknowledgement straight away
+	if err := file.writeChunk(make([]byte, 2<<20), 0); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case <-file.ackRequests:
+	default:
+		t.Errorf("Expected an acknowledgement to be requested")
+	}
+	// Only the latest acknowledgement is kept for the client
+	s.acknowledge(file)
+	s.acknowledge(file)
+	if ack := <-file.ackChannel; ack.CommittedOffset != 2<<20 {
+		t.Errorf("Unexpected acknowledgement %+v", ack)
+	}
+	select {
+	case ack := <-file.ackChannel:
+		t.Errorf("Expected only the latest acknowledgement, got %+v", ack)
+	default:
+	}
+}
+
+func TestHelloFunction(t *testing.T) {
+	s := &TorrxferServer{}
+	capabilities, err := s.HelloFunction(net.ClientInfo{ID: "connection"}, net.DefaultCapabilities(net.FeaturePairing))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// Pairing is only offered with TLS
+	if capabilities.ProtocolVersion != net.ProtocolVersion || len(capabilities.Features) != 0 {
+		t.Errorf("Unexpected server capabilities %+v", capabilities)
+	}
+	old := net.DefaultCapabilities()
+	old.ProtocolVersion, old.MinProtocolVersion = 1, 1
+	if _, err := s.HelloFunction(net.ClientInfo{ID: "connection"}, old); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected an old client to be refused, got %v", err)
+	}
+}
+
+func TestChunkChecksum(t *testing.T) {
+	s := &TorrxferServer{activeFiles: make(map[string]*File)}
+	client := net.ClientInfo{ID: "connection", Identity: "alice"}
+	file := newFile(filepath.Join(t.TempDir(), "episode.mkv"), "tv", 8, storage{})
+	file.owner = client.Identity
+	if err := file.open(); err != nil {
+		t.Error(err)
+		return
+	}
+	defer file.release()
+	s.activeFiles[client.ID] = file
+
+	data := []byte("episode!")
+	err := s.TransferFunction(client, data[4:], 4, 4, net.ChunkChecksum([]byte("corrupt")))
+	var rejection net.ChunkRejection
+	if !errors.As(err, &rejection) || rejection.Offset != 4 || rejection.Size != 4 {
+		t.Errorf("Expected the chunk at offset 4 to be rejected, got %v", err)
+		return
+	}
+	// The transfer goes on without the rejected chunk
+	if file.transferErr != nil || file.committed.total() != 0 {
+		t.Errorf("Expected nothing to be written or refused, got %v and %d bytes", file.transferErr, file.committed.total())
+	}
+	if err := s.TransferFunction(client, data[:4], 4, 0, net.ChunkChecksum(data[:4])); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := s.TransferFunction(client, data[4:], 4, 4, net.ChunkChecksum(data[4:])); err != nil {
+		t.Error(err)
+		return
+	}
+	if file.currentSize != 8 {
+		t.Errorf("Expected the chunk sent again to complete the file, got %d bytes", file.currentSize)
+	}
+	// The client is told straight away that the whole file is written
+	select {
+	case <-file.ackRequests:
+	default:
+		t.Errorf("Expected an acknowledgement to be requested once the file is complete")
+	}
+}
+
+func TestIdleAcknowledge(t *testing.T) {
+	s := &TorrxferServer{fileDb: memoryDb{}, activeFiles: make(map[string]*File)}
+	client := net.ClientInfo{ID: "connection", Identity: "alice"}
+	file := newFile(filepath.Join(t.TempDir(), "episode.mkv"), "tv", 8, storage{})
+	if err := s.setActiveFile(client, "hash", file); err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.writers.Wait()
+	defer file.close()
+	if ack := <-file.ackChannel; ack.CommittedOffset != 0 {
+		t.Errorf("Unexpected first acknowledgement %+v", ack)
+	}
+
+	// Without periodic acknowledgements or a window, a client that stops short of the end of the file is still told
+	// what it sent is durable
+	if err := file.writeChunk([]byte("epis"), 0); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case ack := <-file.ackChannel:
+		if ack.CommittedOffset != 4 {
+			t.Errorf("Unexpected acknowledgement %+v", ack)
+		}
+	case <-time.After(10 * idleAckTime):
+		t.Errorf("Expected the client to be acknowledged once it stopped sending")
+	}
+}
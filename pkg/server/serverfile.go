@@ -1,9 +1,13 @@
 package server
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -11,11 +15,17 @@ import (
 
 	"github.com/juju/fslock"
 	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
 	"github.com/sushshring/torrxfer/pkg/net"
 )
 
 const delimiter string = "*?*"
 
+// partialFileSuffix marks hidden files that are still being received by the server
+const partialFileSuffix string = ".torrxfer-partial"
+
+var errFileClosed = errors.New("file is not open for writing")
+
 // File server representation of a file
 type File struct {
 	fullPath     string
@@ -24,15 +34,56 @@ type File struct {
 	currentSize  uint64
 	creationTime time.Time
 	modifiedTime time.Time
+	// prefixHash is the hash of the first currentSize bytes as of the last checkpoint
+	prefixHash string
 
-	writeChannel *io.PipeWriter
-	readChannel  io.Reader
+	handle       storedFile
+	committed    byteRanges
+	bytesWritten uint64
+	hasher       hash.Hash
+	hashedSize   uint64
+	closed       bool
+	closeChannel chan struct{}
 	errorChannel chan error
-	doneChannel  chan struct{}
-	mux          fslock.Lock
-	sync.Cond
+	doneChannel  chan net.TransferSummary
+	// ackChannel holds the latest acknowledgement for the client. ackRequests asks the writer thread to acknowledge
+	// early, once the client has used up half its window
+	ackChannel  chan net.TransferAck
+	ackRequests chan struct{}
+	// ackedSize and window are what the client was last told
+	ackedSize uint64
+	window    uint64
+	mux       *fslock.Lock
+	// trash receives data discarded when a transfer restarts. nil if the trash is disabled
+	trash *trash
+	// owner is the identity of the client transferring the file
+	owner string
+	// started is when the transfer of the file was set up
+	started time.Time
+	// transferErr is the first error that stopped the transfer early
+	transferErr error
+	// storage encrypts the file data if encryption at rest is enabled
+	storage storage
 	sync.RWMutex
-	sync.Once
+}
+
+// newFile creates the server representation of a file that is about to be received
+func newFile(fullPath, mediaPrefix string, size uint64, fileStorage storage) *File {
+	return &File{
+		storage:      fileStorage,
+		fullPath:     fullPath,
+		mediaPrefix:  mediaPrefix,
+		size:         size,
+		currentSize:  0,
+		creationTime: time.Now(),
+		modifiedTime: time.Now(),
+		closeChannel: make(chan struct{}),
+		errorChannel: make(chan error, 1),
+		doneChannel:  make(chan net.TransferSummary, 1),
+		ackChannel:   make(chan net.TransferAck, 1),
+		ackRequests:  make(chan struct{}, 1),
+		RWMutex:      sync.RWMutex{},
+	}
 }
 
 func (f *File) getStrings() (stringReprs []string) {
@@ -60,7 +111,9 @@ func (f *File) getStrings() (stringReprs []string) {
 		delimiter,
 		string(creationTime),
 		delimiter,
-		string(modifiedTime))
+		string(modifiedTime),
+		delimiter,
+		f.prefixHash)
 	return stringReprs
 }
 
@@ -91,7 +144,8 @@ func (f *File) UnmarshalText(text []byte) error {
 	var size, currentSize uint64
 	textString := string(text)
 	tokens := strings.Split(textString, delimiter)
-	if len(tokens) != 6 {
+	// Records written before checkpoints were introduced have no prefix hash
+	if len(tokens) != 6 && len(tokens) != 7 {
 		err := errors.New("not enough tokens in provided text")
 		log.Error().Strs("tokens", tokens).Msg("Error while unmarshalling")
 		return err
@@ -109,8 +163,8 @@ func (f *File) UnmarshalText(text []byte) error {
 		return err
 	}
 	f.currentSize = currentSize
-	modifiedTime = tokens[4]
-	creationTime = tokens[5]
+	creationTime = tokens[4]
+	modifiedTime = tokens[5]
 	f.modifiedTime = time.Time{}
 	if err := f.modifiedTime.UnmarshalText([]byte(strings.TrimSpace(modifiedTime))); err != nil {
 		return err
@@ -119,15 +173,229 @@ func (f *File) UnmarshalText(text []byte) error {
 	if err := f.creationTime.UnmarshalText([]byte(strings.TrimSpace(creationTime))); err != nil {
 		return err
 	}
+	f.prefixHash = ""
+	if len(tokens) == 7 {
+		f.prefixHash = strings.TrimSpace(tokens[6])
+	}
 	return nil
 }
 
+// stagingPath returns the hidden path the file is written to until the transfer is complete and verified
+func (f *File) stagingPath() string {
+	return stagingPathFor(f.fullPath)
+}
+
+func stagingPathFor(fullPath string) string {
+	return filepath.Join(filepath.Dir(fullPath), "."+filepath.Base(fullPath)+partialFileSuffix)
+}
+
+// currentPath returns the final path if the file has been moved out of staging, and the staging path otherwise
+func (f *File) currentPath() string {
+	if _, err := os.Stat(f.fullPath); err == nil {
+		return f.fullPath
+	}
+	return f.stagingPath()
+}
+
 // GenerateRPCFile returns common RPC representation of a server file
+// A file that is still staged is described by its partial contents under its final name
 func (f *File) GenerateRPCFile() (*net.RPCFile, error) {
-	rpcFile, err := net.NewFile(f.fullPath)
+	return f.storage.rpcFile(f.currentPath(), filepath.Base(f.fullPath), f.mediaPrefix)
+}
+
+// open prepares the staging file for positional writes. Only one transfer can have a file open at a time
+func (f *File) open() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(f.fullPath), 0755); err != nil {
+		common.LogErrorStack(err, "Could not create file directory structure")
+		return err
+	}
+	// Data is staged in a hidden file until the transfer is complete so consumers of the media directory never see partial files
+	handle, err := f.storage.open(f.stagingPath(), os.O_CREATE|os.O_RDWR)
 	if err != nil {
+		common.LogErrorStack(err, "Could not open server file for writing")
+		return err
+	}
+	// Lock file on filesystem for writing
+	mux := fslock.New(f.stagingPath())
+	if err := mux.TryLock(); err != nil {
+		handle.Close()
+		log.Debug().Err(err).Str("Name", f.fullPath).Msg("File is already being written")
+		return err
+	}
+	// Anything past the committed prefix was never accounted for and cannot be trusted
+	if err := handle.Truncate(int64(f.currentSize)); err != nil {
+		mux.Unlock()
+		handle.Close()
+		common.LogErrorStack(err, "Could not truncate staged file")
+		return err
+	}
+	f.handle = handle
+	f.mux = mux
+	f.committed = newByteRanges(f.currentSize)
+	return nil
+}
+
+// writeChunk writes data at offset with a positional write and commits that range of the file.
+// Chunks that overlap committed data or fall outside the declared file size are rejected
+func (f *File) writeChunk(data []byte, offset uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.handle == nil || f.closed {
+		return errFileClosed
+	}
+	// A transfer that starts over from the beginning could not verify the data already on the server. Discard it
+	if offset == 0 && f.bytesWritten == 0 && f.committed.contiguous() > 0 {
+		log.Debug().Str("Name", f.fullPath).Uint64("Discarded", f.committed.contiguous()).Msg("Transfer restarted from the beginning")
+		if f.trash != nil {
+			discarded := int64(f.committed.contiguous())
+			if _, err := f.trash.addCopy(io.NewSectionReader(f.handle, 0, discarded), f.stagingPath(), discarded); err != nil {
+				return err
+			}
+		}
+		if err := f.handle.Truncate(0); err != nil {
+			return err
+		}
+		f.committed = newByteRanges(0)
+		f.currentSize = 0
+		f.prefixHash = ""
+		f.hasher = nil
+		f.hashedSize = 0
+	}
+	end := offset + uint64(len(data))
+	if err := f.committed.check(offset, end, f.size); err != nil {
+		return err
+	}
+	if _, err := f.handle.WriteAt(data, int64(offset)); err != nil {
+		return err
+	}
+	f.committed = f.committed.add(offset, end)
+	f.currentSize = f.committed.contiguous()
+	f.bytesWritten += uint64(len(data))
+	f.modifiedTime = time.Now()
+	// The client also waits for the whole file to be acknowledged before it finishes, in case any chunk is rejected
+	if (f.window > 0 && f.currentSize >= f.ackedSize+f.window/2) || f.currentSize == f.size {
+		select {
+		case f.ackRequests <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// sync flushes the staged data to disk. Returns how much of the start of the file is now durable
+func (f *File) sync() (uint64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.handle == nil {
+		return 0, errFileClosed
+	}
+	if err := f.handle.Sync(); err != nil {
+		return 0, err
+	}
+	return f.currentSize, nil
+}
+
+// idle reports whether data was written since the client was last acknowledged, but nothing for at least d
+func (f *File) idle(d time.Duration) bool {
+	f.RLock()
+	defer f.RUnlock()
+
+	return f.currentSize > f.ackedSize && time.Since(f.modifiedTime) >= d
+}
+
+// acknowledge tells the client that the first offset bytes are durable and how far past them it may send. Only the
+// latest acknowledgement is kept for a client that has not read the previous one yet
+func (f *File) acknowledge(offset, window uint64) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.ackedSize = offset
+	f.window = window
+	select {
+	case <-f.ackChannel:
+	default:
+	}
+	f.ackChannel <- net.TransferAck{CommittedOffset: offset, Window: window}
+}
+
+// checkpoint flushes the staged data to disk and advances the rolling hash over the committed prefix.
+// Returns the DB record describing the durable state of the file
+func (f *File) checkpoint() ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.handle == nil {
+		return nil, errFileClosed
+	}
+	if err := f.handle.Sync(); err != nil {
+		common.LogErrorStack(err, "Could not flush staged file")
+		return nil, err
+	}
+	if f.hasher == nil || f.hashedSize > f.currentSize {
+		f.hasher = sha256.New()
+		f.hashedSize = 0
+	}
+	// Only the bytes committed since the last checkpoint need to be read back
+	if _, err := io.Copy(f.hasher, io.NewSectionReader(f.handle, int64(f.hashedSize), int64(f.currentSize-f.hashedSize))); err != nil {
+		common.LogErrorStack(err, "Could not hash staged file")
 		return nil, err
 	}
-	rpcFile.SetMediaPath(f.mediaPrefix)
-	return rpcFile, nil
+	f.hashedSize = f.currentSize
+	f.prefixHash = fmt.Sprintf("%x", f.hasher.Sum(nil))
+	return f.MarshalText()
+}
+
+// remaining returns how many more bytes the file needs on disk to be complete
+func (f *File) remaining() uint64 {
+	f.RLock()
+	defer f.RUnlock()
+
+	written := f.currentSize
+	if f.committed != nil {
+		written = f.committed.total()
+	}
+	if written >= f.size {
+		return 0
+	}
+	return f.size - written
+}
+
+// refuse records err as the reason the transfer stopped early, unless an earlier error already did
+func (f *File) refuse(err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.transferErr == nil {
+		f.transferErr = err
+	}
+}
+
+// close stops accepting chunks and signals the writer thread to finalize the file
+func (f *File) close() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.closed = true
+	close(f.closeChannel)
+}
+
+// release closes the staging file handle and drops the filesystem lock
+func (f *File) release() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.handle == nil {
+		return
+	}
+	f.handle.Close()
+	f.handle = nil
+	f.mux.Unlock()
 }
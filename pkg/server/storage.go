@@ -0,0 +1,278 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sushshring/torrxfer/internal/db"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+	"github.com/sushshring/torrxfer/pkg/net"
+)
+
+var (
+	// errUnsealedMetadata is returned for metadata that should be sealed but is not
+	errUnsealedMetadata = errors.New("metadata is not sealed")
+	// errUnsealedFile is returned for a file that should be encrypted but is not
+	errUnsealedFile = errors.New("file is not encrypted")
+)
+
+// storedFile is a file under the media directory, read and written by position
+type storedFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	// Size returns the size of the data in the file, which differs from the size on disk for encrypted files
+	Size() (int64, error)
+	Sync() error
+	Close() error
+}
+
+// storage reads and writes the file data the server keeps under the media directory. With a keyring, new files are
+// encrypted as they are written and every file is decrypted as it is read back. Files written before encryption was
+// enabled are never written to, and are only read while migrating until rekey encrypts them. The zero value stores
+// files as they are
+type storage struct {
+	keys *crypto.Keyring
+	// migrate reads files and DB records that were stored before encryption was enabled
+	migrate bool
+}
+
+// plainFile is a file stored as it is
+type plainFile struct {
+	*os.File
+}
+
+func (f plainFile) Size() (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// loadKeyring returns the keyring configured for encryption at rest, or nil if it is not enabled
+func loadKeyring(serverConf common.ServerConfig) (*crypto.Keyring, error) {
+	switch {
+	case serverConf.EncryptionKeyFile != "" && serverConf.EncryptionKey != "":
+		return nil, errors.New("only one of ENCRYPTION_KEY_FILE and ENCRYPTION_KEY can be set")
+	case serverConf.EncryptionKeyFile != "":
+		return crypto.ReadKeyring(serverConf.EncryptionKeyFile)
+	case serverConf.EncryptionKey != "":
+		return crypto.ParseKeyring(serverConf.EncryptionKey)
+	}
+	return nil, nil
+}
+
+// openStorage returns the storage for the media directory of serverConf
+func openStorage(serverConf common.ServerConfig) (storage, error) {
+	keys, err := loadKeyring(serverConf)
+	if err != nil {
+		return storage{}, err
+	}
+	return storage{keys: keys, migrate: serverConf.EncryptionMigrate}, nil
+}
+
+// sealDb encrypts the values of fileDb if encryption at rest is enabled
+func (s storage) sealDb(fileDb db.KvDB) db.KvDB {
+	if s.keys == nil {
+		return fileDb
+	}
+	return db.NewSealedDb(fileDb, s.keys, s.migrate)
+}
+
+// open opens the file at path with flag, as os.OpenFile does
+func (s storage) open(path string, flag int) (storedFile, error) {
+	handle, err := os.OpenFile(path, flag, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if s.keys == nil {
+		return plainFile{handle}, nil
+	}
+	sealed, err := crypto.OpenSealedFile(handle, s.keys)
+	if errors.Is(err, crypto.ErrNotSealed) {
+		if err = s.checkPlainFile(handle, flag); err == nil {
+			return plainFile{handle}, nil
+		}
+	}
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// checkPlainFile returns errUnsealedFile unless the file that is not encrypted may be used as it is. Empty files opened
+// read only are as empty as they would be if they were encrypted. Other files are only read while migrating, and never
+// written to in the clear
+func (s storage) checkPlainFile(handle *os.File, flag int) error {
+	stat, err := handle.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 || (s.migrate && flag&(os.O_WRONLY|os.O_RDWR) == 0) {
+		return nil
+	}
+	return errUnsealedFile
+}
+
+// size returns the size of the data in the file at path
+func (s storage) size(path string) (uint64, error) {
+	file, err := s.open(path, os.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	return uint64(size), err
+}
+
+// diskSize returns how much space size bytes of data take up on disk once stored. Encrypted files carry a header and
+// a nonce and tag for every block
+func (s storage) diskSize(size uint64) uint64 {
+	if s.keys == nil {
+		return size
+	}
+	return uint64(crypto.SealedFileSize(int64(size)))
+}
+
+// hash returns the hash of the data in the file at path
+func (s storage) hash(path string) (string, error) {
+	file, err := s.open(path, os.O_RDONLY)
+	if err != nil {
+		common.LogError(err, "Could not open hashfile")
+		return "", err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return "", err
+	}
+	return crypto.HashReader(io.NewSectionReader(file, 0, size))
+}
+
+// hashPrefix returns the hash of the first size bytes of the data in the file at path
+func (s storage) hashPrefix(path string, size uint64) (string, error) {
+	file, err := s.open(path, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return crypto.HashReader(io.NewSectionReader(file, 0, int64(size)))
+}
+
+// truncate changes the size of the data in the file at path
+func (s storage) truncate(path string, size uint64) error {
+	file, err := s.open(path, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(int64(size)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// copyFile writes the first size bytes of r to a new file at path
+func (s storage) copyFile(r io.Reader, path string, size int64) error {
+	file, err := s.open(path, os.O_CREATE|os.O_EXCL|os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(&appendWriter{file: file}, r, size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// appendWriter writes to the end of what it has written to file so far
+type appendWriter struct {
+	file   io.WriterAt
+	offset int64
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// rpcFile describes the data in the file at path under name. A file that does not exist is described as empty
+func (s storage) rpcFile(path, name, mediaPrefix string) (*net.RPCFile, error) {
+	var size uint64
+	var hash string
+	modTime := time.Unix(0, 0)
+	stat, err := os.Stat(path)
+	if err == nil {
+		if hash, err = s.hash(path); err != nil {
+			return nil, err
+		}
+		if size, err = s.size(path); err != nil {
+			return nil, err
+		}
+		modTime = stat.ModTime()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	rpcFile := net.NewFileFromData(name, size, hash, modTime)
+	rpcFile.SetMediaPath(mediaPrefix)
+	return rpcFile, nil
+}
+
+// sealMetadata encrypts metadata the server writes next to files, such as trash entries
+func (s storage) sealMetadata(text []byte) ([]byte, error) {
+	if s.keys == nil {
+		return text, nil
+	}
+	return s.keys.Seal(text)
+}
+
+// openMetadata returns the plaintext of metadata written by sealMetadata. With a keyring, metadata that is not sealed
+// is refused, as anyone who can write next to the files could have written it
+func (s storage) openMetadata(text []byte) ([]byte, error) {
+	if !crypto.IsSealed(text) {
+		if s.keys != nil {
+			return nil, errUnsealedMetadata
+		}
+		return text, nil
+	}
+	if s.keys == nil {
+		return nil, crypto.ErrUnknownKey
+	}
+	return s.keys.Open(text)
+}
+
+// Export writes the data of the file at path under the media directory to out, decrypting it if it is encrypted
+func Export(serverConf common.ServerConfig, path string, out io.Writer) error {
+	s, err := openStorage(serverConf)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(serverConf.SaveDir.Filepath, path)
+	}
+	if relativePath, err := filepath.Rel(serverConf.SaveDir.Filepath, path); err != nil || strings.HasPrefix(relativePath, "..") {
+		return errors.New("path is not in the media directory")
+	}
+	file, err := s.open(path, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(file, 0, size))
+	return err
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sushshring/torrxfer/internal/db"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+func newTestKeyring(t *testing.T, keys ...string) *crypto.Keyring {
+	keyring, err := crypto.ParseKeyring(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// writeTestFile receives data into a new staged file at path and checkpoints it
+func writeTestFile(t *testing.T, path string, data []byte, fileStorage storage) *File {
+	file := newFile(path, "tv", uint64(len(data)), fileStorage)
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer file.release()
+	for offset := 0; offset < len(data); offset += 1024 {
+		end := offset + 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := file.writeChunk(data[offset:end], uint64(offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := file.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir := t.TempDir()
+	fileStorage := storage{keys: newTestKeyring(t, strings.Repeat("01", 32))}
+	data := bytes.Repeat([]byte("episode data "), 1000)
+	expectedHash := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	file := writeTestFile(t, filepath.Join(dir, "tv", "episode.mkv"), data, fileStorage)
+	if file.prefixHash != expectedHash {
+		t.Errorf("Checkpoint hash is %s, expected %s", file.prefixHash, expectedHash)
+	}
+	raw, err := os.ReadFile(file.stagingPath())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if bytes.Contains(raw, []byte("episode data")) {
+		t.Errorf("Staged data is stored in the clear")
+	}
+	rpcFile, err := file.GenerateRPCFile()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if rpcFile.GetDataHash() != expectedHash || rpcFile.GetSize() != uint64(len(data)) {
+		t.Errorf("Expected file to be described by its plaintext, got %d bytes hashing to %s", rpcFile.GetSize(), rpcFile.GetDataHash())
+	}
+
+	// Discarded data goes to the trash encrypted, along with its entry
+	tr := &trash{rootDir: filepath.Join(dir, trashDirName), serverRootDir: dir, storage: fileStorage}
+	if _, err := tr.addCopy(bytes.NewReader(data), file.stagingPath(), 100); err != nil {
+		t.Error(err)
+		return
+	}
+	entries, err := tr.list()
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected one trash entry, got %v %v", entries, err)
+		return
+	}
+	trashed := filepath.Join(tr.rootDir, filepath.FromSlash(entries[0].ID))
+	if hash, err := fileStorage.hash(trashed); err != nil || hash != fmt.Sprintf("%x", sha256.Sum256(data[:100])) {
+		t.Errorf("Trashed copy does not hold the discarded data: %v", err)
+	}
+	if sidecar, _ := os.ReadFile(trashed + trashEntrySuffix); !crypto.IsSealed(sidecar) {
+		t.Errorf("Trash entry is stored in the clear")
+	}
+
+	// Without the keyring nothing can be read back
+	if hash, err := (storage{}).hash(file.stagingPath()); err == nil && hash == expectedHash {
+		t.Errorf("Encrypted file read back without the keyring")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := strings.Repeat("01", 32), strings.Repeat("02", 32)
+	keys := newTestKeyring(t, oldKey)
+	fileStorage := storage{keys: keys}
+	inner, err := db.GetDb("rekey.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer inner.Close()
+	s := &TorrxferServer{fileDb: fileStorage.sealDb(inner), storage: fileStorage}
+
+	data := bytes.Repeat([]byte("movie data "), 2000)
+	file := writeTestFile(t, filepath.Join(dir, "movie.mkv"), data, fileStorage)
+	text, err := file.MarshalText()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := s.fileDb.Put("hash", string(text)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	keys.Replace(newTestKeyring(t, newKey, oldKey))
+	summary, err := s.rekey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Rekeyed != 1 || summary.Busy != 0 || summary.Failed != 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if _, err := os.Stat(file.stagingPath() + rekeyFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the rekeyed copy to replace the file, got %v", err)
+	}
+
+	// Once rekeyed, everything is readable with the new key alone
+	keys.Replace(newTestKeyring(t, newKey))
+	if hash, err := fileStorage.hash(file.stagingPath()); err != nil || hash != fmt.Sprintf("%x", sha256.Sum256(data)) {
+		t.Errorf("File does not read back with the new key: %v", err)
+	}
+	if record, err := s.fileDb.Get("hash"); err != nil || record != string(text) {
+		t.Errorf("Record does not read back with the new key: %v", err)
+	}
+}
+
+func TestRekeyMigrate(t *testing.T) {
+	dir := t.TempDir()
+	keys := newTestKeyring(t, strings.Repeat("01", 32))
+	inner, err := db.GetDb("migrate.dat", dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer inner.Close()
+
+	// A file and records stored before encryption was enabled
+	data := bytes.Repeat([]byte("movie data "), 2000)
+	path := filepath.Join(dir, "movie.mkv")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	text, err := newFile(path, "movies", uint64(len(data)), storage{}).MarshalText()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := inner.Put("plain", string(text)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Without migrating they are neither trusted nor written to
+	fileStorage := storage{keys: keys}
+	s := &TorrxferServer{fileDb: fileStorage.sealDb(inner), storage: fileStorage}
+	if err := s.fileDb.Put("sealed", string(text)); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := fileStorage.hash(path); err != errUnsealedFile {
+		t.Errorf("Expected the plain file to be refused, got %v", err)
+	}
+	if _, err := s.fileDb.Get("plain"); err != crypto.ErrNotSealed {
+		t.Errorf("Expected the plain record to be refused, got %v", err)
+	}
+	summary, err := s.rekey()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Plain != 1 || summary.Sealed != 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if raw, _ := os.ReadFile(path); !bytes.Equal(raw, data) {
+		t.Errorf("Plain file was changed without migrating")
+	}
+
+	// Migrating reads them, and rekey encrypts them
+	fileStorage.migrate = true
+	s = &TorrxferServer{fileDb: fileStorage.sealDb(inner), storage: fileStorage}
+	if _, err := fileStorage.open(path, os.O_RDWR); err != errUnsealedFile {
+		t.Errorf("Expected the plain file not to be written to while migrating, got %v", err)
+	}
+	if summary, err = s.rekey(); err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Sealed != 1 || summary.Plain != 0 || summary.Failed != 0 {
+		t.Errorf("Unexpected summary %+v", summary)
+	}
+	if raw, _ := os.ReadFile(path); bytes.Contains(raw, []byte("movie data")) {
+		t.Errorf("Migrated file is stored in the clear")
+	}
+	if raw, _ := inner.Get("plain"); !crypto.IsSealed([]byte(raw)) {
+		t.Errorf("Migrated record is stored in the clear")
+	}
+
+	// Once migrated, everything is readable without migrating
+	fileStorage.migrate = false
+	s = &TorrxferServer{fileDb: fileStorage.sealDb(inner), storage: fileStorage}
+	if hash, err := fileStorage.hash(path); err != nil || hash != fmt.Sprintf("%x", sha256.Sum256(data)) {
+		t.Errorf("Migrated file does not read back: %v", err)
+	}
+	if record, err := s.fileDb.Get("plain"); err != nil || record != string(text) {
+		t.Errorf("Migrated record does not read back: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+	"github.com/sushshring/torrxfer/pkg/crypto"
+)
+
+// serverTLSConfig serves the certificate of certificates. If clientCAPath is set, certificates clients present must be
+// signed by one of the CAs in that bundle and the certificate subject becomes their identity. Clients without a
+// certificate are let through the handshake so they can pair, and are refused by net.EnsureClientCertificate for
+// everything else
+func serverTLSConfig(certificates *certificateReloader, clientCAPath string) (*tls.Config, error) {
+	config := &tls.Config{
+		// Looked up on every handshake so a reloaded certificate is used by new connections right away
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAPath == "" {
+		return config, nil
+	}
+	bundle, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in client CA file")
+	}
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// certificateReloader holds the server certificate and swaps it for a new one when its files change. Connections that
+// are already established keep the certificate they were made with, so transfers in progress are not interrupted
+type certificateReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	// modTime is the latest modification time of the files the current certificate was loaded from
+	modTime time.Time
+	sync.RWMutex
+}
+
+// newCertificateReloader loads the certificate and key at certPath and keyPath
+func newCertificateReloader(certPath, keyPath string) (*certificateReloader, error) {
+	r := &certificateReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate. Used as tls.Config.GetCertificate
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// fingerprint returns the fingerprint clients pin for the current certificate. See crypto.PinFingerprint
+func (r *certificateReloader) fingerprint() string {
+	r.RLock()
+	defer r.RUnlock()
+	return crypto.PinFingerprint(r.cert.Certificate)
+}
+
+// reload loads the certificate from disk. The current certificate is kept if the files cannot be loaded, for example
+// because only one of them has been replaced so far
+func (r *certificateReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	r.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.Unlock()
+	// Clients pin this fingerprint when they first connect
+	log.Info().Str("Fingerprint", crypto.PinFingerprint(cert.Certificate)).Time("Expires", leaf.NotAfter).Msg("Serving TLS certificate")
+	if time.Until(leaf.NotAfter) <= 0 {
+		log.Warn().Time("Expires", leaf.NotAfter).Msg("TLS certificate has expired")
+	}
+	return nil
+}
+
+// reloadIfChanged reloads the certificate if either of its files was modified since it was loaded
+func (r *certificateReloader) reloadIfChanged() {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		log.Debug().Err(err).Msg("Could not check TLS certificate files")
+		return
+	}
+	r.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.RUnlock()
+	if !changed {
+		return
+	}
+	if err := r.reload(); err != nil {
+		common.LogError(err, "Could not reload TLS certificate. Keeping the current certificate")
+	}
+}
+
+func (r *certificateReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certPath, r.keyPath} {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch checks the certificate files for changes every interval, and reloads the certificate on SIGHUP, until done is
+// closed. An interval of 0 only reloads on SIGHUP
+func (r *certificateReloader) watch(interval time.Duration, done <-chan struct{}) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	var pollChannel <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		pollChannel = ticker.C
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-hangups:
+			log.Info().Msg("Received SIGHUP. Reloading TLS certificate")
+			if err := r.reload(); err != nil {
+				common.LogError(err, "Could not reload TLS certificate. Keeping the current certificate")
+			}
+		case <-pollChannel:
+			r.reloadIfChanged()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and its key as PEM files to dir
+func writeTestCert(t *testing.T, dir, name string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		DNSNames:              []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tls")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	certPath, keyPath := writeTestCert(t, dir, "server")
+	clientCAPath, _ := writeTestCert(t, dir, "clients")
+
+	certificates, err := newCertificateReloader(certPath, keyPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	config, err := serverTLSConfig(certificates, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Errorf("Client certificates required without a client CA")
+	}
+
+	config, err = serverTLSConfig(certificates, clientCAPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven || config.ClientCAs == nil {
+		t.Errorf("Client certificates not verified with a client CA")
+	}
+
+	// A key is not a CA bundle
+	if _, err := serverTLSConfig(certificates, keyPath); err == nil {
+		t.Errorf("Expected client CA file without certificates to be rejected")
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tls")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	certPath, keyPath := writeTestCert(t, dir, "server")
+	certificates, err := newCertificateReloader(certPath, keyPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	first, _ := certificates.GetCertificate(nil)
+
+	// Unchanged files are not reloaded
+	certificates.reloadIfChanged()
+	if current, _ := certificates.GetCertificate(nil); current != first {
+		t.Errorf("Certificate reloaded without changes")
+	}
+
+	// Rotate the certificate. Timestamps are moved forward so the change is seen on filesystems with coarse times
+	writeTestCert(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	certificates.reloadIfChanged()
+	second, _ := certificates.GetCertificate(nil)
+	if bytes.Equal(second.Certificate[0], first.Certificate[0]) {
+		t.Errorf("Rotated certificate not reloaded")
+	}
+
+	// A half written rotation keeps the current certificate
+	if err := os.WriteFile(keyPath, []byte("not a key"), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(keyPath, later, later); err != nil {
+		t.Error(err)
+		return
+	}
+	certificates.reloadIfChanged()
+	if current, _ := certificates.GetCertificate(nil); current != second {
+		t.Errorf("Certificate replaced by one that could not be loaded")
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/sushshring/torrxfer/pkg/common"
+)
+
+const (
+	// trashDirName is the directory under the server root that holds files the server replaced or discarded
+	trashDirName string = ".trash"
+	// trashEntrySuffix marks the sidecar describing a trashed file
+	trashEntrySuffix string = ".torrxfer-trash"
+	trashDateFormat  string = "2006-01-02"
+)
+
+var (
+	errTrashEntryNotFound = errors.New("trash entry not found")
+	errTrashEntryOutside  = errors.New("trash entry restores outside the media directory")
+)
+
+// TrashEntry describes a file that was moved to the trash
+type TrashEntry struct {
+	// ID identifies the entry for restores. It is the path of the trashed file relative to the trash directory
+	ID           string    `json:"-"`
+	OriginalPath string    `json:"OriginalPath"`
+	TrashedAt    time.Time `json:"TrashedAt"`
+	Size         int64     `json:"Size"`
+	// Partial is set for the staged data of a transfer that never completed
+	Partial bool `json:"Partial"`
+	// Key and Record are the DB entry of the file. They are restored along with it
+	Key    string `json:"Key,omitempty"`
+	Record string `json:"Record,omitempty"`
+}
+
+// MarshalZerologObject implements the zerolog Object Marshaller for logging the entry
+func (e TrashEntry) MarshalZerologObject(event *zerolog.Event) {
+	event.Str("ID", e.ID).
+		Str("OriginalPath", e.OriginalPath).
+		Time("TrashedAt", e.TrashedAt).
+		Int64("Size", e.Size).
+		Bool("Partial", e.Partial)
+}
+
+// trash keeps displaced files in a dated tree under the server root until they expire
+type trash struct {
+	rootDir       string
+	serverRootDir string
+	maxAge        time.Duration
+	maxSize       uint64
+	// storage encrypts copies of files and the entries describing them if encryption at rest is enabled
+	storage storage
+	sync.Mutex
+}
+
+func openTrash(serverConf common.ServerConfig, fileStorage storage) *trash {
+	return &trash{
+		rootDir:       filepath.Join(serverConf.SaveDir.Filepath, trashDirName),
+		serverRootDir: serverConf.SaveDir.Filepath,
+		maxAge:        serverConf.TrashMaxAge,
+		maxSize:       uint64(serverConf.TrashMaxSize),
+		storage:       fileStorage,
+	}
+}
+
+// ListTrash returns the files in the trash of the media directory, oldest first
+func ListTrash(serverConf common.ServerConfig) ([]TrashEntry, error) {
+	fileStorage, err := openStorage(serverConf)
+	if err != nil {
+		return nil, err
+	}
+	return openTrash(serverConf, fileStorage).list()
+}
+
+// RestoreTrash moves a trashed file back to its original path and restores its DB record.
+// The server must not be running
+func RestoreTrash(serverConf common.ServerConfig, id string) (TrashEntry, error) {
+	fileStorage, err := openStorage(serverConf)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	entry, err := openTrash(serverConf, fileStorage).restore(id)
+	if err != nil || entry.Key == "" {
+		return entry, err
+	}
+	fileDb, err := openFileDb(serverConf, fileStorage)
+	if err != nil {
+		return entry, err
+	}
+	defer fileDb.Close()
+	return entry, fileDb.Put(entry.Key, entry.Record)
+}
+
+// add moves the file at path into the trash along with its DB entry
+func (t *trash) add(path, key, record string) (TrashEntry, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	return t.store(path, stat.Size(), key, record, func(dest string) error {
+		return os.Rename(path, dest)
+	})
+}
+
+// addCopy copies the first size bytes of r into the trash as the contents of path, for files that are truncated in place
+func (t *trash) addCopy(r io.Reader, path string, size int64) (TrashEntry, error) {
+	return t.store(path, size, "", "", func(dest string) error {
+		return t.storage.copyFile(r, dest, size)
+	})
+}
+
+func (t *trash) store(path string, size int64, key, record string, move func(dest string) error) (TrashEntry, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	entry := TrashEntry{
+		OriginalPath: path,
+		TrashedAt:    time.Now(),
+		Size:         size,
+		Partial:      strings.HasSuffix(path, partialFileSuffix),
+		Key:          key,
+		Record:       record,
+	}
+	relativePath, err := filepath.Rel(t.serverRootDir, path)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		relativePath = filepath.Base(path)
+	}
+	dest := nextFreePath(filepath.Join(t.rootDir, entry.TrashedAt.Format(trashDateFormat), relativePath), nil)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		common.LogErrorStack(err, "Could not create trash directory")
+		return entry, err
+	}
+	if err := move(dest); err != nil {
+		common.LogErrorStack(err, "Could not move file to trash")
+		return entry, err
+	}
+	entry.ID = t.entryID(dest)
+	text, err := json.Marshal(entry)
+	if err == nil {
+		text, err = t.storage.sealMetadata(text)
+	}
+	if err == nil {
+		err = os.WriteFile(dest+trashEntrySuffix, text, 0644)
+	}
+	if err != nil {
+		// A trashed file without its sidecar could never be restored or purged
+		common.LogErrorStack(err, "Could not record trash entry")
+		os.Remove(dest)
+		return entry, err
+	}
+	if err := t.purgeLocked(); err != nil {
+		common.LogError(err, "Could not purge trash")
+	}
+	return entry, nil
+}
+
+// list returns every entry in the trash, oldest first
+func (t *trash) list() ([]TrashEntry, error) {
+	entries := make([]TrashEntry, 0)
+	err := filepath.Walk(t.rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == t.rootDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, trashEntrySuffix) {
+			return nil
+		}
+		entry, err := t.readEntry(strings.TrimSuffix(path, trashEntrySuffix))
+		if err != nil {
+			log.Debug().Err(err).Str("Path", path).Msg("Skipping unreadable trash entry")
+			return nil
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TrashedAt.Before(entries[j].TrashedAt) })
+	return entries, err
+}
+
+// restore moves the entry with the given ID back to its original path. Nothing is overwritten to do so
+func (t *trash) restore(id string) (TrashEntry, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	path := filepath.Join(t.rootDir, filepath.FromSlash(id))
+	if relativePath, err := filepath.Rel(t.rootDir, path); err != nil || strings.HasPrefix(relativePath, "..") {
+		return TrashEntry{}, fmt.Errorf("%w: %s", errTrashEntryNotFound, id)
+	}
+	entry, err := t.readEntry(path)
+	if err != nil {
+		return entry, err
+	}
+	// The entry is only as trustworthy as whoever could write to the trash, so it may not point anywhere else
+	if err := t.checkOriginalPath(entry); err != nil {
+		return entry, err
+	}
+	if _, err := os.Stat(entry.OriginalPath); err == nil {
+		return entry, fmt.Errorf("cannot restore %s: %w", entry.OriginalPath, os.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.OriginalPath), 0755); err != nil {
+		return entry, err
+	}
+	if err := os.Rename(path, entry.OriginalPath); err != nil {
+		return entry, err
+	}
+	t.removeEntry(path)
+	return entry, nil
+}
+
+// purge removes entries older than the maximum age, then the oldest entries until the trash fits in its maximum size
+func (t *trash) purge() error {
+	t.Lock()
+	defer t.Unlock()
+	return t.purgeLocked()
+}
+
+func (t *trash) purgeLocked() error {
+	if t.maxAge <= 0 && t.maxSize == 0 {
+		return nil
+	}
+	entries, err := t.list()
+	if err != nil {
+		return err
+	}
+	var total uint64
+	for _, entry := range entries {
+		total += uint64(entry.Size)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		expired := t.maxAge > 0 && now.Sub(entry.TrashedAt) > t.maxAge
+		if !expired && (t.maxSize == 0 || total <= t.maxSize) {
+			break
+		}
+		log.Debug().Object("Entry", entry).Msg("Purging trashed file")
+		path := filepath.Join(t.rootDir, filepath.FromSlash(entry.ID))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			common.LogError(err, "Could not purge trashed file")
+			continue
+		}
+		t.removeEntry(path)
+		total -= uint64(entry.Size)
+	}
+	return nil
+}
+
+// checkOriginalPath returns an error unless entry restores to a path under the media directory
+func (t *trash) checkOriginalPath(entry TrashEntry) error {
+	originalPath := filepath.Clean(entry.OriginalPath)
+	relativePath, err := filepath.Rel(t.serverRootDir, originalPath)
+	if !filepath.IsAbs(originalPath) || err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s", errTrashEntryOutside, entry.OriginalPath)
+	}
+	// The trash itself is under the media directory, but nothing is restored into it
+	if relativePath == trashDirName || strings.HasPrefix(relativePath, trashDirName+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s", errTrashEntryOutside, entry.OriginalPath)
+	}
+	if err := resolvesWithin(t.serverRootDir, originalPath); err != nil {
+		return fmt.Errorf("%w: %s: %v", errTrashEntryOutside, entry.OriginalPath, err)
+	}
+	return nil
+}
+
+func (t *trash) readEntry(path string) (TrashEntry, error) {
+	var entry TrashEntry
+	text, err := os.ReadFile(path + trashEntrySuffix)
+	if os.IsNotExist(err) {
+		return entry, fmt.Errorf("%w: %s", errTrashEntryNotFound, t.entryID(path))
+	}
+	if err != nil {
+		return entry, err
+	}
+	if text, err = t.storage.openMetadata(text); err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(text, &entry); err != nil {
+		return entry, err
+	}
+	entry.ID = t.entryID(path)
+	return entry, nil
+}
+
+// removeEntry deletes the sidecar of a trashed file and any directories left empty
+func (t *trash) removeEntry(path string) {
+	os.Remove(path + trashEntrySuffix)
+	for dir := filepath.Dir(path); dir != t.rootDir && strings.HasPrefix(dir, t.rootDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+func (t *trash) entryID(path string) string {
+	relativePath, err := filepath.Rel(t.rootDir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+// discardFile moves a file the server is about to replace or throw away into the trash, or deletes it if the trash is
+// disabled. A complete file takes its DB record with it, and no longer counts towards the quota of the client that
+// transferred it
+func (s *TorrxferServer) discardFile(path string) error {
+	var key, record string
+	if !strings.HasSuffix(path, partialFileSuffix) && (s.trash != nil || s.policies != nil) {
+		key, record = s.findRecord(path)
+	}
+	s.replaceMux.Lock()
+	defer s.replaceMux.Unlock()
+	if s.trash == nil {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		s.releaseCharge(key)
+		return nil
+	}
+	entry, err := s.trash.add(path, key, record)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		s.fileDb.Delete(key)
+	}
+	s.releaseCharge(key)
+	log.Info().Object("Entry", entry).Msg("Moved file to trash")
+	return nil
+}
+
+// findRecord returns the DB entry describing the complete file at path, if there is one
+func (s *TorrxferServer) findRecord(path string) (key, record string) {
+	hash, err := s.storage.hash(path)
+	if err != nil || !s.fileDb.Has(hash) {
+		return "", ""
+	}
+	record, err = s.fileDb.Get(hash)
+	if err != nil {
+		return "", ""
+	}
+	// Identical content stored under another name has the same key
+	file := new(File)
+	if err := file.UnmarshalText([]byte(record)); err != nil || file.fullPath != path {
+		return "", ""
+	}
+	return hash, record
+}
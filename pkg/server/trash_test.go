@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTrash(t *testing.T) *trash {
+	dir, err := os.MkdirTemp("", "trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &trash{rootDir: filepath.Join(dir, trashDirName), serverRootDir: dir}
+}
+
+func TestTrashRestore(t *testing.T) {
+	tr := newTestTrash(t)
+	path := filepath.Join(tr.serverRootDir, "tv", "episode.mkv")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := os.WriteFile(path, []byte("old data"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	entry, err := tr.add(path, "key", "record")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("File was not moved to trash: %v", err)
+	}
+	if !strings.HasSuffix(entry.ID, "/tv/episode.mkv") {
+		t.Errorf("Unexpected entry ID %s", entry.ID)
+	}
+
+	// A new file took its place, so restoring must not overwrite it
+	if err := os.WriteFile(path, []byte("new data"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := tr.restore(entry.ID); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected restore to refuse overwriting, got %v", err)
+	}
+	os.Remove(path)
+	restored, err := tr.restore(entry.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if restored.Key != "key" || restored.Record != "record" {
+		t.Errorf("DB entry was not kept: %+v", restored)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "old data" {
+		t.Errorf("Incorrect restored data %q: %v", data, err)
+	}
+	if entries, err := tr.list(); err != nil || len(entries) != 0 {
+		t.Errorf("Expected empty trash, got %v: %v", entries, err)
+	}
+	if _, err := tr.restore("../tv/episode.mkv"); !errors.Is(err, errTrashEntryNotFound) {
+		t.Errorf("Expected restore outside the trash to fail, got %v", err)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	tr := newTestTrash(t)
+	tr.maxSize = 10
+	// The oldest file is purged once the third pushes the trash over its limit
+	expected := []int{1, 2, 2}
+	for i, data := range []string{"1234", "5678", "abcd"} {
+		if _, err := tr.addCopy(strings.NewReader(data), filepath.Join(tr.serverRootDir, "file"), int64(len(data))); err != nil {
+			t.Error(err)
+			return
+		}
+		entries, err := tr.list()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(entries) != expected[i] {
+			t.Errorf("Incorrect number of entries after file %d. Expected: %d got %d", i, expected[i], len(entries))
+		}
+	}
+
+	tr.maxSize = 0
+	tr.maxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err := tr.purge(); err != nil {
+		t.Error(err)
+		return
+	}
+	if entries, err := tr.list(); err != nil || len(entries) != 0 {
+		t.Errorf("Expected expired entries to be purged, got %v: %v", entries, err)
+	}
+}
+
+func TestTrashRestoreForgedEntry(t *testing.T) {
+	tr := newTestTrash(t)
+	outside := filepath.Join(t.TempDir(), "authorized_keys")
+	forged := map[string]string{
+		"outside":  outside,
+		"relative": "tv/episode.mkv",
+		"parent":   filepath.Join(tr.serverRootDir, "tv", "..", "..", "etc", "passwd"),
+		"trash":    filepath.Join(tr.rootDir, "2021-01-01", "tv", "episode.mkv"),
+	}
+	for name, originalPath := range forged {
+		path := filepath.Join(tr.rootDir, "2021-01-01", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := os.WriteFile(path, []byte("client data"), 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		text, _ := json.Marshal(TrashEntry{OriginalPath: originalPath})
+		if err := os.WriteFile(path+trashEntrySuffix, text, 0644); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := tr.restore("2021-01-01/" + name); !errors.Is(err, errTrashEntryOutside) {
+			t.Errorf("Expected restore to %s to be refused, got %v", originalPath, err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected the trashed file to stay put: %v", err)
+		}
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be restored outside the media directory: %v", err)
+	}
+}
+
+func TestTrashUnsealedEntry(t *testing.T) {
+	tr := newTestTrash(t)
+	tr.storage = storage{keys: newTestKeyring(t, strings.Repeat("01", 32))}
+	path := filepath.Join(tr.rootDir, "2021-01-01", "episode.mkv")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := os.WriteFile(path, []byte("client data"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	text, _ := json.Marshal(TrashEntry{OriginalPath: filepath.Join(tr.serverRootDir, "episode.mkv")})
+	if err := os.WriteFile(path+trashEntrySuffix, text, 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	// With encryption at rest only entries the server sealed are trusted
+	if _, err := tr.restore("2021-01-01/episode.mkv"); !errors.Is(err, errUnsealedMetadata) {
+		t.Errorf("Expected an unsealed entry to be refused, got %v", err)
+	}
+	if entries, err := tr.list(); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the unsealed entry to be skipped, got %v: %v", entries, err)
+	}
+}
@@ -0,0 +1,258 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// RpcTorrxferServerClient is the client API for RpcTorrxferServer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RpcTorrxferServerClient interface {
+	// Exchange the capabilities of client and server. Clients call it first on every connection. The server refuses
+	// clients it cannot work with, and replies with its own capabilities so the client can check them too
+	Hello(ctx context.Context, in *Capabilities, opts ...grpc.CallOption) (*Capabilities, error)
+	// Transfer a stream of bytes for a file. The server periodically acknowledges how much of the file is durable
+	// and how far ahead of that the client may send. The last response carries the summary of the transferred file
+	TransferFile(ctx context.Context, opts ...grpc.CallOption) (RpcTorrxferServer_TransferFileClient, error)
+	// Query the status of the transferred file and return a summary of the file
+	// If a file is partially transmitted, the FileSummary will include the amount of data already recorded
+	QueryFile(ctx context.Context, in *File, opts ...grpc.CallOption) (*File, error)
+	// Exchange a pairing code created on the server for a long-lived client credential
+	// The code itself is never sent. Both sides prove they know it over the fingerprint the client pins for the server
+	Pair(ctx context.Context, in *PairRequest, opts ...grpc.CallOption) (*PairResponse, error)
+}
+
+type rpcTorrxferServerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRpcTorrxferServerClient(cc grpc.ClientConnInterface) RpcTorrxferServerClient {
+	return &rpcTorrxferServerClient{cc}
+}
+
+func (c *rpcTorrxferServerClient) Hello(ctx context.Context, in *Capabilities, opts ...grpc.CallOption) (*Capabilities, error) {
+	out := new(Capabilities)
+	err := c.cc.Invoke(ctx, "/RpcTorrxferServer/Hello", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rpcTorrxferServerClient) TransferFile(ctx context.Context, opts ...grpc.CallOption) (RpcTorrxferServer_TransferFileClient, error) {
+	stream, err := c.cc.NewStream(ctx, &RpcTorrxferServer_ServiceDesc.Streams[0], "/RpcTorrxferServer/TransferFile", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &rpcTorrxferServerTransferFileClient{stream}
+	return x, nil
+}
+
+type RpcTorrxferServer_TransferFileClient interface {
+	Send(*TransferFileRequest) error
+	Recv() (*TransferFileResponse, error)
+	grpc.ClientStream
+}
+
+type rpcTorrxferServerTransferFileClient struct {
+	grpc.ClientStream
+}
+
+func (x *rpcTorrxferServerTransferFileClient) Send(m *TransferFileRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *rpcTorrxferServerTransferFileClient) Recv() (*TransferFileResponse, error) {
+	m := new(TransferFileResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *rpcTorrxferServerClient) QueryFile(ctx context.Context, in *File, opts ...grpc.CallOption) (*File, error) {
+	out := new(File)
+	err := c.cc.Invoke(ctx, "/RpcTorrxferServer/QueryFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rpcTorrxferServerClient) Pair(ctx context.Context, in *PairRequest, opts ...grpc.CallOption) (*PairResponse, error) {
+	out := new(PairResponse)
+	err := c.cc.Invoke(ctx, "/RpcTorrxferServer/Pair", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RpcTorrxferServerServer is the server API for RpcTorrxferServer service.
+// All implementations must embed UnimplementedRpcTorrxferServerServer
+// for forward compatibility
+type RpcTorrxferServerServer interface {
+	// Exchange the capabilities of client and server. Clients call it first on every connection. The server refuses
+	// clients it cannot work with, and replies with its own capabilities so the client can check them too
+	Hello(context.Context, *Capabilities) (*Capabilities, error)
+	// Transfer a stream of bytes for a file. The server periodically acknowledges how much of the file is durable
+	// and how far ahead of that the client may send. The last response carries the summary of the transferred file
+	TransferFile(RpcTorrxferServer_TransferFileServer) error
+	// Query the status of the transferred file and return a summary of the file
+	// If a file is partially transmitted, the FileSummary will include the amount of data already recorded
+	QueryFile(context.Context, *File) (*File, error)
+	// Exchange a pairing code created on the server for a long-lived client credential
+	// The code itself is never sent. Both sides prove they know it over the fingerprint the client pins for the server
+	Pair(context.Context, *PairRequest) (*PairResponse, error)
+	mustEmbedUnimplementedRpcTorrxferServerServer()
+}
+
+// UnimplementedRpcTorrxferServerServer must be embedded to have forward compatible implementations.
+type UnimplementedRpcTorrxferServerServer struct {
+}
+
+func (UnimplementedRpcTorrxferServerServer) Hello(context.Context, *Capabilities) (*Capabilities, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Hello not implemented")
+}
+func (UnimplementedRpcTorrxferServerServer) TransferFile(RpcTorrxferServer_TransferFileServer) error {
+	return status.Errorf(codes.Unimplemented, "method TransferFile not implemented")
+}
+func (UnimplementedRpcTorrxferServerServer) QueryFile(context.Context, *File) (*File, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryFile not implemented")
+}
+func (UnimplementedRpcTorrxferServerServer) Pair(context.Context, *PairRequest) (*PairResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Pair not implemented")
+}
+func (UnimplementedRpcTorrxferServerServer) mustEmbedUnimplementedRpcTorrxferServerServer() {}
+
+// UnsafeRpcTorrxferServerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RpcTorrxferServerServer will
+// result in compilation errors.
+type UnsafeRpcTorrxferServerServer interface {
+	mustEmbedUnimplementedRpcTorrxferServerServer()
+}
+
+func RegisterRpcTorrxferServerServer(s grpc.ServiceRegistrar, srv RpcTorrxferServerServer) {
+	s.RegisterService(&RpcTorrxferServer_ServiceDesc, srv)
+}
+
+func _RpcTorrxferServer_Hello_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Capabilities)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RpcTorrxferServerServer).Hello(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/RpcTorrxferServer/Hello",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RpcTorrxferServerServer).Hello(ctx, req.(*Capabilities))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RpcTorrxferServer_TransferFile_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RpcTorrxferServerServer).TransferFile(&rpcTorrxferServerTransferFileServer{stream})
+}
+
+type RpcTorrxferServer_TransferFileServer interface {
+	Send(*TransferFileResponse) error
+	Recv() (*TransferFileRequest, error)
+	grpc.ServerStream
+}
+
+type rpcTorrxferServerTransferFileServer struct {
+	grpc.ServerStream
+}
+
+func (x *rpcTorrxferServerTransferFileServer) Send(m *TransferFileResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *rpcTorrxferServerTransferFileServer) Recv() (*TransferFileRequest, error) {
+	m := new(TransferFileRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _RpcTorrxferServer_QueryFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(File)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RpcTorrxferServerServer).QueryFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/RpcTorrxferServer/QueryFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RpcTorrxferServerServer).QueryFile(ctx, req.(*File))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RpcTorrxferServer_Pair_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PairRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RpcTorrxferServerServer).Pair(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/RpcTorrxferServer/Pair",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RpcTorrxferServerServer).Pair(ctx, req.(*PairRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RpcTorrxferServer_ServiceDesc is the grpc.ServiceDesc for RpcTorrxferServer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RpcTorrxferServer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "RpcTorrxferServer",
+	HandlerType: (*RpcTorrxferServerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Hello",
+			Handler:    _RpcTorrxferServer_Hello_Handler,
+		},
+		{
+			MethodName: "QueryFile",
+			Handler:    _RpcTorrxferServer_QueryFile_Handler,
+		},
+		{
+			MethodName: "Pair",
+			Handler:    _RpcTorrxferServer_Pair_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TransferFile",
+			Handler:       _RpcTorrxferServer_TransferFile_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "server.proto",
+}